@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maxInternalRedirects bounds the internal redirects followed for one
+// request, so an origin redirecting in a loop gets a 502.
+const maxInternalRedirects = 5
+
+// followInternalRedirects swaps res for the response to the internal path
+// named by its internalRedirectHeader, the way nginx handles
+// X-Accel-Redirect, until a response names none. The result is cached under
+// the key of the original request. Paths outside internalRedirectPaths are
+// refused, and the header never reaches clients.
+func followInternalRedirects(res *http.Response, rt http.RoundTripper, cfg *config) error {
+	if cfg.internalRedirectHeader == "" || res.Header.Get(cfg.internalRedirectHeader) == "" {
+		return nil
+	}
+
+	if m := res.Request.Method; m != http.MethodGet && m != http.MethodHead {
+		res.Header.Del(cfg.internalRedirectHeader)
+
+		return nil
+	}
+
+	for hops := 0; ; hops++ {
+		target := res.Header.Get(cfg.internalRedirectHeader)
+		if target == "" {
+			return nil
+		}
+
+		if hops == maxInternalRedirects {
+			return fmt.Errorf("more than %d internal redirects for %s", maxInternalRedirects, res.Request.URL.Path)
+		}
+
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+			return fmt.Errorf("invalid internal redirect of %s to %q", res.Request.URL.Path, target)
+		}
+
+		p := path.Clean(u.Path)
+		if !cfg.internalRedirectAllowed(p) {
+			return fmt.Errorf("internal redirect of %s to %q outside INTERNAL_REDIRECT_PATHS", res.Request.URL.Path, target)
+		}
+
+		sub := res.Request.Clone(res.Request.Context())
+		sub.URL.Path, sub.URL.RawPath, sub.URL.RawQuery = p, "", u.RawQuery
+		dropConditionals(sub.Header)
+
+		next, err := rt.RoundTrip(sub)
+		if err != nil {
+			return err
+		}
+
+		replaceResponse(res, next)
+	}
+}
+
+// dropConditionals removes the validators of the original resource from a
+// request for another one, to which they don't apply.
+func dropConditionals(h http.Header) {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		h.Del(name)
+	}
+}
+
+// replaceResponse swaps res for next, fetched by the proxy itself, whose
+// hop-by-hop headers the reverse proxy won't remove.
+func replaceResponse(res, next *http.Response) {
+	_ = res.Body.Close()
+
+	for _, h := range next.Header.Values("Connection") {
+		for _, name := range strings.Split(h, ",") {
+			next.Header.Del(strings.TrimSpace(name))
+		}
+	}
+
+	next.Header.Del("Connection")
+
+	res.Status, res.StatusCode = next.Status, next.StatusCode
+	res.Header, res.Trailer = next.Header, next.Trailer
+	res.Body, res.ContentLength = next.Body, next.ContentLength
+}
+
+// internalRedirectAllowed reports whether p lies under one of the
+// internalRedirectPaths, on a segment boundary: /internal allows /internal
+// and /internal/a but not /internalx.
+func (cfg *config) internalRedirectAllowed(p string) bool {
+	for _, prefix := range cfg.internalRedirectPaths {
+		if p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// normalizeAccept rewrites Accept header values so that equivalent ones are
+// equal: media ranges lower-cased, parameters sorted, a q of 1 dropped and
+// ranges ordered by decreasing q, then alphabetically. An absent Accept and
+// */* both mean anything and normalize to "".
+func normalizeAccept(values []string) string {
+	type mediaRange struct {
+		value string
+		q     float64
+	}
+
+	var ranges []mediaRange
+
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			parts := strings.Split(item, ";")
+
+			mt := strings.ToLower(strings.TrimSpace(parts[0]))
+			if mt == "" {
+				continue
+			}
+
+			q := 1.0
+			var params []string
+
+			for _, p := range parts[1:] {
+				k, v, _ := strings.Cut(p, "=")
+				k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+
+				if k != "q" {
+					params = append(params, k+"="+v)
+
+					continue
+				}
+
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+
+			sort.Strings(params)
+
+			if q != 1 {
+				params = append(params, "q="+strconv.FormatFloat(q, 'f', -1, 64))
+			}
+
+			ranges = append(ranges, mediaRange{value: strings.Join(append([]string{mt}, params...), ";"), q: q})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+
+		return ranges[i].value < ranges[j].value
+	})
+
+	out := make([]string, len(ranges))
+	for i, r := range ranges {
+		out[i] = r.value
+	}
+
+	if s := strings.Join(out, ","); s != "*/*" {
+		return s
+	}
+
+	return ""
+}
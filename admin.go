@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminOnly guards h with the ADMIN_SECRET bearer token. Admin routes are
+// unreachable while no secret is configured.
+func adminOnly(cfg *config, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if cfg.adminSecret == "" || !ok ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(cfg.adminSecret)) != 1 {
+			cfg.writeError(w, r, http.StatusUnauthorized)
+
+			return
+		}
+
+		if cfg.adminMaxBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.adminMaxBody)
+		}
+
+		if cfg.adminTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), cfg.adminTimeout)
+			defer cancel()
+
+			// The deadlines replace the ones of the listener, which may be
+			// too short for a snapshot or too long for everything else.
+			rc := http.NewResponseController(w)
+			deadline := time.Now().Add(cfg.adminTimeout)
+			_ = rc.SetReadDeadline(deadline)
+			_ = rc.SetWriteDeadline(deadline)
+
+			r = r.WithContext(ctx)
+		}
+
+		h(w, r)
+	}
+}
+
+// maintenanceHandler reports maintenance mode on GET, enables it on POST/PUT
+// and disables it on DELETE.
+func maintenanceHandler(c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			c.maintenance.Store(true)
+			log.Println("maintenance mode enabled")
+		case http.MethodDelete:
+			c.maintenance.Store(false)
+			log.Println("maintenance mode disabled")
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			cfg.writeError(w, r, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		_, _ = fmt.Fprintf(w, "maintenance: %t\n", c.maintenance.Load())
+	}
+}
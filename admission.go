@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	AdmissionPolicyNone       = "none"
+	AdmissionPolicySeenBefore = "seen-before"
+)
+
+// admissionFilter only admits keys into the cache on their second request
+// within the window, keeping one-hit wonders from evicting hot entries.
+// Sightings are kept as hashes in two generations that rotate every window,
+// or earlier once maxKeys are tracked, which bounds its memory.
+type admissionFilter struct {
+	mu       sync.Mutex
+	window   time.Duration
+	maxKeys  int
+	current  map[uint64]struct{}
+	previous map[uint64]struct{}
+	rotated  time.Time
+}
+
+func newAdmissionFilter(window time.Duration, maxKeys int, now time.Time) *admissionFilter {
+	return &admissionFilter{
+		window:   window,
+		maxKeys:  maxKeys,
+		current:  make(map[uint64]struct{}),
+		previous: make(map[uint64]struct{}),
+		rotated:  now,
+	}
+}
+
+// admit records a request for key at now and reports whether it was seen
+// before.
+func (f *admissionFilter) admit(key string, now time.Time) bool {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.rotated) >= f.window || len(f.current) >= f.maxKeys {
+		f.previous, f.current = f.current, make(map[uint64]struct{})
+		f.rotated = now
+	}
+
+	_, seen := f.current[sum]
+	if !seen {
+		_, seen = f.previous[sum]
+	}
+
+	f.current[sum] = struct{}{}
+
+	return seen
+}
+
+type bypassAdmissionKey struct{}
+
+// withBypassAdmission marks requests made by the proxy itself, like warming,
+// whose responses are always admitted.
+func withBypassAdmission(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassAdmissionKey{}, true)
+}
+
+// admits reports whether the response to r may be stored under key.
+func (c *cache) admits(r *http.Request, key string) bool {
+	if c.admission == nil || r.Context().Value(bypassAdmissionKey{}) != nil {
+		return true
+	}
+
+	return c.admission.admit(key, c.clock.Now())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionFilter(t *testing.T) {
+	now := time.Now()
+	f := newAdmissionFilter(time.Hour, 2, now)
+
+	if f.admit("/a", now) {
+		t.Error("expected first sighting not to be admitted")
+	}
+
+	if !f.admit("/a", now) {
+		t.Error("expected second sighting to be admitted")
+	}
+
+	f.admit("/b", now)
+	f.admit("/c", now)
+
+	if !f.admit("/c", now) {
+		t.Error("expected sightings to survive one rotation")
+	}
+
+	// Two windows later the filter rotated twice.
+	f.admit("/d", now.Add(time.Hour))
+
+	if f.admit("/a", now.Add(2*time.Hour)) {
+		t.Error("expected sightings to be forgotten after two windows")
+	}
+}
+
+func TestSeenBeforeAdmission(t *testing.T) {
+	var requests int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.admission = newAdmissionFilter(time.Hour, 100, time.Now())
+
+	var xCache []string
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(proxyServer.URL + "/test")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+		xCache = append(xCache, resp.Header.Get("X-Cache"))
+	}
+
+	if xCache[0] != XCacheMiss || xCache[1] != XCacheMiss || xCache[2] != XCacheHit {
+		t.Errorf("expected MISS, MISS, HIT, got %v", xCache)
+	}
+
+	if requests != 2 {
+		t.Errorf("expected 2 origin requests, got %d", requests)
+	}
+}
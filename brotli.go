@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+func isBrotli(h http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(h.Get("Content-Encoding")), "br")
+}
+
+// wantsGzipForBrotli reports whether a client sending h needs a Brotli body
+// in gzip: it takes gzip but not br.
+func wantsGzipForBrotli(h http.Header) bool {
+	ae := parseAcceptEncoding(h)
+
+	return ae.quality("br") == 0 && ae.preferredEncoding("gzip") == "gzip"
+}
+
+// varyOnEncoding lists Accept-Encoding in Vary unless the origin did.
+func varyOnEncoding(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" || strings.EqualFold(name, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+
+	h.Add("Vary", "Accept-Encoding")
+}
+
+func brotliToGzip(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	if _, err := io.Copy(gz, brotli.NewReader(bytes.NewReader(b))); err != nil {
+		return nil, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func brotliBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	bw := brotli.NewWriter(&buf)
+	if _, err := bw.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// transcodeBrotli serves the Brotli entry d in gzip to clients that need it.
+// The gzipped body is kept with the entry like in identity mode, so it is
+// transcoded once per entry.
+func (c *cache) transcodeBrotli(r *http.Request, d cacheData) cacheData {
+	v := d
+	v.header = d.header.Clone()
+	varyOnEncoding(v.header)
+
+	if !wantsGzipForBrotli(r.Header) || !bodyAllowed(d.status) {
+		return v
+	}
+
+	if d.gzipBody == nil {
+		b, err := brotliToGzip(d.body)
+		if err != nil {
+			log.Printf("can't transcode %s from brotli %s", r.URL.RequestURI(), err)
+
+			return v
+		}
+
+		d.gzipBody = b
+		c.attachGzip(c.key(r), d)
+	}
+
+	v.body = d.gzipBody
+	v.header.Set("Content-Encoding", "gzip")
+	v.header.Set("Content-Length", strconv.Itoa(len(v.body)))
+
+	return v
+}
+
+// transcodeBrotliResponse streams a Brotli response from the origin to the
+// client in gzip when it needs it. The entry stored for it keeps the Brotli
+// body.
+func transcodeBrotliResponse(res *http.Response, cfg *config) {
+	if !cfg.brotliToGzip || !isBrotli(res.Header) {
+		return
+	}
+
+	varyOnEncoding(res.Header)
+
+	if !wantsGzipForBrotli(res.Request.Header) || !bodyAllowed(res.StatusCode) {
+		return
+	}
+
+	res.Header.Set("Content-Encoding", "gzip")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+
+	if res.Request.Method == http.MethodHead {
+		return
+	}
+
+	res.Body = transcodeBody(res.Body, func(dst io.Writer, src io.Reader) error {
+		gz := gzip.NewWriter(dst)
+		if _, err := io.Copy(gz, brotli.NewReader(src)); err != nil {
+			return err
+		}
+
+		return gz.Close()
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// defaultMaxPooledBuffer bounds the buffers kept in a bodyPool, so a single
+// huge response does not pin its memory in the pool.
+const defaultMaxPooledBuffer = 1 << 20
+
+// bodyPool reads response bodies into pooled buffers to avoid growing a
+// fresh buffer per miss. Only right-sized copies leave the pool, stored
+// entries never reference a pooled buffer.
+type bodyPool struct {
+	pool    sync.Pool
+	maxSize int
+}
+
+func newBodyPool(maxSize int) *bodyPool {
+	return &bodyPool{
+		pool:    sync.Pool{New: func() any { return new(bytes.Buffer) }},
+		maxSize: maxSize,
+	}
+}
+
+// read reads r to the end. sizeHint, usually the Content-Length, presizes the
+// buffer when known.
+func (p *bodyPool) read(r io.Reader, sizeHint int64) ([]byte, error) {
+	buf := p.pool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	if sizeHint > 0 && sizeHint <= int64(p.maxSize) {
+		// ReadFrom wants MinRead spare bytes before it detects EOF.
+		buf.Grow(int(sizeHint) + bytes.MinRead)
+	}
+
+	_, err := buf.ReadFrom(r)
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+
+	if buf.Cap() <= p.maxSize {
+		p.pool.Put(buf)
+	}
+
+	return b, err
+}
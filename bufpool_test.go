@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestBodyPoolReturnsCopies(t *testing.T) {
+	p := newBodyPool(defaultMaxPooledBuffer)
+
+	a, err := p.read(bytes.NewReader([]byte("first")), 5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	b, err := p.read(bytes.NewReader([]byte("other")), 5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	if string(a) != "first" || string(b) != "other" {
+		t.Errorf("expected independent bodies, got %q and %q", a, b)
+	}
+
+	if cap(a) != len(a) {
+		t.Errorf("expected right-sized body, got len %d cap %d", len(a), cap(a))
+	}
+}
+
+var benchBody = bytes.Repeat([]byte("x"), 64<<10)
+
+func BenchmarkReadAll(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = io.ReadAll(bytes.NewReader(benchBody))
+	}
+}
+
+func BenchmarkBodyPool(b *testing.B) {
+	p := newBodyPool(defaultMaxPooledBuffer)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = p.read(bytes.NewReader(benchBody), int64(len(benchBody)))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cannedResponse is served for a path without contacting the origin or the
+// cache.
+type cannedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// envCannedResponses reads semicolon separated "path: status type body"
+// rules. A body starting with @ names the file holding it, read once here.
+func (l *configLoader) envCannedResponses(name string) map[string]cannedResponse {
+	canned := make(map[string]cannedResponse)
+
+	for _, item := range strings.Split(os.Getenv(name), ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		path, rest, ok := strings.Cut(item, ":")
+		path = strings.TrimSpace(path)
+
+		status, rest, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		contentType, body, _ := strings.Cut(strings.TrimSpace(rest), " ")
+
+		code, err := strconv.Atoi(status)
+		if !ok || !strings.HasPrefix(path, "/") || err != nil || code < 100 || code > 599 || contentType == "" {
+			l.errorf("invalid %s entry %q, expected path: status type body", name, item)
+
+			continue
+		}
+
+		resp := cannedResponse{status: code, contentType: contentType, body: []byte(strings.TrimSpace(body))}
+
+		if file, ok := strings.CutPrefix(string(resp.body), "@"); ok {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				l.errorf("cannot read %s body %s", name, err)
+
+				continue
+			}
+
+			resp.body = b
+		}
+
+		canned[path] = resp
+	}
+
+	return canned
+}
+
+// serveCanned answers GET and HEAD requests with resp.
+func serveCanned(w http.ResponseWriter, r *http.Request, resp cannedResponse, cfg *config) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		cfg.writeError(w, r, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", resp.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.body)))
+	cfg.applyAddHeaders(w.Header())
+	w.WriteHeader(resp.status)
+
+	if r.Method == http.MethodHead || !bodyAllowed(resp.status) {
+		return
+	}
+
+	if _, err := w.Write(resp.body); err != nil {
+		log.Printf("can't write to body %s", err)
+	}
+}
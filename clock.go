@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// Clock tells the time entries are stored at and aged by, Expires counts
+// from without a Date, upstream round trips are timed by, and that rate limit
+// backoffs, the admission window and TTL overrides run out on. Caches use the
+// real clock, tests swap in a fake one to expire entries without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// since is how long ago t was on the clock of the cache.
+func (c *cache) since(t time.Time) time.Duration {
+	return c.clock.Now().Sub(t)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+}
+
+func TestFakeClockExpiry(t *testing.T) {
+	var upstream int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream++
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	clock := newFakeClock()
+	c.clock = clock
+	c.grace = time.Minute
+
+	get := func(cacheControl string) string {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp.Header.Get("X-Cache")
+	}
+
+	get("")
+
+	clock.advance(59 * time.Second)
+
+	if got := get(""); got != XCacheHit {
+		t.Errorf("expected HIT within max-age, got %q", got)
+	}
+
+	clock.advance(2 * time.Second)
+
+	if got := get("max-stale=10"); got != XCacheStale {
+		t.Errorf("expected STALE within max-stale, got %q", got)
+	}
+
+	if got := get(""); got != XCacheMiss || upstream != 2 {
+		t.Errorf("expected the expired entry fetched again, got %q after %d upstream requests", got, upstream)
+	}
+
+	clock.advance(90 * time.Second)
+	c.cleanup()
+
+	if _, ok := c.data["/test"]; !ok {
+		t.Fatal("expected the entry kept within its grace period")
+	}
+
+	clock.advance(time.Minute)
+	c.cleanup()
+
+	if _, ok := c.data["/test"]; ok {
+		t.Error("expected cleanup to delete the entry past its grace period")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup coalesces concurrent misses of the same cache key into a
+// single upstream request. There is one group per cache, keyed on the full
+// cache key, so every request for a key shares the same flight.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is the miss of one key in progress. done is closed when it lands.
+type flight struct {
+	done chan struct{}
+
+	// shed is set when the leader was shed for the fill limit, which its
+	// followers are then shed for too instead of each fetching the key.
+	shed atomic.Bool
+}
+
+type flightKey struct{}
+
+// join makes the caller the leader of the flight for key when there is none
+// yet. The leader must call done once the response has been stored, which
+// may happen more than once; the others wait on the done channel of the
+// flight and then look the key up again.
+func (g *flightGroup) join(key string) (f *flight, done func(), leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		return f, nil, false
+	}
+
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+
+	f = &flight{done: make(chan struct{})}
+	g.flights[key] = f
+
+	var once sync.Once
+
+	return f, func() {
+		once.Do(func() {
+			g.mu.Lock()
+			delete(g.flights, key)
+			g.mu.Unlock()
+
+			close(f.done)
+		})
+	}, true
+}
+
+// landFlight ends the flight the request leads, if any, as soon as its
+// response was stored or found uncacheable, rather than once its body was
+// sent. Streamed bodies may never end.
+func landFlight(r *http.Request) {
+	if done, ok := r.Context().Value(flightKey{}).(func()); ok {
+		done()
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestColdKeyCoalesced(t *testing.T) {
+	const clients = 100
+
+	var requests, arrivals atomic.Int64
+
+	// The origin answers once every client reached the proxy.
+	arrived := make(chan struct{})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-arrived
+		_, _ = w.Write([]byte("payload"))
+	}))
+
+	defer backend.Close()
+
+	c := newCache(time.Hour)
+	h := newProxy(backend.URL, c, &config{}).Handler()
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if arrivals.Add(1) == clients {
+			close(arrived)
+		}
+
+		h.ServeHTTP(w, r)
+	}))
+
+	defer proxyServer.Close()
+
+	var wg sync.WaitGroup
+
+	for range clients {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			resp, err := http.Get(proxyServer.URL + "/test")
+			if err != nil {
+				t.Errorf("proxy request failed: %v", err)
+
+				return
+			}
+
+			defer resp.Body.Close()
+
+			if body, _ := io.ReadAll(resp.Body); string(body) != "payload" {
+				t.Errorf("expected body %q, got %q", "payload", body)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 upstream request, got %d", n)
+	}
+
+	flights := c.snapshot(0).Flights
+	if flights[FlightRoleLeader] != 1 || flights[FlightRoleRefetched] != 0 {
+		t.Errorf("expected a single leader and no refetch, got %v", flights)
+	}
+
+	if n := flights[FlightRoleShared]; n == 0 || n > 99 {
+		t.Errorf("expected the other requests to share the entry, got %d", n)
+	}
+}
+
+func TestFillConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 1)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			arrived <- struct{}{}
+			<-release
+		}
+
+		_, _ = w.Write([]byte("payload"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{fillQueueTimeout: 50 * time.Millisecond})
+	c.fills.limit = 1
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		resp, err := http.Get(proxyServer.URL + "/slow")
+		if err != nil {
+			t.Errorf("proxy request failed: %v", err)
+
+			return
+		}
+
+		_ = resp.Body.Close()
+	}()
+
+	<-arrived
+
+	var m dto.Metric
+	if err := fillsInFlight.WithLabelValues("default").Write(&m); err != nil {
+		t.Fatalf("cannot read the fill gauge: %v", err)
+	}
+
+	if n := m.GetGauge().GetValue(); n != 1 {
+		t.Errorf("expected 1 fill in flight, got %v", n)
+	}
+
+	resp, err := http.Get(proxyServer.URL + "/other")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the queued fill to time out with 503, got %d", resp.StatusCode)
+	}
+
+	close(release)
+	<-done
+
+	resp, err = http.Get(proxyServer.URL + "/other")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the fill once the slot was released, got %d", resp.StatusCode)
+	}
+}
+
+func TestFillLimitCoversFollowers(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 1)
+
+	var requests, inFlight, maxInFlight atomic.Int64
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			arrived <- struct{}{}
+			<-release
+			_, _ = w.Write([]byte("payload"))
+
+			return
+		}
+
+		requests.Add(1)
+
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write([]byte("payload"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{fillQueueTimeout: 100 * time.Millisecond})
+	c.fills.limit = 1
+
+	get := func() int {
+		resp, err := http.Get(proxyServer.URL + "/key")
+		if err != nil {
+			t.Errorf("proxy request failed: %v", err)
+
+			return 0
+		}
+
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// With the slot taken the leader is shed, and its followers with it.
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		resp, err := http.Get(proxyServer.URL + "/slow")
+		if err != nil {
+			t.Errorf("proxy request failed: %v", err)
+
+			return
+		}
+
+		_ = resp.Body.Close()
+	}()
+
+	<-arrived
+
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if code := get(); code != http.StatusServiceUnavailable {
+				t.Errorf("expected the shed flight to answer 503, got %d", code)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := requests.Load(); n != 0 {
+		t.Errorf("expected no request past the fill limit, got %d", n)
+	}
+
+	close(release)
+	<-done
+
+	// The followers of an uncacheable response refetch it one at a time.
+	for range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if code := get(); code != http.StatusOK && code != http.StatusServiceUnavailable {
+				t.Errorf("expected 200 or 503, got %d", code)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := requests.Load(); n == 0 || n > 10 {
+		t.Errorf("expected between 1 and 10 requests to the origin, got %d", n)
+	}
+
+	if n := maxInFlight.Load(); n != 1 {
+		t.Errorf("expected the origin to see 1 fill at a time, got %d", n)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// requestFingerprint hashes what makes a request distinct for the response
+// it got: the method, the URI and the request headers the response varies on.
+// Two fingerprints differing for the same key point at a collision.
+func requestFingerprint(r *http.Request, res http.Header) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(r.Method + " " + r.URL.RequestURI()))
+
+	var vary []string
+	for _, v := range res.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+
+	sort.Strings(vary)
+
+	for _, name := range vary {
+		_, _ = h.Write([]byte("\n" + name + ": " + strings.Join(r.Header.Values(name), ",")))
+	}
+
+	// Zero means no fingerprint.
+	return max(h.Sum64(), 1)
+}
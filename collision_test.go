@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyCollisionWarning(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+
+	defer backend.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.checkCollisions = true
+
+	for _, lang := range []string{"en", "en", "de"} {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.Header.Set("Accept-Language", lang)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if warned := strings.Contains(logs.String(), "collision on /test"); warned != (lang == "de") {
+			t.Errorf("%s: expected warning %v, got logs %q", lang, lang == "de", logs.String())
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// clientEncodingKey holds the request headers of the client, whose
+// Accept-Encoding the director replaces with UPSTREAM_COMPRESSION.
+type clientEncodingKey struct{}
+
+func isGzip(h http.Header) bool {
+	return strings.EqualFold(strings.TrimSpace(h.Get("Content-Encoding")), "gzip")
+}
+
+// gunzipForClient serves the gzipped entry d decoded to clients that don't
+// prefer gzip. Such clients are rare, so the decoded body isn't kept.
+func gunzipForClient(r *http.Request, d cacheData) cacheData {
+	v := d
+	v.header = d.header.Clone()
+	varyOnEncoding(v.header)
+
+	// Stale answers to origin errors get the request sent to the origin.
+	h := r.Header
+	if client, ok := r.Context().Value(clientEncodingKey{}).(http.Header); ok {
+		h = client
+	}
+
+	if ok, _ := acceptsGzip(h); ok || !bodyAllowed(d.status) {
+		return v
+	}
+
+	b, err := gunzipBytes(d.body)
+	if err != nil {
+		log.Printf("can't decode gzip of %s %s", r.URL.RequestURI(), err)
+
+		return v
+	}
+
+	v.body = b
+	v.header.Del("Content-Encoding")
+	v.header.Set("Content-Length", strconv.Itoa(len(v.body)))
+
+	return v
+}
+
+// gunzipResponse decodes a gzip response of the origin on its way to a client
+// that doesn't prefer gzip. The entry stored for it keeps the gzipped body.
+func gunzipResponse(res *http.Response, cfg *config) {
+	if !cfg.upstreamCompression || !isGzip(res.Header) {
+		return
+	}
+
+	varyOnEncoding(res.Header)
+
+	// Requests of the proxy itself, such as warming, have no client.
+	h, ok := res.Request.Context().Value(clientEncodingKey{}).(http.Header)
+	if !ok || !bodyAllowed(res.StatusCode) {
+		return
+	}
+
+	if gzipOK, _ := acceptsGzip(h); gzipOK {
+		return
+	}
+
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+
+	if res.Request.Method == http.MethodHead {
+		return
+	}
+
+	res.Body = transcodeBody(res.Body, func(dst io.Writer, src io.Reader) error {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(dst, gz)
+
+		return err
+	})
+}
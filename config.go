@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	AddHeadersModeSet    = "set"
+	AddHeadersModeAppend = "append"
+)
+
+// How requests matching no UPSTREAMS route are answered.
+const (
+	UnmatchedDefault  = "default"
+	UnmatchedNotFound = "404"
+)
+
+// Which responses to requests carrying Authorization are stored.
+const (
+	AuthorizedPublic = "public"
+	AuthorizedAlways = "always"
+	AuthorizedNever  = "never"
+)
+
+// How the bare "/" route is answered.
+const (
+	RootModeProxy    = "proxy"
+	RootModeOK       = "ok"
+	RootModeRedirect = "redirect"
+)
+
+// configLoader reads settings from the environment. It collects the invalid
+// ones instead of stopping at the first, so they are all reported at once.
+type configLoader struct {
+	errs []error
+}
+
+// errorf records an invalid setting.
+func (l *configLoader) errorf(format string, args ...any) {
+	l.errs = append(l.errs, fmt.Errorf(format, args...))
+}
+
+// err joins the invalid settings found, nil when there were none.
+func (l *configLoader) err() error {
+	return errors.Join(l.errs...)
+}
+
+// config holds the optional proxy settings read from the environment. The
+// .env file is expected to be loaded already (see getTTL).
+type config struct {
+	// addHeaders are injected into every response the proxy serves. They are
+	// applied on the way out and never stored with cache entries.
+	addHeaders     http.Header
+	addHeadersMode string
+
+	// upstreamHeaders are set on every request sent to the origin, typically
+	// credentials the clients do not have. Their values are secrets: they are
+	// never logged and never part of cache keys.
+	upstreamHeaders http.Header
+
+	// stripCookies name the cookies, "*" for any, whose Set-Cookie is
+	// dropped from stored responses instead of keeping them out of the cache.
+	// bypassCookies always keep their responses out of the cache.
+	stripCookies  []string
+	bypassCookies []string
+
+	// internalRedirectHeader, when set, names the response header asking
+	// for the response to another origin path, one of internalRedirectPaths.
+	internalRedirectHeader string
+	internalRedirectPaths  []string
+
+	// followRedirects resolves redirects of the origin, to its own host or
+	// one of redirectHosts, in at most redirectMaxHops.
+	followRedirects bool
+	redirectMaxHops int
+	redirectHosts   []string
+
+	// stripRequestHeaders are removed from inbound requests before they are
+	// forwarded, so client supplied internal headers never reach the origin.
+	stripRequestHeaders []string
+	stripForwardedFor   bool
+
+	// failoverOrigins are tried in order when the primary origin fails with a
+	// transport error (failoverOnError) or one of failoverStatuses.
+	failoverOrigins  []*url.URL
+	failoverOnError  bool
+	failoverStatuses []int
+
+	// upstreams route requests by Host or path prefix to other origins,
+	// each with its own partition of the cache.
+	upstreams []upstreamRoute
+
+	// unmatched decides whether requests matching no route go to the
+	// default origin or get a 404.
+	unmatched string
+
+	// honorPragma makes a request Pragma: no-cache revalidate the cached entry
+	// instead of serving it directly.
+	honorPragma bool
+
+	// authorized is one of the Authorized modes, empty meaning
+	// AuthorizedPublic.
+	authorized string
+
+	// ignoreRequestCacheControl stops clients from steering the cache with
+	// their own Cache-Control directives.
+	ignoreRequestCacheControl bool
+
+	// skipQueryStrings proxies requests with a query string without caching
+	// them.
+	skipQueryStrings bool
+
+	// invalidateOnUnsafe evicts the cached GET of a URL once an unsafe
+	// request to it succeeded, along with the paths of matching
+	// invalidationRules.
+	invalidateOnUnsafe bool
+	invalidationRules  []invalidationRule
+
+	// methodOverride takes X-HTTP-Method-Override for the method of the
+	// request, see effectiveMethod.
+	methodOverride bool
+
+	// maxRequestBody keeps requests with larger bodies out of the cache, or
+	// rejects them with rejectLargeBodies. Zero means no limit.
+	maxRequestBody    int64
+	rejectLargeBodies bool
+
+	// clientCacheControl replaces the Cache-Control served to clients under
+	// a path prefix. Entries keep the origin's header for their freshness.
+	clientCacheControl []routeCacheControl
+
+	// defaultContentTypes fill in the Content-Type of responses without one,
+	// on the way out or, with storeDefaultContentType, in stored entries too.
+	defaultContentTypes     []routeContentType
+	storeDefaultContentType bool
+
+	// refreshThreshold enables refetching entries hit that often since
+	// their last refresh once they are within refreshLead of expiring, with
+	// at most refreshConcurrency fetches at a time.
+	refreshThreshold   int
+	refreshLead        time.Duration
+	refreshConcurrency int
+
+	// fillConcurrency caps the concurrent misses fetched from each origin.
+	// Zero means no cap.
+	fillConcurrency int
+
+	// fillQueueTimeout is how long misses over fillConcurrency wait for a
+	// fill slot before a 503.
+	fillQueueTimeout time.Duration
+
+	adminSecret string
+
+	// adminAddr moves the admin routes to their own listener, leaving the
+	// public one for proxied traffic only. Admin requests may not run longer
+	// than adminTimeout nor send more than adminMaxBody bytes.
+	adminAddr    string
+	adminTimeout time.Duration
+	adminMaxBody int64
+
+	// maintenance is the initial maintenance mode, which can be toggled at
+	// runtime through /_cache/maintenance. maintenancePage is served for
+	// requests that cannot be answered from cache meanwhile.
+	maintenance     bool
+	maintenancePage []byte
+
+	// canned responses are served by path, never reaching the cache nor the
+	// origin.
+	canned map[string]cannedResponse
+
+	// segmentSize enables caching objects under segmentPaths as fixed-size
+	// segments fetched with range requests. Zero keeps whole-object caching.
+	segmentSize  int64
+	segmentPaths []string
+
+	// dedupBodies shares byte-identical bodies between entries.
+	dedupBodies bool
+
+	// memoryMaxEntries bounds the entries kept in memory, demoting the least
+	// recently used to the disk tier under diskCacheDir when it is set.
+	memoryMaxEntries int
+	diskCacheDir     string
+
+	// diskCacheMaxBytes bounds the bytes held by the disk tier, zero meaning
+	// no bound.
+	diskCacheMaxBytes int64
+
+	// diskCachePrecompress keeps gzip and Brotli copies of the entries
+	// demoted to the disk tier, served to the clients taking them.
+	diskCachePrecompress bool
+
+	// quotas bound path prefixes to their own share of the memory tier.
+	quotas []cacheQuota
+
+	// streamContentTypes and streamMinBytes pick responses that stream
+	// through uncached instead of being buffered, see streams.
+	streamContentTypes []string
+	streamMinBytes     int64
+
+	// minBodySize and maxBodySize bound the size of cached bodies, zero
+	// meaning no bound. Responses outside pass through uncached.
+	minBodySize int64
+	maxBodySize int64
+
+	// maxHeaderBytes bounds the response headers stored with an entry, zero
+	// meaning no bound.
+	maxHeaderBytes int
+
+	// statusTTLs give the default TTL by status, exact codes winning over
+	// classes. With statusTTLsOnly, unlisted statuses are not stored.
+	statusTTLs     []statusTTL
+	statusTTLsOnly bool
+
+	// slideFraction and slideMax configure the sliding TTL, disabled while
+	// slideFraction is zero.
+	slideFraction float64
+	slideMax      time.Duration
+
+	// keyHeaders are request headers folded into every cache key, for
+	// origins that vary on them without saying so in Vary.
+	keyHeaders []string
+
+	// keyAccept folds the normalized Accept header into every cache key, for
+	// origins negotiating the content type without Vary: Accept.
+	keyAccept bool
+
+	// keyFullURL keys entries by scheme and host as well, for a proxy in
+	// front of several sites.
+	keyFullURL bool
+
+	// maxKeyBytes bounds the length of cache keys, those longer being
+	// handled as longKeys says. Zero means no bound.
+	maxKeyBytes int
+	longKeys    string
+
+	// maxVariants caps the entries stored per URL for different values of
+	// the key headers, zero meaning no cap.
+	maxVariants int
+
+	// trailingSlash normalizes trailing slashes in keys, under slashPaths
+	// when given.
+	trailingSlash string
+	slashPaths    []string
+
+	// checkKeyCollisions fingerprints the request behind each entry and
+	// warns when a key is stored again for a different request.
+	checkKeyCollisions bool
+
+	// otlpEndpoint is the OTLP/HTTP collector URL spans are exported to.
+	otlpEndpoint string
+
+	// encodingMode is one of EncodingModeAsIs or EncodingModeIdentity.
+	encodingMode string
+
+	// brotliToGzip transcodes Brotli bodies to gzip for clients accepting
+	// gzip but not br.
+	brotliToGzip bool
+
+	// upstreamCompression asks the origin for gzip and caches the compressed
+	// body as is, decoding it for clients without gzip.
+	upstreamCompression bool
+
+	// uncompressedTypes are Content-Type prefixes identity mode leaves
+	// uncompressed, as their bodies are compressed already.
+	uncompressedTypes []string
+
+	staleGracePeriod time.Duration
+
+	// staleIfErrorMaxAge is how old an entry may be to answer in place of an
+	// origin error.
+	staleIfErrorMaxAge time.Duration
+
+	// loadStaleThreshold and loadStaleMaxAge serve recently expired entries
+	// while the origin is busy, see limits.
+	loadStaleThreshold int
+	loadStaleMaxAge    time.Duration
+
+	// Error pages rendered with errorData, in place of the built-in JSON and
+	// HTML bodies.
+	errorJSONTemplate *template.Template
+	errorHTMLTemplate *htmltemplate.Template
+
+	// upstreamTLS holds the client certificate and CA for mutual TLS with
+	// the origin, nil to use the default TLS settings.
+	upstreamTLS *tls.Config
+
+	// upstreamInsecureSkipVerify disables origin certificate verification,
+	// meant for self-signed staging origins only.
+	upstreamInsecureSkipVerify bool
+
+	// upstreamDialTimeout and upstreamHeaderTimeout bound how long a request
+	// waits for the origin to accept the connection and to send its response
+	// headers, zero keeping the defaults of http.DefaultTransport.
+	upstreamDialTimeout   time.Duration
+	upstreamHeaderTimeout time.Duration
+
+	// warmPaths are fetched into the cache at start-up.
+	warmPaths []string
+
+	// slowTop slowest upstream requests of each slowWindow are logged and
+	// reported by the stats endpoint. Zero disables tracking.
+	slowTop    int
+	slowWindow time.Duration
+
+	// warmTimeout bounds how long /readyz waits for warming, unless
+	// readyIgnoresWarm reports ready right away.
+	warmTimeout      time.Duration
+	readyIgnoresWarm bool
+
+	cacheKeyPrefix string
+
+	// maxPooledBuffer is the largest body read buffer kept for reuse.
+	maxPooledBuffer int
+
+	// rootMode decides how "/" is answered, rootRedirect is the target for
+	// RootModeRedirect.
+	rootMode     string
+	rootRedirect string
+
+	// debugHeaders adds the lookup result and entry age under the configured
+	// header names, for correlating layered caches.
+	debugHeaders bool
+	lookupHeader string
+	ageHeader    string
+
+	// debugTTLParam names the query parameter shortening the TTL of the
+	// entry a request fills, honored with debugHeaders on. Empty disables it.
+	debugTTLParam string
+
+	// serverTiming adds a Server-Timing header with the cache decision and
+	// the upstream duration of misses.
+	serverTiming bool
+
+	// drainTimeout is how long in-flight requests may run after a shutdown
+	// signal before their connections are force closed.
+	drainTimeout time.Duration
+
+	// writeTimeout is the deadline the server gives itself to write a
+	// response, counted from the end of the request headers, so it includes
+	// the wait for the origin.
+	writeTimeout time.Duration
+
+	// shedRetryAfter is the Retry-After of requests shed with a 503.
+	shedRetryAfter time.Duration
+
+	// maxConnections caps the connections open on the listener, 0 leaves
+	// them unbounded. Over it, connLimitMode decides whether new connections
+	// wait or are refused.
+	maxConnections int
+	connLimitMode  string
+
+	admissionPolicy  string
+	admissionWindow  time.Duration
+	admissionMaxKeys int
+
+	// ignoreRetryAfter keeps forwarding requests to an origin that answered
+	// 429, instead of backing off for its Retry-After.
+	ignoreRetryAfter bool
+
+	// proxyID is the pseudonym the proxy adds to Via, and looks for to
+	// detect requests that looped back to it.
+	proxyID string
+}
+
+const defaultMaintenancePage = "<!DOCTYPE html><title>Maintenance</title><p>The service is undergoing maintenance, please try again later.</p>\n"
+
+// loadConfig reads the settings from the environment, failing with every
+// invalid one.
+func loadConfig() (*config, error) {
+	l := &configLoader{}
+
+	cfg := &config{
+		addHeaders:     l.envHeaders("ADD_HEADERS"),
+		addHeadersMode: l.envString("ADD_HEADERS_MODE", AddHeadersModeSet),
+
+		stripCookies:  l.envList("CACHE_STRIP_COOKIES"),
+		bypassCookies: l.envList("CACHE_BYPASS_COOKIES"),
+
+		internalRedirectHeader: http.CanonicalHeaderKey(os.Getenv("INTERNAL_REDIRECT_HEADER")),
+		internalRedirectPaths:  l.envList("INTERNAL_REDIRECT_PATHS"),
+
+		followRedirects: l.envBool("FOLLOW_REDIRECTS", false),
+		redirectMaxHops: l.envInt("REDIRECT_MAX_HOPS", defaultRedirectMaxHops),
+		redirectHosts:   l.envList("REDIRECT_ALLOWED_HOSTS"),
+
+		stripRequestHeaders: l.envList("STRIP_REQUEST_HEADERS"),
+		stripForwardedFor:   l.envBool("STRIP_X_FORWARDED_FOR", true),
+
+		failoverOnError:  l.envBool("FAILOVER_ON_ERROR", true),
+		failoverStatuses: l.envInts("FAILOVER_STATUS_CODES", []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}),
+
+		honorPragma:               l.envBool("HONOR_PRAGMA", false),
+		authorized:                l.envString("CACHE_AUTHORIZED", AuthorizedPublic),
+		ignoreRequestCacheControl: l.envBool("IGNORE_REQUEST_CACHE_CONTROL", false),
+		skipQueryStrings:          !l.envBool("CACHE_QUERY_STRINGS", true),
+
+		invalidateOnUnsafe: l.envBool("INVALIDATE_ON_UNSAFE", false),
+		invalidationRules:  l.envInvalidationRules("INVALIDATE_RELATED"),
+		methodOverride:     l.envBool("METHOD_OVERRIDE", false),
+
+		maxRequestBody:    int64(l.envInt("MAX_REQUEST_BODY_BYTES", 0)),
+		rejectLargeBodies: l.envBool("REJECT_LARGE_REQUEST_BODIES", false),
+
+		clientCacheControl: l.envRouteCacheControl("CLIENT_CACHE_CONTROL"),
+
+		defaultContentTypes:     l.envContentTypes("DEFAULT_CONTENT_TYPE"),
+		storeDefaultContentType: l.envBool("STORE_DEFAULT_CONTENT_TYPE", false),
+
+		refreshThreshold:   l.envInt("REFRESH_HIT_THRESHOLD", 0),
+		refreshLead:        l.envDuration("REFRESH_LEAD_TIME", 30*time.Second),
+		refreshConcurrency: l.envInt("REFRESH_CONCURRENCY", 4),
+
+		fillConcurrency:  l.envInt("FILL_CONCURRENCY", 0),
+		fillQueueTimeout: l.envDuration("FILL_QUEUE_TIMEOUT", 5*time.Second),
+
+		adminSecret:  os.Getenv("ADMIN_SECRET"),
+		adminAddr:    os.Getenv("ADMIN_ADDR"),
+		adminTimeout: l.envDuration("ADMIN_TIMEOUT", 30*time.Second),
+		adminMaxBody: int64(l.envInt("ADMIN_MAX_BODY_BYTES", 64<<20)),
+
+		maintenance:     l.envBool("MAINTENANCE_MODE", false),
+		maintenancePage: []byte(defaultMaintenancePage),
+
+		canned: l.envCannedResponses("CANNED_RESPONSES"),
+
+		segmentSize:  int64(l.envInt("SEGMENT_SIZE", 0)),
+		segmentPaths: l.envList("SEGMENT_PATHS"),
+
+		dedupBodies:        l.envBool("DEDUPLICATE_BODIES", false),
+		checkKeyCollisions: l.envBool("CACHE_KEY_INTEGRITY", false),
+		keyHeaders:         l.envList("CACHE_KEY_HEADERS"),
+		keyAccept:          l.envBool("CACHE_KEY_ACCEPT", false),
+		keyFullURL:         l.envBool("CACHE_KEY_FULL_URL", false),
+		maxKeyBytes:        l.envInt("CACHE_MAX_KEY_BYTES", 0),
+		longKeys:           l.envString("CACHE_LONG_KEYS", LongKeysHash),
+		maxVariants:        l.envInt("CACHE_MAX_VARIANTS", 0),
+		trailingSlash:      l.envString("TRAILING_SLASH", TrailingSlashKeep),
+		slashPaths:         l.envList("TRAILING_SLASH_PATHS"),
+		streamContentTypes: l.envList("STREAM_CONTENT_TYPES"),
+		streamMinBytes:     int64(l.envInt("STREAM_MIN_BYTES", 0)),
+
+		minBodySize: int64(l.envInt("CACHE_MIN_BODY_BYTES", 0)),
+		maxBodySize: int64(l.envInt("CACHE_MAX_BODY_BYTES", 0)),
+
+		maxHeaderBytes: l.envInt("CACHE_MAX_HEADER_BYTES", 0),
+
+		statusTTLs:     l.envStatusTTLs("STATUS_TTLS"),
+		statusTTLsOnly: l.envBool("STATUS_TTLS_ONLY", false),
+
+		slideMax: l.envDuration("SLIDING_TTL_MAX", 24*time.Hour),
+
+		memoryMaxEntries:     l.envInt("MEMORY_MAX_ENTRIES", 0),
+		diskCacheDir:         os.Getenv("DISK_CACHE_DIR"),
+		diskCacheMaxBytes:    int64(l.envInt("DISK_CACHE_MAX_BYTES", 0)),
+		diskCachePrecompress: l.envBool("DISK_CACHE_PRECOMPRESS", false),
+		quotas:               l.envQuotas("CACHE_QUOTAS"),
+
+		otlpEndpoint: os.Getenv("OTLP_ENDPOINT"),
+
+		encodingMode: l.envString("ENCODING_MODE", EncodingModeAsIs),
+		brotliToGzip: l.envBool("BROTLI_TO_GZIP", false),
+
+		upstreamCompression: l.envBool("UPSTREAM_COMPRESSION", false),
+
+		staleGracePeriod:   l.envDuration("STALE_GRACE_PERIOD", 0),
+		staleIfErrorMaxAge: l.envDuration("STALE_IF_ERROR_MAX_AGE", 0),
+
+		loadStaleThreshold: l.envInt("LOAD_STALE_THRESHOLD", 0),
+		loadStaleMaxAge:    l.envDuration("LOAD_STALE_MAX_AGE", 5*time.Minute),
+
+		errorJSONTemplate: l.loadTemplate("ERROR_JSON_TEMPLATE"),
+		errorHTMLTemplate: l.loadHTMLTemplate("ERROR_HTML_TEMPLATE"),
+
+		slowTop:    l.envInt("SLOW_UPSTREAM_TOP", 0),
+		slowWindow: l.envDuration("SLOW_UPSTREAM_WINDOW", time.Minute),
+
+		warmPaths:        l.envList("WARM_URLS"),
+		warmTimeout:      l.envDuration("WARM_TIMEOUT", time.Minute),
+		readyIgnoresWarm: !l.envBool("READY_WAIT_FOR_WARM", true),
+
+		cacheKeyPrefix: os.Getenv("CACHE_KEY_PREFIX"),
+
+		maxPooledBuffer: l.envInt("MAX_POOLED_BUFFER_BYTES", defaultMaxPooledBuffer),
+
+		unmatched: l.envString("UPSTREAM_UNMATCHED", UnmatchedDefault),
+
+		rootMode:     l.envString("ROOT_MODE", RootModeProxy),
+		rootRedirect: os.Getenv("ROOT_REDIRECT_URL"),
+
+		debugHeaders: l.envBool("CACHE_DEBUG_HEADERS", false),
+		lookupHeader: l.envString("CACHE_LOOKUP_HEADER", "X-Cache-Lookup"),
+		ageHeader:    l.envString("CACHE_AGE_HEADER", "X-Cache-Age"),
+
+		debugTTLParam: os.Getenv("CACHE_DEBUG_TTL_PARAM"),
+
+		serverTiming: l.envBool("SERVER_TIMING", false),
+
+		drainTimeout: l.envDuration("DRAIN_TIMEOUT", 30*time.Second),
+		writeTimeout: l.envDuration("WRITE_TIMEOUT", WriteTimeoutAmount*time.Second),
+
+		shedRetryAfter: l.envDuration("SHED_RETRY_AFTER", defaultShedRetryAfter),
+
+		maxConnections: l.envInt("MAX_CONNECTIONS", 0),
+		connLimitMode:  l.envString("CONNECTION_LIMIT_MODE", ConnLimitWait),
+
+		admissionPolicy:  l.envString("ADMISSION_POLICY", AdmissionPolicyNone),
+		admissionWindow:  l.envDuration("ADMISSION_WINDOW", time.Hour),
+		admissionMaxKeys: l.envInt("ADMISSION_MAX_KEYS", 100000),
+
+		proxyID: l.envString("PROXY_ID", "cache-proxy"),
+
+		ignoreRetryAfter: l.envBool("IGNORE_RETRY_AFTER", false),
+	}
+
+	if strings.ContainsAny(cfg.proxyID, " \t,") {
+		l.errorf("invalid PROXY_ID %q", cfg.proxyID)
+	}
+
+	if cfg.admissionPolicy != AdmissionPolicyNone && cfg.admissionPolicy != AdmissionPolicySeenBefore {
+		l.errorf("invalid ADMISSION_POLICY %q", cfg.admissionPolicy)
+	}
+
+	if cfg.internalRedirectHeader != "" && len(cfg.internalRedirectPaths) == 0 {
+		l.errorf("INTERNAL_REDIRECT_HEADER requires INTERNAL_REDIRECT_PATHS")
+	}
+
+	if cfg.slowTop > 0 && cfg.slowWindow <= 0 {
+		l.errorf("invalid SLOW_UPSTREAM_WINDOW %s", cfg.slowWindow)
+	}
+
+	if cfg.longKeys != LongKeysHash && cfg.longKeys != LongKeysBypass {
+		l.errorf("invalid CACHE_LONG_KEYS %q", cfg.longKeys)
+	}
+
+	switch cfg.authorized {
+	case AuthorizedPublic, AuthorizedAlways, AuthorizedNever:
+	default:
+		l.errorf("invalid CACHE_AUTHORIZED %q", cfg.authorized)
+	}
+
+	switch cfg.trailingSlash {
+	case TrailingSlashKeep, TrailingSlashStrip, TrailingSlashAdd:
+	default:
+		l.errorf("invalid TRAILING_SLASH %q", cfg.trailingSlash)
+	}
+
+	if cfg.unmatched != UnmatchedDefault && cfg.unmatched != UnmatchedNotFound {
+		l.errorf("invalid UPSTREAM_UNMATCHED %q", cfg.unmatched)
+	}
+
+	switch cfg.rootMode {
+	case RootModeProxy, RootModeOK:
+	case RootModeRedirect:
+		if cfg.rootRedirect == "" {
+			l.errorf("ROOT_MODE redirect requires ROOT_REDIRECT_URL")
+		}
+	default:
+		l.errorf("invalid ROOT_MODE %q", cfg.rootMode)
+	}
+
+	if cfg.encodingMode != EncodingModeAsIs && cfg.encodingMode != EncodingModeIdentity {
+		l.errorf("invalid ENCODING_MODE %q", cfg.encodingMode)
+	}
+
+	if cfg.upstreamCompression && cfg.encodingMode != EncodingModeAsIs {
+		l.errorf("UPSTREAM_COMPRESSION requires ENCODING_MODE asis")
+	}
+
+	if cfg.connLimitMode != ConnLimitWait && cfg.connLimitMode != ConnLimitRefuse {
+		l.errorf("invalid CONNECTION_LIMIT_MODE %q", cfg.connLimitMode)
+	}
+
+	tc, err := loadUpstreamTLS(
+		os.Getenv("UPSTREAM_CLIENT_CERT"),
+		os.Getenv("UPSTREAM_CLIENT_KEY"),
+		os.Getenv("UPSTREAM_CA"),
+	)
+	if err != nil {
+		l.errorf("%s", err)
+	}
+
+	cfg.upstreamTLS = tc
+	cfg.upstreamInsecureSkipVerify = l.envBool("UPSTREAM_INSECURE_SKIP_VERIFY", false)
+	cfg.upstreamDialTimeout = l.envDuration("UPSTREAM_DIAL_TIMEOUT", 0)
+	cfg.upstreamHeaderTimeout = l.envDuration("UPSTREAM_HEADER_TIMEOUT", 0)
+
+	cfg.upstreamHeaders = l.loadUpstreamHeaders()
+
+	cfg.uncompressedTypes = defaultUncompressedTypes
+	if _, ok := os.LookupEnv("UNCOMPRESSED_TYPES"); ok {
+		cfg.uncompressedTypes = l.envList("UNCOMPRESSED_TYPES")
+	}
+
+	if v := os.Getenv("SLIDING_TTL"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			l.errorf("invalid SLIDING_TTL %q, expected a fraction between 0 and 1", v)
+		} else {
+			cfg.slideFraction = f
+		}
+	}
+
+	if path := os.Getenv("MAINTENANCE_PAGE"); path != "" {
+		page, err := os.ReadFile(path)
+		if err != nil {
+			l.errorf("cannot read MAINTENANCE_PAGE %s", err)
+		}
+
+		cfg.maintenancePage = page
+	}
+
+	for _, origin := range l.envList("FAILOVER_ORIGINS") {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			l.errorf("invalid FAILOVER_ORIGINS entry %q", origin)
+
+			continue
+		}
+
+		cfg.failoverOrigins = append(cfg.failoverOrigins, u)
+	}
+
+	for _, item := range l.envList("UPSTREAMS") {
+		match, rest, ok := strings.Cut(item, "=")
+		match = strings.TrimSpace(match)
+		fields := strings.Fields(rest)
+
+		if !ok || match == "" || len(fields) == 0 {
+			l.errorf("invalid UPSTREAMS entry %q, expected host=url or /prefix=url", item)
+
+			continue
+		}
+
+		u, err := url.Parse(fields[0])
+		if err != nil || u.Host == "" {
+			l.errorf("invalid UPSTREAMS entry %q, expected host=url or /prefix=url", item)
+
+			continue
+		}
+
+		route := upstreamRoute{host: match, target: u}
+		if strings.HasPrefix(match, "/") {
+			route = upstreamRoute{prefix: match, target: u}
+		}
+
+		for _, option := range fields[1:] {
+			v, ok := strings.CutPrefix(option, "ttl=")
+			ttl, err := time.ParseDuration(v)
+
+			if !ok || err != nil || ttl <= 0 {
+				l.errorf("invalid UPSTREAMS option %q in %q, expected ttl=<duration>", option, item)
+
+				continue
+			}
+
+			route.ttl = ttl
+		}
+
+		cfg.upstreams = append(cfg.upstreams, route)
+	}
+
+	if cfg.addHeadersMode != AddHeadersModeSet && cfg.addHeadersMode != AddHeadersModeAppend {
+		l.errorf("invalid ADD_HEADERS_MODE %q", cfg.addHeadersMode)
+	}
+
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (l *configLoader) envString(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+
+	return def
+}
+
+func (l *configLoader) envBool(name string, def bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.errorf("cannot convert %s to bool %s", name, err)
+
+		return def
+	}
+
+	return b
+}
+
+func (l *configLoader) envInt(name string, def int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		l.errorf("cannot convert %s to int %s", name, err)
+
+		return def
+	}
+
+	return i
+}
+
+// envDuration reads a Go duration such as "90s" or "10m".
+func (l *configLoader) envDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		l.errorf("cannot convert %s to duration %s", name, err)
+
+		return def
+	}
+
+	return d
+}
+
+// envList reads a comma separated list, dropping empty items.
+func (l *configLoader) envList(name string) []string {
+	var items []string
+
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// envInts reads a comma separated list of integers, or def when unset.
+func (l *configLoader) envInts(name string, def []int) []int {
+	items := l.envList(name)
+	if len(items) == 0 {
+		return def
+	}
+
+	ints := make([]int, 0, len(items))
+
+	for _, item := range items {
+		i, err := strconv.Atoi(item)
+		if err != nil {
+			l.errorf("cannot convert %s entry to int %s", name, err)
+
+			continue
+		}
+
+		ints = append(ints, i)
+	}
+
+	return ints
+}
+
+// envHeaders reads a comma separated list of "Name: value" pairs.
+func (l *configLoader) envHeaders(name string) http.Header {
+	h := make(http.Header)
+
+	for _, item := range l.envList(name) {
+		k, v, ok := strings.Cut(item, ":")
+		if !ok {
+			l.errorf("invalid %s entry %q, expected Name: value", name, item)
+
+			continue
+		}
+
+		h.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+
+	return h
+}
+
+// loadUpstreamHeaders reads UPSTREAM_HEADERS, comma separated "Name: value"
+// pairs, then UPSTREAM_HEADERS_FILE, one pair per line, which wins for names
+// set in both. Errors never quote the values.
+func (l *configLoader) loadUpstreamHeaders() http.Header {
+	h := make(http.Header)
+
+	for i, item := range l.envList("UPSTREAM_HEADERS") {
+		k, v, ok := strings.Cut(item, ":")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			l.errorf("invalid UPSTREAM_HEADERS entry %d, expected Name: value", i+1)
+
+			continue
+		}
+
+		h.Add(k, strings.TrimSpace(v))
+	}
+
+	path := os.Getenv("UPSTREAM_HEADERS_FILE")
+	if path == "" {
+		return h
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		l.errorf("cannot read UPSTREAM_HEADERS_FILE %s", err)
+
+		return h
+	}
+
+	fromFile := make(http.Header)
+
+	for i, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			l.errorf("invalid UPSTREAM_HEADERS_FILE line %d, expected Name: value", i+1)
+
+			continue
+		}
+
+		fromFile.Add(k, strings.TrimSpace(v))
+	}
+
+	for k, vv := range fromFile {
+		h[k] = vv
+	}
+
+	return h
+}
+
+// envInvalidationRules reads comma separated "prefix: path path" rules.
+func (l *configLoader) envInvalidationRules(name string) []invalidationRule {
+	var rules []invalidationRule
+
+	for _, item := range l.envList(name) {
+		prefix, paths, ok := strings.Cut(item, ":")
+		related := strings.Fields(paths)
+
+		if !ok || strings.TrimSpace(prefix) == "" || len(related) == 0 {
+			l.errorf("invalid %s entry %q, expected prefix: path...", name, item)
+
+			continue
+		}
+
+		rules = append(rules, invalidationRule{prefix: strings.TrimSpace(prefix), related: related})
+	}
+
+	return rules
+}
+
+// routeCacheControl is the Cache-Control served for paths under prefix.
+type routeCacheControl struct {
+	prefix string
+	value  string
+}
+
+// envRouteCacheControl reads "prefix: directives" entries. They are separated
+// by semicolons since the directives contain commas.
+func (l *configLoader) envRouteCacheControl(name string) []routeCacheControl {
+	var routes []routeCacheControl
+
+	for _, item := range strings.Split(os.Getenv(name), ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		prefix, value, ok := strings.Cut(item, ":")
+		if !ok || strings.TrimSpace(prefix) == "" || strings.TrimSpace(value) == "" {
+			l.errorf("invalid %s entry %q, expected prefix: directives", name, item)
+
+			continue
+		}
+
+		routes = append(routes, routeCacheControl{prefix: strings.TrimSpace(prefix), value: strings.TrimSpace(value)})
+	}
+
+	return routes
+}
+
+// applyClientCacheControl sets the Cache-Control of the longest configured
+// prefix of path, leaving h alone when none matches.
+func (cfg *config) applyClientCacheControl(path string, h http.Header) {
+	best := -1
+
+	for i, route := range cfg.clientCacheControl {
+		if strings.HasPrefix(path, route.prefix) && (best < 0 || len(route.prefix) > len(cfg.clientCacheControl[best].prefix)) {
+			best = i
+		}
+	}
+
+	if best >= 0 {
+		h.Set("Cache-Control", cfg.clientCacheControl[best].value)
+	}
+}
+
+// routeContentType is the Content-Type served under prefix by responses that
+// lack one.
+type routeContentType struct {
+	prefix string
+	value  string
+}
+
+// envContentTypes reads comma separated "prefix: type" rules. Commas rather
+// than semicolons separate them, as types may carry parameters.
+func (l *configLoader) envContentTypes(name string) []routeContentType {
+	var routes []routeContentType
+
+	for _, item := range l.envList(name) {
+		prefix, value, ok := strings.Cut(item, ":")
+		if !ok || strings.TrimSpace(prefix) == "" || strings.TrimSpace(value) == "" {
+			l.errorf("invalid %s entry %q, expected prefix: type", name, item)
+
+			continue
+		}
+
+		routes = append(routes, routeContentType{prefix: strings.TrimSpace(prefix), value: strings.TrimSpace(value)})
+	}
+
+	return routes
+}
+
+// applyDefaultContentType sets the Content-Type of the longest configured
+// prefix of path on a response with a body but without a Content-Type.
+func (cfg *config) applyDefaultContentType(path string, status int, h http.Header) {
+	if len(cfg.defaultContentTypes) == 0 || h.Get("Content-Type") != "" || !bodyAllowed(status) {
+		return
+	}
+
+	best := -1
+
+	for i, route := range cfg.defaultContentTypes {
+		if strings.HasPrefix(path, route.prefix) && (best < 0 || len(route.prefix) > len(cfg.defaultContentTypes[best].prefix)) {
+			best = i
+		}
+	}
+
+	if best >= 0 {
+		h.Set("Content-Type", cfg.defaultContentTypes[best].value)
+	}
+}
+
+// cacheQuota bounds the entries and bytes stored under prefix, zero meaning
+// no bound.
+type cacheQuota struct {
+	prefix  string
+	entries int
+	bytes   int64
+}
+
+// envQuotas reads comma separated "prefix: entries=N bytes=N" quotas.
+func (l *configLoader) envQuotas(name string) []cacheQuota {
+	var quotas []cacheQuota
+
+	for _, item := range l.envList(name) {
+		prefix, limits, ok := strings.Cut(item, ":")
+		q := cacheQuota{prefix: strings.TrimSpace(prefix)}
+
+		if !ok || q.prefix == "" || strings.TrimSpace(limits) == "" {
+			l.errorf("invalid %s entry %q, expected prefix: entries=N bytes=N", name, item)
+
+			continue
+		}
+
+		for _, limit := range strings.Fields(limits) {
+			k, v, _ := strings.Cut(limit, "=")
+
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				l.errorf("invalid %s limit %q", name, limit)
+
+				continue
+			}
+
+			switch k {
+			case "entries":
+				q.entries = int(n)
+			case "bytes":
+				q.bytes = n
+			default:
+				l.errorf("invalid %s limit %q", name, limit)
+			}
+		}
+
+		quotas = append(quotas, q)
+	}
+
+	return quotas
+}
+
+// statusTTL is the default TTL of responses with a status, or with any status
+// of a class such as 5xx, zero meaning not to store them.
+type statusTTL struct {
+	status int
+	class  bool
+	ttl    time.Duration
+}
+
+// envStatusTTLs reads comma separated "status: duration" rules, the status
+// being a code such as 404 or a class such as 5xx.
+func (l *configLoader) envStatusTTLs(name string) []statusTTL {
+	var rules []statusTTL
+
+	for _, item := range l.envList(name) {
+		status, value, ok := strings.Cut(item, ":")
+		status = strings.TrimSpace(status)
+
+		ttl, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil || ttl < 0 {
+			l.errorf("invalid %s entry %q, expected status: duration", name, item)
+
+			continue
+		}
+
+		rule := statusTTL{ttl: ttl}
+
+		if class, ok := strings.CutSuffix(strings.ToLower(status), "xx"); ok {
+			status, rule.class = class, true
+		}
+
+		rule.status, err = strconv.Atoi(status)
+		if err != nil || (rule.class && (rule.status < 1 || rule.status > 5)) ||
+			(!rule.class && (rule.status < 100 || rule.status > 599)) {
+			l.errorf("invalid %s status %q", name, status)
+
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// setDebugHeaders reports whether the key was found in the cache and how old
+// the served entry is, in whole seconds.
+func (cfg *config) setDebugHeaders(h http.Header, lookup string, age time.Duration) {
+	if !cfg.debugHeaders {
+		return
+	}
+
+	h.Set(cfg.lookupHeader, lookup)
+	h.Set(cfg.ageHeader, strconv.Itoa(int(age.Seconds())))
+}
+
+// applyAddHeaders injects the configured headers into h, either replacing
+// what the origin sent or appending to it.
+func (cfg *config) applyAddHeaders(h http.Header) {
+	for k, vv := range cfg.addHeaders {
+		if cfg.addHeadersMode == AddHeadersModeSet {
+			h.Del(k)
+		}
+
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+}
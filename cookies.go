@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// cookieName is the name of the cookie a Set-Cookie value sets.
+func cookieName(setCookie string) string {
+	name, _, _ := strings.Cut(setCookie, "=")
+
+	return strings.TrimSpace(name)
+}
+
+// strips reports whether the cookie may be dropped from a stored response:
+// it is listed in CACHE_STRIP_COOKIES, or "*" is, and it is not listed in
+// CACHE_BYPASS_COOKIES.
+func (cfg *config) strips(name string) bool {
+	if slices.Contains(cfg.bypassCookies, name) {
+		return false
+	}
+
+	return slices.Contains(cfg.stripCookies, name) || slices.Contains(cfg.stripCookies, "*")
+}
+
+// cookiesCacheable reports whether a response with h may be stored, which
+// takes every cookie it sets to be strippable.
+func (cfg *config) cookiesCacheable(h http.Header) bool {
+	for _, v := range h.Values("Set-Cookie") {
+		if !cfg.strips(cookieName(v)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withoutCookies runs store with the Set-Cookie headers removed from h, so
+// the stored entry never replays them to other clients, and puts them back
+// for the client the response is for.
+func withoutCookies(h http.Header, store func() error) error {
+	cookies := h.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return store()
+	}
+
+	h.Del("Set-Cookie")
+	err := store()
+	h["Set-Cookie"] = cookies
+
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type debugTTLKey struct{}
+
+// takeDebugTTL removes the debug TTL parameter from the query, so neither the
+// origin nor the cache key sees it, and puts the TTL it asks for in the
+// context. The TTL is only honored with debug headers on; otherwise the
+// parameter is dropped without effect.
+func takeDebugTTL(r *http.Request, cfg *config) *http.Request {
+	if cfg.debugTTLParam == "" || !strings.Contains(r.URL.RawQuery, cfg.debugTTLParam) {
+		return r
+	}
+
+	var (
+		kept  []string
+		value string
+		found bool
+	)
+
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		name, v, _ := strings.Cut(pair, "=")
+		if n, err := url.QueryUnescape(name); err == nil && n == cfg.debugTTLParam {
+			value, found = v, true
+
+			continue
+		}
+
+		kept = append(kept, pair)
+	}
+
+	if !found {
+		return r
+	}
+
+	ctx := r.Context()
+	if v, err := url.QueryUnescape(value); err == nil && cfg.debugHeaders {
+		if ttl, err := time.ParseDuration(v); err == nil && ttl >= 0 {
+			ctx = context.WithValue(ctx, debugTTLKey{}, ttl)
+		}
+	}
+
+	r = r.Clone(ctx)
+	r.URL.RawQuery = strings.Join(kept, "&")
+
+	return r
+}
+
+// debugTTL bounds ttl by the TTL the request asked for, if any. It never
+// lengthens the entry, so the parameter can't pin it.
+func debugTTL(r *http.Request, ttl time.Duration) time.Duration {
+	if d, ok := r.Context().Value(debugTTLKey{}).(time.Duration); ok && d < ttl {
+		return d
+	}
+
+	return ttl
+}
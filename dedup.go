@@ -0,0 +1,30 @@
+package main
+
+import "crypto/sha256"
+
+// sharedBody is a body buffer referenced by every entry with the same content.
+type sharedBody struct {
+	body []byte
+	refs int
+}
+
+// intern points d at the shared buffer for its body, adding one when this
+// content is new. Callers must hold c.mu for writing.
+func (c *cache) intern(d cacheData) cacheData {
+	if d.bodyHash == "" {
+		sum := sha256.Sum256(d.body)
+		d.bodyHash = string(sum[:])
+	}
+
+	sb, ok := c.bodies[d.bodyHash]
+	if !ok {
+		sb = &sharedBody{body: d.body}
+		c.bodies[d.bodyHash] = sb
+		c.bytes += int64(len(d.body))
+	}
+
+	sb.refs++
+	d.body = sb.body
+
+	return d
+}
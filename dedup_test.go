@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDedupBodies(t *testing.T) {
+	c := newCache(time.Hour)
+	c.dedupBodies = true
+
+	c.store("/a", cacheData{header: http.Header{}, body: []byte("[]")})
+	c.store("/b", cacheData{header: http.Header{}, body: []byte("[]")})
+	c.store("/c", cacheData{header: http.Header{}, body: []byte("{}")})
+
+	if len(c.bodies) != 2 || c.bytes != 4 {
+		t.Errorf("expected 2 unique bodies of 4 bytes, got %d of %d bytes", len(c.bodies), c.bytes)
+	}
+
+	c.mu.Lock()
+	c.evict("/a", EvictionReasonPurge)
+	c.mu.Unlock()
+
+	if len(c.bodies) != 2 {
+		t.Errorf("expected body shared with /b to be kept, got %d bodies", len(c.bodies))
+	}
+
+	c.mu.Lock()
+	c.evict("/b", EvictionReasonPurge)
+	c.mu.Unlock()
+
+	if len(c.bodies) != 1 || c.bytes != 2 {
+		t.Errorf("expected last reference to free the body, got %d bodies of %d bytes", len(c.bodies), c.bytes)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Ways of storing compressible responses. EncodingModeAsIs caches whatever
+// encoding the origin sent, EncodingModeIdentity fetches and stores the
+// identity body and gzips it per client on the way out.
+const (
+	EncodingModeAsIs     = "asis"
+	EncodingModeIdentity = "identity"
+)
+
+// gzipMinSize is the smallest body worth compressing.
+const gzipMinSize = 256
+
+// defaultUncompressedTypes are the content types that are compressed already.
+var defaultUncompressedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif",
+	"video/", "audio/", "application/gzip", "application/zip", "font/woff2",
+}
+
+// worthCompressing reports whether a body of the given Content-Type gains
+// from gzip, i.e. it starts with none of the uncompressed types.
+func worthCompressing(contentType string, uncompressed []string) bool {
+	ct := strings.ToLower(contentType)
+
+	for _, prefix := range uncompressed {
+		if strings.HasPrefix(ct, strings.ToLower(prefix)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// acceptEncoding holds the q-values of an Accept-Encoding header.
+type acceptEncoding struct {
+	present bool
+	q       map[string]float64
+}
+
+func parseAcceptEncoding(h http.Header) acceptEncoding {
+	ae := acceptEncoding{q: make(map[string]float64)}
+
+	for _, v := range h.Values("Accept-Encoding") {
+		ae.present = true
+
+		for _, item := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(item, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+
+			if coding == "" {
+				continue
+			}
+
+			q := 1.0
+
+			for _, param := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(k, "q") {
+					f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+					if err != nil {
+						f = 0
+					}
+
+					q = f
+				}
+			}
+
+			ae.q[coding] = q
+		}
+	}
+
+	return ae
+}
+
+// quality returns the q-value for coding as RFC 7231 section 5.3.4 defines
+// it: an explicit entry wins over "*", and identity is acceptable unless
+// excluded.
+func (ae acceptEncoding) quality(coding string) float64 {
+	if q, ok := ae.q[coding]; ok {
+		return q
+	}
+
+	if q, ok := ae.q["*"]; ok {
+		return q
+	}
+
+	if coding == "identity" {
+		return 1
+	}
+
+	return 0
+}
+
+// preferredEncoding picks the coding to respond with among offers, listed in
+// the proxy's order of preference, or identity. A missing Accept-Encoding
+// means identity, as most clients that can decode say so. Identity that is
+// only implicitly acceptable loses to any offered coding.
+func (ae acceptEncoding) preferredEncoding(offers ...string) string {
+	best, bestQ := "identity", 0.0
+
+	if !ae.present {
+		return best
+	}
+
+	if q, ok := ae.q["identity"]; ok {
+		bestQ = q
+	} else if q, ok := ae.q["*"]; ok {
+		bestQ = q
+	}
+
+	for _, offer := range offers {
+		if q := ae.quality(offer); q > 0 && q >= bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// acceptsGzip reports whether gzip is the preferred coding for the client.
+// forced is set when the client excluded identity, so even bodies too small
+// to be worth it have to be compressed.
+func acceptsGzip(h http.Header) (ok, forced bool) {
+	ae := parseAcceptEncoding(h)
+	if ae.preferredEncoding("gzip") != "gzip" {
+		return false, false
+	}
+
+	return true, ae.quality("identity") == 0
+}
+
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(b)
+	_ = gz.Close()
+
+	return buf.Bytes()
+}
+
+func gunzipBytes(b []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(gz)
+}
+
+// transcodeBody streams body through transcode as it is read.
+func transcodeBody(body io.ReadCloser, transcode func(dst io.Writer, src io.Reader) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(transcode(pw, body))
+	}()
+
+	return &transcodedBody{PipeReader: pr, origin: body}
+}
+
+// transcodedBody closes the origin body along with the pipe it is
+// transcoded into, which ends the transcoding.
+type transcodedBody struct {
+	*io.PipeReader
+	origin io.ReadCloser
+}
+
+func (b *transcodedBody) Close() error {
+	_ = b.PipeReader.Close()
+
+	return b.origin.Close()
+}
+
+// negotiateEncoding picks the representation of the cached entry d to serve
+// for r. In identity mode the gzipped body is computed on first use and kept
+// with the entry, so it is not recompressed on every hit. Brotli entries are
+// transcoded the same way with BROTLI_TO_GZIP, and gzipped entries of
+// UPSTREAM_COMPRESSION decoded for clients without gzip.
+func (c *cache) negotiateEncoding(r *http.Request, d cacheData, cfg *config) cacheData {
+	if cfg.upstreamCompression && isGzip(d.header) {
+		return gunzipForClient(r, d)
+	}
+
+	if cfg.brotliToGzip && isBrotli(d.header) {
+		return c.transcodeBrotli(r, d)
+	}
+
+	if cfg.encodingMode != EncodingModeIdentity {
+		return d
+	}
+
+	v := d
+	v.header = d.header.Clone()
+	v.header.Add("Vary", "Accept-Encoding")
+
+	// Entries only ever hold a gzipped body when it is worth it, unless a
+	// client refusing identity forced one.
+	gzipOK, forced := acceptsGzip(r.Header)
+	worth := len(d.body) >= gzipMinSize && worthCompressing(d.header.Get("Content-Type"), cfg.uncompressedTypes)
+
+	if !gzipOK || d.header.Get("Content-Encoding") != "" || (!worth && !forced) || !bodyAllowed(d.status) {
+		return v
+	}
+
+	if d.gzipBody == nil {
+		d.gzipBody = gzipBytes(d.body)
+		c.attachGzip(c.key(r), d)
+	}
+
+	v.body = d.gzipBody
+	v.header.Set("Content-Encoding", "gzip")
+	v.header.Set("Content-Length", strconv.Itoa(len(v.body)))
+
+	return v
+}
+
+// attachGzip keeps the gzipped body computed for d, unless the entry was
+// replaced in the meantime.
+func (c *cache) attachGzip(key string, d cacheData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cur, ok := c.data[key]
+	if !ok || cur.gzipBody != nil || !cur.age.Equal(d.age) {
+		return
+	}
+
+	cur.gzipBody = d.gzipBody
+	c.bytes += int64(len(cur.gzipBody))
+	c.data[key] = cur
+}
+
+// gzipResponseWriter compresses a proxied identity response on the fly.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+
+	// forced compresses even small bodies, for clients refusing identity.
+	forced bool
+
+	// uncompressed are the content types not worth compressing.
+	uncompressed []string
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+
+	skip := !worthCompressing(h.Get("Content-Type"), w.uncompressed)
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < gzipMinSize {
+		skip = true
+	}
+
+	if h.Get("Content-Encoding") == "" && bodyAllowed(status) && (!skip || w.forced) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) FlushError() error {
+	if w.gz != nil {
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+
+	return w.gz.Close()
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
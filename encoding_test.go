@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestIdentityEncodingMode(t *testing.T) {
+	content := strings.Repeat("cacheable ", 100)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(content))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{encodingMode: EncodingModeIdentity})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	get := func(acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, b
+	}
+
+	gunzip := func(b []byte) string {
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("expected gzip body: %v", err)
+		}
+
+		plain, _ := io.ReadAll(gz)
+
+		return string(plain)
+	}
+
+	for _, xCache := range []string{XCacheMiss, XCacheHit} {
+		resp, body := get("gzip")
+
+		if resp.Header.Get("X-Cache") != xCache {
+			t.Errorf("expected %s, got %q", xCache, resp.Header.Get("X-Cache"))
+		}
+
+		if resp.Header.Get("Content-Encoding") != "gzip" || gunzip(body) != content {
+			t.Errorf("expected gzipped content on %s", xCache)
+		}
+	}
+
+	resp, body := get("")
+
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != content {
+		t.Errorf("expected identity content for client without gzip support")
+	}
+}
+
+func TestAcceptEncodingQValues(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		gzip, forced   bool
+	}{
+		{"", false, false},
+		{"gzip", true, false},
+		{"gzip, deflate, br", true, false},
+		{"gzip;q=0, br;q=1", false, false},
+		{"GZIP;Q=0.5", true, false},
+		{"br, gzip;q=0.5, identity;q=0.8", false, false},
+		{"identity;q=0, gzip", true, true},
+		{"*", true, false},
+		{"*;q=0, identity", false, false},
+		{"br;q=1, *;q=0.1", true, false},
+		{"gzip;q=0, *", false, false},
+		{"identity", false, false},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.acceptEncoding != "" {
+			h.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+
+		gzipOK, forced := acceptsGzip(h)
+		if gzipOK != tt.gzip || forced != tt.forced {
+			t.Errorf("Accept-Encoding %q: got gzip=%t forced=%t, expected gzip=%t forced=%t",
+				tt.acceptEncoding, gzipOK, forced, tt.gzip, tt.forced)
+		}
+	}
+}
+
+func TestUncompressedTypes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(bytes.Repeat([]byte{0x89}, 1000))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{
+		encodingMode:      EncodingModeIdentity,
+		uncompressedTypes: []string{"image/png"},
+	})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, xCache := range []string{XCacheMiss, XCacheHit} {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/logo.png", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.Header.Get("Content-Encoding") != "" || len(b) != 1000 {
+			t.Errorf("%s: expected the raw image, got %q encoding of %d bytes", xCache, resp.Header.Get("Content-Encoding"), len(b))
+		}
+	}
+
+	if d := c.data["/logo.png"]; d.gzipBody != nil {
+		t.Error("expected no gzipped copy stored")
+	}
+}
+
+func TestBrotliToGzip(t *testing.T) {
+	content := strings.Repeat("compressible ", 100)
+
+	var buf bytes.Buffer
+
+	bw := brotli.NewWriter(&buf)
+	_, _ = bw.Write([]byte(content))
+	_ = bw.Close()
+
+	encoded := buf.Bytes()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = w.Write(encoded)
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{brotliToGzip: true})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	get := func(acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, b
+	}
+
+	for _, xCache := range []string{XCacheMiss, XCacheHit, XCacheHit} {
+		resp, body := get("gzip, deflate")
+
+		if resp.Header.Get("X-Cache") != xCache {
+			t.Errorf("expected %s, got %q", xCache, resp.Header.Get("X-Cache"))
+		}
+
+		if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("expected gzip varying on Accept-Encoding on %s, got %q and %q",
+				xCache, resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("expected gzip body on %s: %v", xCache, err)
+		}
+
+		if plain, _ := io.ReadAll(gz); string(plain) != content {
+			t.Errorf("expected transcoded content on %s", xCache)
+		}
+	}
+
+	if d := c.data["/test"]; !bytes.Equal(d.body, encoded) || d.gzipBody == nil {
+		t.Errorf("expected the brotli entry to keep its gzipped variant")
+	}
+
+	resp, body := get("br, gzip")
+
+	if resp.Header.Get("Content-Encoding") != "br" || !bytes.Equal(body, encoded) {
+		t.Errorf("expected brotli for clients accepting it, got %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestUpstreamCompression(t *testing.T) {
+	content := strings.Repeat("compressible ", 100)
+	encoded := gzipBytes([]byte(content))
+
+	var acceptEncodings []string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncodings = append(acceptEncodings, r.Header.Get("Accept-Encoding"))
+
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(encoded)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(content))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{upstreamCompression: true})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	get := func(path, acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, b
+	}
+
+	for _, tt := range []struct {
+		path, acceptEncoding string
+		xCache               string
+		gzipped              bool
+	}{
+		{"/a", "gzip", XCacheMiss, true},
+		{"/a", "gzip", XCacheHit, true},
+		{"/a", "", XCacheHit, false},
+		{"/b", "", XCacheMiss, false},
+		{"/b", "br, gzip;q=0.5", XCacheHit, true},
+		{"/b", "identity", XCacheHit, false},
+	} {
+		resp, body := get(tt.path, tt.acceptEncoding)
+
+		if resp.Header.Get("X-Cache") != tt.xCache || resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s with %q: expected %s varying on Accept-Encoding, got %q and %q",
+				tt.path, tt.acceptEncoding, tt.xCache, resp.Header.Get("X-Cache"), resp.Header.Get("Vary"))
+		}
+
+		if gzipped := resp.Header.Get("Content-Encoding") == "gzip"; gzipped != tt.gzipped {
+			t.Fatalf("%s with %q: expected gzip %v, got Content-Encoding %q",
+				tt.path, tt.acceptEncoding, tt.gzipped, resp.Header.Get("Content-Encoding"))
+		}
+
+		if tt.gzipped {
+			if !bytes.Equal(body, encoded) {
+				t.Errorf("%s with %q: expected the gzipped body of the origin", tt.path, tt.acceptEncoding)
+			}
+		} else if string(body) != content {
+			t.Errorf("%s with %q: expected the decoded body, got %d bytes", tt.path, tt.acceptEncoding, len(body))
+		}
+	}
+
+	if want := []string{"gzip", "gzip"}; strings.Join(acceptEncodings, " ") != strings.Join(want, " ") {
+		t.Errorf("expected the origin always asked for gzip, got %q", acceptEncodings)
+	}
+
+	for _, key := range []string{"/a", "/b"} {
+		if d := c.data[key]; !bytes.Equal(d.body, encoded) || d.header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("expected %s cached compressed", key)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// errorData is what error templates are rendered with.
+type errorData struct {
+	Status int
+	Error  string
+}
+
+const defaultErrorHTML = `<!DOCTYPE html>
+<title>{{.Status}} {{.Error}}</title>
+<h1>{{.Status}} {{.Error}}</h1>
+`
+
+var defaultErrorHTMLTemplate = htmltemplate.Must(htmltemplate.New("error").Parse(defaultErrorHTML))
+
+// prefersJSON reports whether the client's Accept header ranks JSON above
+// HTML. Ties, including a missing Accept header, go to HTML.
+func prefersJSON(accept string) bool {
+	return acceptQuality(accept, "application", "json") > acceptQuality(accept, "text", "html")
+}
+
+// acceptQuality returns the q-value the Accept header gives to type/subtype,
+// taken from the most specific matching media range.
+func acceptQuality(accept, typ, subtype string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+
+	q, specificity := 0.0, -1
+
+	for _, item := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(item, ";")
+		t, s, _ := strings.Cut(strings.ToLower(strings.TrimSpace(mediaRange)), "/")
+
+		var spec int
+
+		switch {
+		case t == typ && s == subtype:
+			spec = 2
+		case t == typ && s == "*":
+			spec = 1
+		case t == "*" && s == "*":
+			spec = 0
+		default:
+			continue
+		}
+
+		if spec < specificity {
+			continue
+		}
+
+		itemQ := 1.0
+
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					itemQ = f
+				}
+			}
+		}
+
+		q, specificity = itemQ, spec
+	}
+
+	return q
+}
+
+// writeError answers with status in the format the client prefers, JSON for
+// API clients and HTML otherwise, using the configured templates if any.
+func (cfg *config) writeError(w http.ResponseWriter, r *http.Request, status int) {
+	data := errorData{Status: status, Error: strings.ToLower(http.StatusText(status))}
+
+	var (
+		buf bytes.Buffer
+		err error
+	)
+
+	if prefersJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if cfg.errorJSONTemplate != nil {
+			err = cfg.errorJSONTemplate.Execute(&buf, data)
+		} else {
+			err = json.NewEncoder(&buf).Encode(map[string]any{"error": data.Error, "status": data.Status})
+		}
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		tmpl := defaultErrorHTMLTemplate
+		if cfg.errorHTMLTemplate != nil {
+			tmpl = cfg.errorHTMLTemplate
+		}
+
+		err = tmpl.Execute(&buf, data)
+	}
+
+	if err != nil {
+		log.Printf("cannot render error page %s", err)
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	cfg.applyAddHeaders(w.Header())
+	w.WriteHeader(status)
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("can't write to body %s", err)
+	}
+}
+
+func (l *configLoader) loadTemplate(name string) *template.Template {
+	path := l.envString(name, "")
+	if path == "" {
+		return nil
+	}
+
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		l.errorf("cannot parse %s %s", name, err)
+	}
+
+	return tmpl
+}
+
+func (l *configLoader) loadHTMLTemplate(name string) *htmltemplate.Template {
+	path := l.envString(name, "")
+	if path == "" {
+		return nil
+	}
+
+	tmpl, err := htmltemplate.ParseFiles(path)
+	if err != nil {
+		l.errorf("cannot parse %s %s", name, err)
+	}
+
+	return tmpl
+}
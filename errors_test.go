@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrefersJSON(t *testing.T) {
+	tests := map[string]bool{
+		"":                                    false,
+		"*/*":                                 false,
+		"application/json":                    true,
+		"text/html,application/xhtml+xml,*/*": false,
+		"application/json, text/html;q=0.9":   true,
+		"text/html, application/json;q=0.5":   false,
+		"application/*, text/*;q=0.1":         true,
+	}
+
+	for accept, want := range tests {
+		if got := prefersJSON(accept); got != want {
+			t.Errorf("prefersJSON(%q) = %t, expected %t", accept, got, want)
+		}
+	}
+}
+
+func TestBadGatewayErrorIsJSON(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{})
+
+	req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var body struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("expected JSON body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadGateway || body.Status != http.StatusBadGateway || body.Error != "bad gateway" {
+		t.Errorf("unexpected error response %d %+v", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// splitETags splits an If-None-Match style list into its entity tags,
+// keeping commas inside quoted tags intact.
+func splitETags(v string) []string {
+	var (
+		tags   []string
+		quoted bool
+		start  int
+	)
+
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				tags = append(tags, strings.TrimSpace(v[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	if tag := strings.TrimSpace(v[start:]); tag != "" {
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// weakETagMatch compares two entity tags ignoring the W/ weakness prefix, as
+// RFC 7232 requires for If-None-Match.
+func weakETagMatch(a, b string) bool {
+	return a != "" && strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// strongETagMatch only matches identical tags when neither is weak, which is
+// what If-Range needs since byte ranges of weakly equal bodies may differ.
+func strongETagMatch(a, b string) bool {
+	return a != "" && a == b && !strings.HasPrefix(a, "W/")
+}
+
+// notModified evaluates the client's If-None-Match, or failing that
+// If-Modified-Since, against the cached response headers h.
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := h.Get("ETag")
+
+		for _, tag := range splitETags(inm) {
+			if tag == "*" || weakETagMatch(tag, etag) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+
+	return err == nil && !lastModified.After(ims)
+}
+
+// ifRangeMatches reports whether the If-Range validator v still matches the
+// cached response headers h, so a partial response may be served.
+func ifRangeMatches(v string, h http.Header) bool {
+	if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "W/") {
+		return strongETagMatch(v, h.Get("ETag"))
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+
+	return err == nil && lastModified.Equal(t)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETagComparison(t *testing.T) {
+	tests := []struct {
+		a, b         string
+		weak, strong bool
+	}{
+		{`"abc"`, `"abc"`, true, true},
+		{`W/"abc"`, `"abc"`, true, false},
+		{`W/"abc"`, `W/"abc"`, true, false},
+		{`"abc"`, `"xyz"`, false, false},
+		{`W/"abc"`, `W/"xyz"`, false, false},
+	}
+
+	for _, tt := range tests {
+		if got := weakETagMatch(tt.a, tt.b); got != tt.weak {
+			t.Errorf("weakETagMatch(%s, %s) = %t, expected %t", tt.a, tt.b, got, tt.weak)
+		}
+
+		if got := strongETagMatch(tt.a, tt.b); got != tt.strong {
+			t.Errorf("strongETagMatch(%s, %s) = %t, expected %t", tt.a, tt.b, got, tt.strong)
+		}
+	}
+}
+
+func TestNotModifiedUsesWeakComparison(t *testing.T) {
+	cached := http.Header{"Etag": {`W/"v1"`}}
+
+	tests := map[string]bool{
+		`"v1"`:            true,
+		`W/"v1"`:          true,
+		`"v0", W/"v1"`:    true,
+		`"a,b", "v1"`:     true,
+		`*`:               true,
+		`"v2"`:            false,
+		`"v0", W/"other"`: false,
+	}
+
+	for inm, want := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("If-None-Match", inm)
+
+		if got := notModified(req, cached); got != want {
+			t.Errorf("If-None-Match %s: got %t, expected %t", inm, got, want)
+		}
+	}
+}
+
+func TestIfRangeRequiresStrongMatch(t *testing.T) {
+	if !ifRangeMatches(`"v1"`, http.Header{"Etag": {`"v1"`}}) {
+		t.Error("expected strong ETag to satisfy If-Range")
+	}
+
+	if ifRangeMatches(`W/"v1"`, http.Header{"Etag": {`W/"v1"`}}) {
+		t.Error("expected weak ETag not to satisfy If-Range")
+	}
+}
+
+func TestHitAnswersConditionalRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `W/"v1"`)
+		_, _ = w.Write([]byte("body"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{})
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("If-None-Match", `"v1"`)
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 from cache, got %d", resp.StatusCode)
+	}
+}
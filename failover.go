@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// failoverTransport retries requests against secondary origins, in order,
+// when the primary errors out or answers with one of the failover statuses.
+// Secondaries are only used on primary failure, never to spread load. They
+// stand in for the default origin only: requests routed to an upstream are
+// left alone, as its content would be cached from another origin. Nor do
+// they stand in when stale can: a failure that stale-if-error answers with
+// the cached entry is passed on as is.
+type failoverTransport struct {
+	next     http.RoundTripper
+	origins  []*url.URL
+	onError  bool
+	onStatus map[int]bool
+	stale    func(*http.Request) bool
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if upstreamFrom(req.Context()) != nil {
+		return t.next.RoundTrip(req)
+	}
+
+	res, err := t.next.RoundTrip(req)
+
+	// Requests with a body cannot be replayed once the primary consumed it.
+	if req.Body != nil && req.Body != http.NoBody {
+		return res, err
+	}
+
+	for _, origin := range t.origins {
+		if !t.shouldFailover(res, err) {
+			return res, err
+		}
+
+		// Only errors and 5xx are answered from stale, see handleOriginError.
+		if (err != nil || res.StatusCode >= http.StatusInternalServerError) && t.stale != nil && t.stale(req) {
+			log.Printf("not failing over %s, serving stale", req.URL.RequestURI())
+
+			return res, err
+		}
+
+		if res != nil {
+			_ = res.Body.Close()
+		}
+
+		log.Printf("failing over %s to %s", req.URL.RequestURI(), origin.Host)
+
+		outreq := req.Clone(req.Context())
+		outreq.URL.Scheme = origin.Scheme
+		outreq.URL.Host = origin.Host
+		outreq.Host = origin.Host
+
+		res, err = t.next.RoundTrip(outreq)
+	}
+
+	return res, err
+}
+
+func (t *failoverTransport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
+
+func (t *failoverTransport) shouldFailover(res *http.Response, err error) bool {
+	if err != nil {
+		return t.onError
+	}
+
+	return t.onStatus[res.StatusCode]
+}
+
+// preferStale lets the stale-if-error entries of c answer before the
+// secondaries of the failover transport under rt, if there is one.
+func preferStale(rt http.RoundTripper, c *cache) {
+	if t, ok := rt.(*tracingTransport); ok {
+		rt = t.next
+	}
+
+	if t, ok := rt.(*failoverTransport); ok {
+		t.stale = func(r *http.Request) bool {
+			_, ok := c.staleOnError(r)
+
+			return ok
+		}
+	}
+}
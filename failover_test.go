@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailoverToSecondaryOrigin(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	defer primary.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secondary"))
+	}))
+
+	defer secondary.Close()
+
+	secondaryURL, err := url.Parse(secondary.URL)
+	if err != nil {
+		t.Fatalf("failed to parse url: %v", err)
+	}
+
+	cfg := &config{
+		failoverOrigins:  []*url.URL{secondaryURL},
+		failoverStatuses: []int{http.StatusServiceUnavailable},
+	}
+	c := newCache(time.Hour)
+	proxy := newReverseProxy(primary.URL, cfg)
+	handleMissedCache(proxy, c, cfg)
+
+	proxyServer := httptest.NewServer(proxy)
+
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "secondary" {
+		t.Errorf("expected response from secondary, got %d %q", resp.StatusCode, body)
+	}
+
+	c.mu.RLock()
+	_, ok := c.data["/test"]
+	c.mu.RUnlock()
+
+	if !ok {
+		t.Error("expected failover response to be cached")
+	}
+}
+
+func TestFailoverLeavesUpstreamsAlone(t *testing.T) {
+	def := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("default"))
+	}))
+
+	defer def.Close()
+
+	tenant := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	defer tenant.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secondary"))
+	}))
+
+	defer secondary.Close()
+
+	tenantURL, _ := url.Parse(tenant.URL)
+	secondaryURL, _ := url.Parse(secondary.URL)
+
+	cfg := &config{
+		adminSecret:      "secret",
+		upstreams:        []upstreamRoute{{host: "tenant.example", target: tenantURL}},
+		failoverOrigins:  []*url.URL{secondaryURL},
+		failoverStatuses: []int{http.StatusServiceUnavailable},
+	}
+	c := newCache(time.Hour)
+	srv := httptest.NewServer(newProxy(def.URL, c, cfg).routes())
+
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/test", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	req.Host = "tenant.example"
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) == "secondary" {
+		t.Errorf("expected the upstream's own answer, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestStaleIfErrorBeforeFailover(t *testing.T) {
+	var failing atomic.Bool
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=0")
+		_, _ = w.Write([]byte("primary"))
+	}))
+
+	defer primary.Close()
+
+	var secondaryRequests atomic.Int64
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryRequests.Add(1)
+		_, _ = w.Write([]byte("secondary"))
+	}))
+
+	defer secondary.Close()
+
+	secondaryURL, _ := url.Parse(secondary.URL)
+
+	cfg := &config{
+		failoverOrigins:  []*url.URL{secondaryURL},
+		failoverStatuses: []int{http.StatusServiceUnavailable},
+	}
+	c := newCache(time.Hour)
+	c.staleIfError = time.Hour
+	proxy := newReverseProxy(primary.URL, cfg)
+	handleMissedCache(proxy, c, cfg)
+
+	proxyServer := httptest.NewServer(proxy)
+
+	defer proxyServer.Close()
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(proxyServer.URL + path)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(body)
+	}
+
+	get("/test")
+	failing.Store(true)
+
+	if resp, body := get("/test"); body != "primary" || resp.Header.Get("X-Cache") != XCacheStale {
+		t.Errorf("expected the stale entry, got %q %q", resp.Header.Get("X-Cache"), body)
+	}
+
+	if secondaryRequests.Load() != 0 {
+		t.Errorf("expected no failover while stale stands in, got %d requests", secondaryRequests.Load())
+	}
+
+	if _, body := get("/other"); body != "secondary" {
+		t.Errorf("expected a failover without a stale entry, got %q", body)
+	}
+}
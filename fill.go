@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var fillsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cache_fills_in_flight",
+	Help: "Number of cache misses being fetched from the origin, by origin host.",
+}, []string{"origin"})
+
+var fillsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_fills_rejected_total",
+	Help: "Number of cache misses answered 503 after queueing for a fill slot, by origin host.",
+}, []string{"origin"})
+
+// fillLimiter caps the concurrent cache fills of each origin at limit, zero
+// meaning no cap. Concurrent misses of the same key are already coalesced,
+// so this bounds the distinct keys fetched at once, e.g. on a cold start.
+type fillLimiter struct {
+	mu    sync.Mutex
+	limit int
+	slots map[string]chan struct{}
+}
+
+// acquire takes a fill slot of origin, queueing up to wait for one. The
+// returned release may be called more than once.
+func (f *fillLimiter) acquire(ctx context.Context, origin string, wait time.Duration) (release func(), ok bool) {
+	var slots chan struct{}
+
+	if f.limit > 0 {
+		f.mu.Lock()
+		slots = f.slots[origin]
+		if slots == nil {
+			if f.slots == nil {
+				f.slots = make(map[string]chan struct{})
+			}
+
+			slots = make(chan struct{}, f.limit)
+			f.slots[origin] = slots
+		}
+		f.mu.Unlock()
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+
+			select {
+			case slots <- struct{}{}:
+			case <-timer.C:
+				fillsRejected.WithLabelValues(origin).Inc()
+
+				return nil, false
+			case <-ctx.Done():
+				return nil, false
+			}
+		}
+	}
+
+	fillsInFlight.WithLabelValues(origin).Inc()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			fillsInFlight.WithLabelValues(origin).Dec()
+
+			if slots != nil {
+				<-slots
+			}
+		})
+	}, true
+}
+
+// fillOrigin names the origin r is fetched from for the fill metrics.
+func fillOrigin(r *http.Request) string {
+	if route := upstreamFrom(r.Context()); route != nil {
+		return route.target.Host
+	}
+
+	return "default"
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyCacheTTLHeader lets the origin pin the freshness of a response, in
+// seconds. It overrides every other freshness source and is never passed on
+// to clients.
+const ProxyCacheTTLHeader = "X-Proxy-Cache-TTL"
+
+// parseCacheControl splits a Cache-Control header value into lower-cased
+// directives mapped to their (unquoted) arguments.
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, arg, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+	}
+
+	return cc
+}
+
+func parseDeltaSeconds(v string) (time.Duration, bool) {
+	s, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || s < 0 {
+		return 0, false
+	}
+
+	return time.Duration(s) * time.Second, true
+}
+
+// freshnessLifetime computes how long a response may be served from cache.
+// s-maxage and max-age take precedence over Expires, and the default TTL is
+// only used when the origin sent neither. An invalid or past Expires makes
+// the response stale right away. Expires counts from Date, or from now when
+// the origin sent none.
+func freshnessLifetime(h http.Header, def time.Duration, now time.Time) time.Duration {
+	cc := parseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			if d, ok := parseDeltaSeconds(v); ok {
+				return d
+			}
+		}
+	}
+
+	if _, ok := h["Expires"]; ok {
+		exp, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return 0
+		}
+
+		base := now
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			base = date
+		}
+
+		if !exp.After(base) {
+			return 0
+		}
+
+		return exp.Sub(base)
+	}
+
+	return def
+}
+
+// isImmutable reports whether the origin marked the response immutable, i.e.
+// it will not change while fresh (RFC 8246).
+func isImmutable(h http.Header) bool {
+	_, ok := parseCacheControl(strings.Join(h.Values("Cache-Control"), ","))["immutable"]
+
+	return ok
+}
+
+// entryTTL is the freshness lifetime stored with a cache entry.
+func entryTTL(h http.Header, def time.Duration, now time.Time) time.Duration {
+	if d, ok := proxyCacheTTL(h); ok {
+		return d
+	}
+
+	return freshnessLifetime(h, def, now)
+}
+
+// proxyCacheTTL reads ProxyCacheTTLHeader, ignoring malformed values.
+func proxyCacheTTL(h http.Header) (time.Duration, bool) {
+	v := h.Get(ProxyCacheTTLHeader)
+	if v == "" {
+		return 0, false
+	}
+
+	return parseDeltaSeconds(strings.TrimSpace(v))
+}
+
+// requestCacheControl holds the Cache-Control directives a client sent.
+type requestCacheControl struct {
+	noCache      bool
+	noStore      bool
+	onlyIfCached bool
+
+	maxAge    time.Duration
+	hasMaxAge bool
+
+	// minFresh asks for entries that stay fresh at least that long, and
+	// maxStale accepts entries stale for up to that long, or for any time
+	// when negative.
+	minFresh    time.Duration
+	maxStale    time.Duration
+	hasMaxStale bool
+}
+
+// requestCacheControl parses the request directives, or returns none when
+// they are ignored. A lone "no-cache" next to Pragma: no-cache is the one
+// net/http synthesizes, which is left to HONOR_PRAGMA.
+func (cfg *config) requestCacheControl(h http.Header) requestCacheControl {
+	var rcc requestCacheControl
+
+	values := h.Values("Cache-Control")
+	if cfg.ignoreRequestCacheControl || len(values) == 0 {
+		return rcc
+	}
+
+	if len(values) == 1 && values[0] == "no-cache" && h.Get("Pragma") != "" {
+		return rcc
+	}
+
+	cc := parseCacheControl(strings.Join(values, ","))
+	_, rcc.noCache = cc["no-cache"]
+	_, rcc.noStore = cc["no-store"]
+	_, rcc.onlyIfCached = cc["only-if-cached"]
+
+	if v, ok := cc["max-age"]; ok {
+		rcc.maxAge, rcc.hasMaxAge = parseDeltaSeconds(v)
+	}
+
+	if v, ok := cc["min-fresh"]; ok {
+		rcc.minFresh, _ = parseDeltaSeconds(v)
+	}
+
+	if v, ok := cc["max-stale"]; ok {
+		rcc.maxStale, rcc.hasMaxStale = -1, true
+
+		if v != "" {
+			rcc.maxStale, rcc.hasMaxStale = parseDeltaSeconds(v)
+		}
+	}
+
+	return rcc
+}
+
+// uncacheable reports whether a GET is neither served from nor stored in the
+// cache, because of no-store, because it has a query string that is not
+// cached, because its body is over the limit or because it overrides its
+// method.
+func (cfg *config) uncacheable(r *http.Request) bool {
+	return cfg.requestCacheControl(r.Header).noStore || (cfg.skipQueryStrings && r.URL.RawQuery != "") ||
+		(cfg.maxRequestBody > 0 && r.ContentLength > cfg.maxRequestBody) ||
+		cfg.effectiveMethod(r) != r.Method
+}
+
+// authorizedCacheable reports whether the response with header to out, as
+// sent to the origin, may be stored despite an Authorization header. By
+// default only responses allowing shared caching through public, s-maxage or
+// must-revalidate are, see RFC 9111 section 3.5. Credentials set through
+// UPSTREAM_HEADERS are the proxy's own and don't count.
+func (cfg *config) authorizedCacheable(out *http.Request, header http.Header) bool {
+	if out.Header.Get("Authorization") == "" || cfg.upstreamHeaders.Get("Authorization") != "" {
+		return true
+	}
+
+	switch cfg.authorized {
+	case AuthorizedAlways:
+		return true
+	case AuthorizedNever:
+		return false
+	}
+
+	cc := parseCacheControl(strings.Join(header.Values("Cache-Control"), ","))
+	for _, directive := range []string{"public", "s-maxage", "must-revalidate"} {
+		if _, ok := cc[directive]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streams reports whether res should stream through uncached rather than be
+// buffered, judging only by its headers: server-sent events, whose body never
+// ends, a Content-Type starting with one of the stream types, or a
+// Content-Length of at least the stream threshold. Other bodies of unknown
+// length are buffered, up to CACHE_MAX_BODY_BYTES.
+func (cfg *config) streams(res *http.Response) bool {
+	if cfg.streamMinBytes > 0 && res.ContentLength >= cfg.streamMinBytes {
+		return true
+	}
+
+	ct := strings.ToLower(res.Header.Get("Content-Type"))
+	if mt, _, _ := mime.ParseMediaType(ct); mt == "text/event-stream" {
+		return true
+	}
+
+	for _, prefix := range cfg.streamContentTypes {
+		if strings.HasPrefix(ct, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usable reports whether an entry stored at age with the given ttl may be
+// served without contacting the origin, and whether it is served stale
+// because of max-stale.
+func (rcc requestCacheControl) usable(age, ttl time.Duration) (ok, stale bool) {
+	if rcc.noCache || (rcc.hasMaxAge && age > rcc.maxAge) {
+		return false, false
+	}
+
+	remaining := ttl - age
+
+	if remaining > 0 {
+		return remaining >= rcc.minFresh, false
+	}
+
+	if rcc.hasMaxStale && (rcc.maxStale < 0 || -remaining <= rcc.maxStale) {
+		return true, true
+	}
+
+	return false, false
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2026, time.January, 2, 3, 4, 5, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"default ttl", http.Header{}, time.Hour},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute},
+		{"expires", http.Header{
+			"Date":    {date},
+			"Expires": {now.Add(5 * time.Minute).Format(http.TimeFormat)},
+		}, 5 * time.Minute},
+		{"cache-control over expires", http.Header{
+			"Cache-Control": {"max-age=10"},
+			"Date":          {date},
+			"Expires":       {now.Add(5 * time.Minute).Format(http.TimeFormat)},
+		}, 10 * time.Second},
+		{"past expires", http.Header{
+			"Date":    {date},
+			"Expires": {now.Add(-time.Minute).Format(http.TimeFormat)},
+		}, 0},
+		{"invalid expires", http.Header{"Expires": {"0"}}, 0},
+		{"expires without date", http.Header{
+			"Expires": {now.Add(5 * time.Minute).Format(http.TimeFormat)},
+		}, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := freshnessLifetime(tt.header, time.Hour, now); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRequestCacheControl(t *testing.T) {
+	var upstream int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream++
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+
+	get := func(path, cacheControl string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp
+	}
+
+	if resp := get("/test", "only-if-cached"); resp.StatusCode != http.StatusGatewayTimeout || upstream != 0 {
+		t.Errorf("expected 504 without contacting the origin, got %d after %d requests", resp.StatusCode, upstream)
+	}
+
+	get("/test", "")
+
+	for _, cc := range []string{"no-cache", "max-age=0"} {
+		if resp := get("/test", cc); resp.Header.Get("X-Cache") != XCacheMiss {
+			t.Errorf("%s: expected MISS, got %q", cc, resp.Header.Get("X-Cache"))
+		}
+	}
+
+	if resp := get("/test", "max-age=3600"); resp.Header.Get("X-Cache") != XCacheHit {
+		t.Errorf("expected HIT within max-age, got %q", resp.Header.Get("X-Cache"))
+	}
+
+	if resp := get("/test", "only-if-cached"); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != XCacheHit {
+		t.Errorf("expected cached 200, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+
+	before := upstream
+
+	get("/private", "no-store")
+
+	if _, ok := c.data["/private"]; ok {
+		t.Error("expected no-store response not to be cached")
+	}
+
+	if resp := get("/test", "no-store"); resp.Header.Get("X-Cache") != XCacheMiss || upstream != before+2 {
+		t.Errorf("expected no-store to bypass the cached entry, got %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestRequestCacheControlUsable(t *testing.T) {
+	cfg := &config{}
+	age := time.Minute
+
+	tests := []struct {
+		cacheControl string
+		ttl          time.Duration
+		ok, stale    bool
+	}{
+		{"", time.Hour, true, false},
+		{"only-if-cached", time.Hour, true, false},
+		{"only-if-cached, no-cache", time.Hour, false, false},
+		{"only-if-cached, max-age=30", time.Hour, false, false},
+		{"min-fresh=30", 75 * time.Second, false, false},
+		{"min-fresh=10", 75 * time.Second, true, false},
+		{"only-if-cached", 30 * time.Second, false, false},
+		{"only-if-cached, max-stale", 30 * time.Second, true, true},
+		{"max-stale=60", 30 * time.Second, true, true},
+		{"max-stale=10", 30 * time.Second, false, false},
+		{"max-stale, no-cache", 30 * time.Second, false, false},
+	}
+
+	for _, tt := range tests {
+		rcc := cfg.requestCacheControl(http.Header{"Cache-Control": {tt.cacheControl}})
+
+		if ok, stale := rcc.usable(age, tt.ttl); ok != tt.ok || stale != tt.stale {
+			t.Errorf("%q with ttl %s: got (%v, %v), want (%v, %v)", tt.cacheControl, tt.ttl, ok, stale, tt.ok, tt.stale)
+		}
+	}
+}
+
+func TestEntryAgeIsMonotonic(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	// time.Time only prints the m= offset while it has a monotonic reading,
+	// which Round, UTC or a serialization round trip would strip.
+	if d := c.data["/test"]; !strings.Contains(d.age.String(), " m=") {
+		t.Errorf("expected a monotonic stored time, got %s", d.age)
+	}
+}
+
+func TestImmutableNotRevalidated(t *testing.T) {
+	var upstream int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream++
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		_, _ = w.Write([]byte("asset"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{honorPragma: true})
+
+	for _, h := range []http.Header{
+		{},
+		{"Cache-Control": {"no-cache"}},
+		{"Cache-Control": {"max-age=0"}},
+		{"Pragma": {"no-cache"}},
+	} {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/app.3f9a.js", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.Header = h
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	if upstream != 1 {
+		t.Errorf("expected a single origin request, got %d", upstream)
+	}
+}
+
+func TestSlidingTTL(t *testing.T) {
+	c := newCache(time.Hour)
+	c.slideFraction = 0.5
+
+	recent := time.Now().Add(-20 * time.Minute)
+	c.data["/hot"] = cacheData{ttl: time.Hour, age: recent, created: recent}
+
+	// 20 minutes old: half an hour forward would pass now.
+	c.slide("/hot", c.data["/hot"])
+
+	if d := c.data["/hot"]; time.Since(d.age) > time.Second {
+		t.Errorf("expected the age capped at now, got %s old", time.Since(d.age))
+	}
+
+	// Now at most 30 minutes past creation, so a lifetime of 90 minutes.
+	c.slideMax = 90 * time.Minute
+	created := time.Now().Add(-40 * time.Minute)
+	c.data["/hot"] = cacheData{ttl: time.Hour, age: created.Add(20 * time.Minute), created: created}
+	c.slide("/hot", c.data["/hot"])
+
+	if d := c.data["/hot"]; !d.age.Equal(created.Add(30 * time.Minute)) {
+		t.Errorf("expected the age capped by SLIDING_TTL_MAX, got %s after creation", d.age.Sub(created))
+	}
+
+	c.slideFraction = 0
+	before := c.data["/hot"].age
+	c.slide("/hot", c.data["/hot"])
+
+	if !c.data["/hot"].age.Equal(before) {
+		t.Error("expected no sliding while disabled")
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	var down bool
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=1")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.staleIfError = time.Hour
+
+	get := func() *http.Response {
+		resp, err := http.Get(proxyServer.URL + "/test")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp
+	}
+
+	get()
+
+	// Stale for a minute, long past the grace period but within the hour.
+	c.mu.Lock()
+	d := c.data["/test"]
+	d.age = time.Now().Add(-time.Minute)
+	c.data["/test"] = d
+	c.mu.Unlock()
+
+	if c.cleanup(); len(c.data) != 1 {
+		t.Fatal("expected cleanup to keep the entry for stale-if-error")
+	}
+
+	down = true
+	if resp := get(); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != XCacheStale {
+		t.Errorf("expected the stale entry on a 503, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+
+	backend.Close()
+	if resp := get(); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != XCacheStale {
+		t.Errorf("expected the stale entry with the origin down, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+
+	c.staleIfError = 30 * time.Second
+	if resp := get(); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 past STALE_IF_ERROR_MAX_AGE, got %d", resp.StatusCode)
+	}
+}
+
+func TestStatusTTLs(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		if code == http.StatusMovedPermanently {
+			w.Header().Set("Location", "/elsewhere")
+		}
+
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte("body"))
+	}))
+
+	defer backend.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	for _, only := range []bool{false, true} {
+		proxyServer, c := newTestProxy(t, backend.URL, &config{})
+		c.statusTTLs = []statusTTL{
+			{status: 200, ttl: time.Hour},
+			{status: 3, class: true, ttl: 24 * time.Hour},
+			{status: 404, ttl: time.Minute},
+			{status: 5, class: true},
+			{status: 503, ttl: time.Second},
+		}
+		c.statusTTLsOnly = only
+
+		unlisted := time.Hour
+		if only {
+			unlisted = 0
+		}
+
+		for status, want := range map[int]time.Duration{
+			200: time.Hour,
+			301: 24 * time.Hour,
+			404: time.Minute,
+			500: 0,
+			503: time.Second,
+			410: unlisted,
+		} {
+			uri := "/page?status=" + strconv.Itoa(status)
+
+			resp, err := client.Get(proxyServer.URL + uri)
+			if err != nil {
+				t.Fatalf("proxy request failed: %v", err)
+			}
+
+			_ = resp.Body.Close()
+
+			d, ok := c.data[uri]
+			if ok != (want > 0) || d.ttl != want {
+				t.Errorf("only %v, status %d: expected ttl %s, got %s (stored %v)", only, status, want, d.ttl, ok)
+			}
+		}
+	}
+}
+
+func TestAuthorizedResponses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		cfg    config
+		auth   string
+		cc     string
+		stored bool
+	}{
+		{cc: "", stored: true},
+		{auth: "Bearer t", cc: "", stored: false},
+		{auth: "Bearer t", cc: "max-age=60", stored: false},
+		{auth: "Bearer t", cc: "private, max-age=60", stored: false},
+		{auth: "Bearer t", cc: "public, max-age=60", stored: true},
+		{auth: "Bearer t", cc: "s-maxage=60", stored: true},
+		{auth: "Bearer t", cc: "must-revalidate", stored: true},
+		{cfg: config{authorized: AuthorizedAlways}, auth: "Bearer t", cc: "", stored: true},
+		{cfg: config{authorized: AuthorizedNever}, auth: "Bearer t", cc: "public", stored: false},
+		{cfg: config{upstreamHeaders: http.Header{"Authorization": {"Bearer proxy"}}}, auth: "Bearer t", cc: "", stored: true},
+	} {
+		proxyServer, c := newTestProxy(t, backend.URL, &tc.cfg)
+
+		uri := "/page?cc=" + url.QueryEscape(tc.cc)
+
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL+uri, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if _, ok := c.data[uri]; ok != tc.stored {
+			t.Errorf("authorization %q, Cache-Control %q, mode %q: expected stored %v, got %v",
+				tc.auth, tc.cc, tc.cfg.authorized, tc.stored, ok)
+		}
+	}
+}
+
+func TestDebugTTLParam(t *testing.T) {
+	var queries []string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		_, _ = w.Write([]byte("body"))
+	}))
+
+	defer backend.Close()
+
+	for _, debug := range []bool{false, true} {
+		queries = nil
+
+		proxyServer, c := newTestProxy(t, backend.URL, &config{debugTTLParam: "__cache_ttl", debugHeaders: debug})
+
+		shortened := time.Hour
+		if debug {
+			shortened = 5 * time.Second
+		}
+
+		for _, tt := range []struct {
+			uri, key string
+			want     time.Duration
+		}{
+			{"/a?x=1&__cache_ttl=5s", "/a?x=1", shortened},
+			{"/b?__cache_ttl=2h", "/b", time.Hour},
+			{"/c?__cache_ttl=bogus&y=2", "/c?y=2", time.Hour},
+		} {
+			resp, err := http.Get(proxyServer.URL + tt.uri)
+			if err != nil {
+				t.Fatalf("proxy request failed: %v", err)
+			}
+
+			_ = resp.Body.Close()
+
+			d, ok := c.data[tt.key]
+			if !ok || d.ttl != tt.want {
+				t.Errorf("debug %v, %s: expected ttl %s under %s, got %s (stored %v)", debug, tt.uri, tt.want, tt.key, d.ttl, ok)
+			}
+		}
+
+		if want := []string{"x=1", "", "y=2"}; strings.Join(queries, " ") != strings.Join(want, " ") {
+			t.Errorf("debug %v: expected origin queries %q, got %q", debug, want, queries)
+		}
+	}
+}
+
+func TestEntryLifetimeHistogram(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/short" {
+			w.Header().Set("Cache-Control", "max-age=30")
+		}
+
+		_, _ = w.Write([]byte("body"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.statusTTLs = []statusTTL{{status: 200, ttl: 6 * time.Hour}}
+
+	read := func() *dto.Histogram {
+		var m dto.Metric
+		if err := entryLifetime.Write(&m); err != nil {
+			t.Fatalf("cannot read the ttl histogram: %v", err)
+		}
+
+		return m.GetHistogram()
+	}
+
+	before := read()
+
+	for _, path := range []string{"/short", "/long"} {
+		resp, err := http.Get(proxyServer.URL + path)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	after := read()
+
+	if n := after.GetSampleCount() - before.GetSampleCount(); n != 2 {
+		t.Fatalf("expected two stored ttls, got %d", n)
+	}
+
+	if sum := after.GetSampleSum() - before.GetSampleSum(); sum != 30+6*3600 {
+		t.Errorf("expected the max-age and status ttls recorded, got a sum of %v seconds", sum)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"net/http/httputil"
+)
+
+// proxy is the reverse proxy and the cache wired together in front of one
+// origin.
+type proxy struct {
+	rp  *httputil.ReverseProxy
+	c   *cache
+	cfg *config
+
+	// reloads, when set, swaps this proxy for one with the reloaded
+	// configuration, see reloader.
+	reloads *reloader
+}
+
+// newProxy wires c in front of origin without listening anywhere, so the
+// result can be mounted under any server or tested with httptest.
+func newProxy(origin string, c *cache, cfg *config) *proxy {
+	rp := newReverseProxy(origin, cfg)
+	handleMissedCache(rp, c, cfg)
+
+	return &proxy{rp: rp, c: c, cfg: cfg}
+}
+
+// Handler returns the traced cache handler serving every proxied request.
+func (p *proxy) Handler() http.Handler {
+	return traced(cacheHandler(p.rp, p.c, p.cfg))
+}
+
+// routes returns a dedicated mux with the metrics and admin endpoints next to
+// the proxied routes, keeping http.DefaultServeMux untouched. With ADMIN_ADDR
+// set, the admin endpoints are left to adminRoutes instead.
+func (p *proxy) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", readyHandler(p.c, p.cfg))
+
+	if p.cfg.adminAddr == "" {
+		p.mountAdmin(mux)
+	}
+
+	mux.Handle("/", p.Handler())
+
+	return mux
+}
+
+// adminRoutes returns the mux served on ADMIN_ADDR, without proxied routes.
+func (p *proxy) adminRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	p.mountAdmin(mux)
+
+	return mux
+}
+
+func (p *proxy) mountAdmin(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/_cache/maintenance", adminOnly(p.cfg, maintenanceHandler(p.c, p.cfg)))
+	mux.HandleFunc("/_cache/purge", adminOnly(p.cfg, purgeHandler(p.c, p.cfg)))
+	mux.HandleFunc("/_cache/ttl", adminOnly(p.cfg, ttlOverrideHandler(p.c, p.cfg)))
+	mux.HandleFunc("/_cache/stats", adminOnly(p.cfg, statsHandler(p.c, p.cfg)))
+	mux.HandleFunc("/_cache/snapshot", adminOnly(p.cfg, snapshotHandler(p.c, p.cfg)))
+	mux.HandleFunc("/_cache/upstreams", adminOnly(p.cfg, upstreamsHandler(p.c, p.cfg)))
+	mux.HandleFunc("/_cache/selftest", adminOnly(p.cfg, selftestHandler(p.c, p.cfg)))
+
+	if p.reloads != nil {
+		mux.HandleFunc("/_cache/reload", adminOnly(p.cfg, reloadHandler(p.reloads, p.cfg)))
+	}
+}
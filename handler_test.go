@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerMountsUnderOwnMux(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+
+	defer backend.Close()
+
+	p := newProxy(backend.URL, newCache(time.Hour), &config{})
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", p.Handler()))
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, want := range []string{XCacheMiss, XCacheHit} {
+		resp, err := http.Get(srv.URL + "/api/products")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if string(body) != "/products" || resp.Header.Get("X-Cache") != want {
+			t.Errorf("expected %s of /products, got %q %q", want, resp.Header.Get("X-Cache"), body)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{adminSecret: "secret"}
+	srv := httptest.NewServer(newProxy(backend.URL, newCache(time.Hour), cfg).routes())
+	defer srv.Close()
+
+	for path, want := range map[string]int{
+		"/products":     http.StatusOK,
+		"/metrics":      http.StatusOK,
+		"/_cache/stats": http.StatusUnauthorized,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected %d, got %d", path, want, resp.StatusCode)
+		}
+	}
+
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, "/metrics", nil)); pattern != "" {
+		t.Errorf("expected nothing on http.DefaultServeMux, got %q", pattern)
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{adminSecret: "secret", adminAddr: "127.0.0.1:0", adminMaxBody: 16}
+	p := newProxy(backend.URL, newCache(time.Hour), cfg)
+
+	public := httptest.NewServer(p.routes())
+	defer public.Close()
+
+	admin := httptest.NewServer(p.adminRoutes())
+	defer admin.Close()
+
+	for _, tc := range []struct {
+		url, method, body string
+		want              int
+	}{
+		{public.URL + "/_cache/stats", http.MethodGet, "", http.StatusOK},
+		{admin.URL + "/_cache/stats", http.MethodGet, "", http.StatusOK},
+		{admin.URL + "/products", http.MethodGet, "", http.StatusNotFound},
+		{admin.URL + "/_cache/snapshot", http.MethodPost, `{"key":"/` + strings.Repeat("x", 16) + `"}`, http.StatusRequestEntityTooLarge},
+	} {
+		req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.url, tc.want, resp.StatusCode)
+		}
+
+		// The public listener proxies what used to be an admin route.
+		if strings.HasPrefix(tc.url, public.URL) && string(body) != "origin" {
+			t.Errorf("expected the origin behind %s, got %q", tc.url, body)
+		}
+	}
+}
+
+func TestReadyWaitsForWarm(t *testing.T) {
+	p := newProxy("http://127.0.0.1:0", newCache(time.Hour), &config{})
+	p.c.warming.begin(2)
+
+	srv := httptest.NewServer(p.routes())
+	defer srv.Close()
+
+	ready := func() int {
+		resp, err := http.Get(srv.URL + "/readyz")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while warming, got %d", got)
+	}
+
+	p.cfg.readyIgnoresWarm = true
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("expected 200 when ignoring warming, got %d", got)
+	}
+
+	p.cfg.readyIgnoresWarm = false
+	warm(p.rp, p.cfg, []string{"/a", "/b"}, &p.c.warming)
+
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("expected 200 once warmed, got %d", got)
+	}
+
+	if s := p.c.warming.status(); s.Done != 2 || s.Failed != 2 || !s.Complete {
+		t.Errorf("expected 2 failed paths reported, got %+v", s)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// invalidationRule lists the related paths to evict when an unsafe request
+// under prefix succeeded.
+type invalidationRule struct {
+	prefix  string
+	related []string
+}
+
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+
+	return true
+}
+
+// MethodOverrideHeader carries the method a client meant but could not send.
+const MethodOverrideHeader = "X-HTTP-Method-Override"
+
+// effectiveMethod is the method of r, or the one it overrides it with when
+// METHOD_OVERRIDE is on. The origin is assumed to honor the override too.
+func (cfg *config) effectiveMethod(r *http.Request) string {
+	if m := r.Header.Get(MethodOverrideHeader); cfg.methodOverride && m != "" {
+		return strings.ToUpper(strings.TrimSpace(m))
+	}
+
+	return r.Method
+}
+
+// invalidationPaths lists the paths a successful unsafe response makes stale:
+// the request path, its same-origin Location and Content-Location, and the
+// related paths of matching rules.
+func (cfg *config) invalidationPaths(res *http.Response) []string {
+	paths := []string{res.Request.URL.Path}
+
+	for _, h := range []string{"Location", "Content-Location"} {
+		u, err := url.Parse(res.Header.Get(h))
+		if err != nil || u.Path == "" || (u.Host != "" && u.Host != res.Request.URL.Host) {
+			continue
+		}
+
+		paths = append(paths, res.Request.URL.ResolveReference(u).Path)
+	}
+
+	for _, rule := range cfg.invalidationRules {
+		if strings.HasPrefix(res.Request.URL.Path, rule.prefix) {
+			paths = append(paths, rule.related...)
+		}
+	}
+
+	return paths
+}
+
+// purgeMatch finds the entries of path, whatever their query string, along
+// with its segments. A long key is only found hashed, and then only for the
+// exact URI.
+func (c *cache) purgeMatch(path string) func(k string) bool {
+	partition, uri := splitPartition(path)
+	key := c.keyPrefix + partition + c.slashed(uri)
+	hashed := c.boundKey(key, len(c.keyPrefix)+len(partition))
+
+	return func(k string) bool {
+		return k == key || k == hashed || strings.HasPrefix(k, key+"?") || strings.HasPrefix(k, key+"#")
+	}
+}
+
+// invalidate evicts the entries of path from both tiers and reports how many.
+func (c *cache) invalidate(path string) int {
+	match := c.purgeMatch(path)
+	n := 0
+
+	// Memory goes first, so entries demoted meanwhile are still found on
+	// disk.
+	c.mu.Lock()
+	for k := range c.data {
+		if match(k) {
+			c.evict(k, EvictionReasonPurge)
+			n++
+		}
+	}
+	c.mu.Unlock()
+
+	return n + c.purgeDisk(match)
+}
+
+// flush evicts every entry from both tiers and reports how many.
+func (c *cache) flush() int {
+	c.mu.Lock()
+	n := len(c.data)
+	for k := range c.data {
+		c.evict(k, EvictionReasonFlush)
+	}
+	c.mu.Unlock()
+
+	return n + c.purgeDisk(func(string) bool { return true })
+}
+
+// softPurge marks the entries of path stale rather than evicting them, so
+// they are revalidated before being served again, cheaply when they carry
+// validators, and can still stand in for an origin error. It reports how many
+// it marked. Entries on disk can't be marked in place and are removed, and
+// counted among them.
+func (c *cache) softPurge(path string) int {
+	match := c.purgeMatch(path)
+	n := 0
+
+	c.mu.Lock()
+	for k, d := range c.data {
+		if match(k) && !d.forcedStale {
+			d.forcedStale = true
+			c.data[k] = d
+			n++
+		}
+	}
+	c.mu.Unlock()
+
+	softPurges.Add(float64(n))
+
+	return n + c.purgeDisk(match)
+}
+
+// maxPurgeRegexBytes bounds the patterns of regex purges, whose compiled
+// programs grow with them.
+const maxPurgeRegexBytes = 1024
+
+// purgeCheckEvery is how many keys a regex purge matches between checks of
+// its deadline.
+const purgeCheckEvery = 1000
+
+// purgeRegex evicts the entries whose key, without CACHE_KEY_PREFIX, matches
+// re, or only marks them stale when soft, in a single pass under the write
+// lock. RE2 matches in linear time, so only the number of keys can make it
+// slow: it stops once ctx is done, reporting how many it purged so far and
+// false. Entries on disk are removed, soft or not, after the pass over
+// memory and outside of the lock.
+func (c *cache) purgeRegex(ctx context.Context, re *regexp.Regexp, soft bool) (n int, complete bool) {
+	if n, complete = c.purgeRegexMemory(ctx, re, soft); !complete || c.l2 == nil {
+		return n, complete
+	}
+
+	i := 0
+
+	for k := range c.l2.Entries() {
+		if i++; i%purgeCheckEvery == 0 && ctx.Err() != nil {
+			return n, false
+		}
+
+		if re.MatchString(strings.TrimPrefix(k, c.keyPrefix)) {
+			c.l2.Delete(k)
+			n++
+		}
+	}
+
+	return n, true
+}
+
+func (c *cache) purgeRegexMemory(ctx context.Context, re *regexp.Regexp, soft bool) (n int, complete bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if soft {
+		defer func() {
+			softPurges.Add(float64(n))
+		}()
+	}
+
+	i := 0
+
+	for k, d := range c.data {
+		if i++; i%purgeCheckEvery == 0 && ctx.Err() != nil {
+			return n, false
+		}
+
+		if !re.MatchString(strings.TrimPrefix(k, c.keyPrefix)) {
+			continue
+		}
+
+		switch {
+		case !soft:
+			c.evict(k, EvictionReasonPurge)
+		case d.forcedStale:
+			continue
+		default:
+			d.forcedStale = true
+			c.data[k] = d
+		}
+
+		n++
+	}
+
+	return n, true
+}
+
+// purgeHandler removes the entries of ?path= on POST or DELETE, those whose
+// key matches ?regex=, or all of them with ?all=true, and only marks them
+// stale with ?soft=true. A path matches its exact key and the keys continuing
+// it with ?… or #…, see purgeMatch.
+func purgeHandler(c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "POST, DELETE")
+			cfg.writeError(w, r, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		q := r.URL.Query()
+		path, pattern := q.Get("path"), q.Get("regex")
+
+		all := false
+		if v := q.Get("all"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				cfg.writeError(w, r, http.StatusBadRequest)
+
+				return
+			}
+
+			all = b
+		}
+
+		// A path is matched as a key, never as a pattern, so exactly one
+		// of them, or all, must be given.
+		given := 0
+		for _, ok := range []bool{path != "", pattern != "", all} {
+			if ok {
+				given++
+			}
+		}
+
+		if given != 1 || (path != "" && !strings.HasPrefix(path, "/")) || len(pattern) > maxPurgeRegexBytes {
+			cfg.writeError(w, r, http.StatusBadRequest)
+
+			return
+		}
+
+		var re *regexp.Regexp
+		if pattern != "" {
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				cfg.writeError(w, r, http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		soft := false
+		if v := q.Get("soft"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				cfg.writeError(w, r, http.StatusBadRequest)
+
+				return
+			}
+
+			soft = b
+		}
+
+		// Flushes are hard only.
+		if all && soft {
+			cfg.writeError(w, r, http.StatusBadRequest)
+
+			return
+		}
+
+		n, complete := 0, true
+
+		switch {
+		case all:
+			n = c.flush()
+			path = "*"
+		case re != nil:
+			n, complete = c.purgeRegex(r.Context(), re, soft)
+		case soft:
+			n = c.softPurge(path)
+		default:
+			n = c.invalidate(path)
+		}
+
+		// Only one of path and pattern is set, path being * for a flush.
+		log.Printf("purged %d entries of %s%s (soft %v, complete %v)", n, path, pattern, soft, complete)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(struct {
+			Purged     int  `json:"purged"`
+			Soft       bool `json:"soft"`
+			Incomplete bool `json:"incomplete,omitempty"`
+		}{n, soft, !complete})
+		if err != nil {
+			log.Printf("can't write to body %s", err)
+		}
+	}
+}
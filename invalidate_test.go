@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidateOnUnsafe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/products/6" {
+			w.WriteHeader(http.StatusConflict)
+
+			return
+		}
+
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{
+		invalidateOnUnsafe: true,
+		invalidationRules:  []invalidationRule{{prefix: "/products/", related: []string{"/products"}}},
+	})
+
+	do := func(method, path string) {
+		req, err := http.NewRequest(method, proxyServer.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	for _, path := range []string{"/products", "/products?page=2", "/products/5", "/products/5?fields=name", "/products/50", "/products/6", "/cart"} {
+		do(http.MethodGet, path)
+	}
+
+	do(http.MethodPut, "/products/5")
+	do(http.MethodDelete, "/products/6")
+
+	for key, want := range map[string]bool{
+		"/products":               false,
+		"/products?page=2":        false,
+		"/products/5":             false,
+		"/products/5?fields=name": false,
+		"/products/50":            true,
+		"/products/6":             true,
+		"/cart":                   true,
+	} {
+		if _, ok := c.data[key]; ok != want {
+			t.Errorf("%s: expected cached %v, got %v", key, want, ok)
+		}
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{invalidateOnUnsafe: true}
+	proxyServer, c := newTestProxy(t, backend.URL, cfg)
+
+	do := func(method, override string) {
+		req, err := http.NewRequest(method, proxyServer.URL+"/products/5", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if override != "" {
+			req.Header.Set(MethodOverrideHeader, override)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	do(http.MethodGet, "")
+	do(http.MethodGet, "delete")
+
+	if _, ok := c.data["/products/5"]; !ok {
+		t.Fatal("expected the override ignored while METHOD_OVERRIDE is off")
+	}
+
+	cfg.methodOverride = true
+	do(http.MethodGet, "delete")
+
+	if _, ok := c.data["/products/5"]; ok {
+		t.Error("expected an overridden DELETE to invalidate the entry")
+	}
+
+	do(http.MethodGet, "delete")
+
+	if _, ok := c.data["/products/5"]; ok {
+		t.Error("expected an overridden request never stored")
+	}
+}
+
+func TestPurgePathMatchesKeys(t *testing.T) {
+	c := newCache(time.Hour)
+
+	for _, key := range []string{"/products", "/products?page=2", "/products#Accept=text%2Fhtml", "/products/1", "/productsx"} {
+		c.store(key, cacheData{age: time.Now(), ttl: time.Hour})
+	}
+
+	if n := c.invalidate("/products"); n != 3 {
+		t.Errorf("expected the key with its query strings and headers purged, got %d entries", n)
+	}
+
+	for _, key := range []string{"/products/1", "/productsx"} {
+		if _, ok := c.data[key]; !ok {
+			t.Errorf("expected %s not to be purged", key)
+		}
+	}
+}
+
+func TestPurgeRegex(t *testing.T) {
+	c := newCache(time.Hour)
+	c.keyPrefix = "v1"
+	cfg := &config{adminSecret: "secret"}
+	h := adminOnly(cfg, purgeHandler(c, cfg))
+
+	for _, key := range []string{"/products/1", "/products/2?color=red", "/products/new", "/users/1", "/users/2"} {
+		c.store(c.keyPrefix+key, cacheData{age: time.Now(), ttl: time.Hour})
+	}
+
+	purge := func(query url.Values) (int, int) {
+		req := httptest.NewRequest(http.MethodPost, "/_cache/purge?"+query.Encode(), nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rec := httptest.NewRecorder()
+		h(rec, req)
+
+		var report struct {
+			Purged int `json:"purged"`
+		}
+
+		_ = json.NewDecoder(rec.Body).Decode(&report)
+
+		return rec.Code, report.Purged
+	}
+
+	if code, n := purge(url.Values{"regex": {`^/products/\d+(\?|$)`}}); code != http.StatusOK || n != 2 {
+		t.Fatalf("expected two products purged, got %d entries and status %d", n, code)
+	}
+
+	for key, kept := range map[string]bool{"/products/1": false, "/products/2?color=red": false, "/products/new": true} {
+		if _, ok := c.data[c.keyPrefix+key]; ok != kept {
+			t.Errorf("%s: expected kept %v", key, kept)
+		}
+	}
+
+	if code, n := purge(url.Values{"regex": {"^/users/"}, "soft": {"true"}}); code != http.StatusOK || n != 2 {
+		t.Fatalf("expected two users soft purged, got %d entries and status %d", n, code)
+	}
+
+	if d, ok := c.data[c.keyPrefix+"/users/1"]; !ok || !d.forcedStale {
+		t.Errorf("expected the soft purged entry kept and marked stale")
+	}
+
+	for name, query := range map[string]url.Values{
+		"invalid regex":   {"regex": {"(products"}},
+		"path and regex":  {"path": {"/products"}, "regex": {"^/products"}},
+		"neither":         {},
+		"oversized regex": {"regex": {strings.Repeat("a", maxPurgeRegexBytes+1)}},
+		"not a path":      {"path": {"products"}},
+		"invalid soft":    {"regex": {"^/"}, "soft": {"maybe"}},
+		"all and path":    {"all": {"true"}, "path": {"/products"}},
+		"soft flush":      {"all": {"true"}, "soft": {"true"}},
+		"invalid all":     {"all": {"maybe"}},
+	} {
+		if code, _ := purge(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, code)
+		}
+	}
+
+	if code, n := purge(url.Values{"all": {"true"}}); code != http.StatusOK || n != 3 || len(c.data) != 0 {
+		t.Errorf("expected the flush to purge the three entries left, got %d entries and status %d", n, code)
+	}
+}
+
+func TestPurgeRegexStopsAtDeadline(t *testing.T) {
+	c := newCache(time.Hour)
+
+	total := 3 * purgeCheckEvery
+	for i := range total {
+		c.store("/entry/"+strconv.Itoa(i), cacheData{age: time.Now(), ttl: time.Hour})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n, complete := c.purgeRegex(ctx, regexp.MustCompile("^/entry/"), false)
+	if complete || n >= total || len(c.data) != total-n {
+		t.Errorf("expected the purge to stop early, purged %d of %d (complete %v)", n, total, complete)
+	}
+}
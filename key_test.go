@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readKeyRequest parses uri the way the server does, leaving it to the
+// fuzzer to find URIs the server accepts.
+func readKeyRequest(uri, tenant string) (*http.Request, bool) {
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET " + uri + " HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	if err != nil {
+		return nil, false
+	}
+
+	if tenant != "" {
+		r.Header.Set("X-Tenant", tenant)
+	}
+
+	return r, true
+}
+
+func FuzzCacheKey(f *testing.F) {
+	f.Add("/products?limit=10", "", "/products?limit=10", "acme")
+	f.Add("/products?a#X-Tenant=acme", "", "/products?a", "acme")
+	f.Add("/products#", "acme", "/products%23", "acme")
+	f.Add("/a%2Fb", "", "/a/b", "")
+
+	c := newCache(time.Hour)
+	c.keyPrefix = "v2:"
+	c.setKeyHeaders([]string{"X-Tenant"})
+
+	f.Fuzz(func(t *testing.T, uri1, tenant1, uri2, tenant2 string) {
+		r1, ok1 := readKeyRequest(uri1, tenant1)
+		r2, ok2 := readKeyRequest(uri2, tenant2)
+
+		if !ok1 || !ok2 {
+			return
+		}
+
+		if again, _ := readKeyRequest(uri1, tenant1); c.key(r1) != c.key(again) {
+			t.Fatalf("identical requests for %q got keys %q and %q", uri1, c.key(r1), c.key(again))
+		}
+
+		sameURI := keyURI(r1.URL) == keyURI(r2.URL)
+		sameTenant := r1.Header.Get("X-Tenant") == r2.Header.Get("X-Tenant")
+
+		if c.key(r1) == c.key(r2) && (!sameURI || !sameTenant) {
+			t.Fatalf("%q with tenant %q and %q with tenant %q share the key %q",
+				uri1, tenant1, uri2, tenant2, c.key(r1))
+		}
+	})
+}
+
+func TestNormalizeAccept(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"*/*"}, ""},
+		{[]string{"application/JSON; q=1"}, "application/json"},
+		{[]string{"text/xml;q=0.5, application/json"}, "application/json,text/xml;q=0.5"},
+		{[]string{"application/json", "text/xml;q=0.50"}, "application/json,text/xml;q=0.5"},
+		{[]string{"text/html;level=1;charset=utf-8"}, "text/html;charset=utf-8;level=1"},
+		{[]string{"b/b, a/a"}, "a/a,b/b"},
+	} {
+		if got := normalizeAccept(tc.values); got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.values, tc.want, got)
+		}
+	}
+
+	c := newCache(time.Hour)
+	c.keyAccept = true
+
+	jsonReq, _ := readKeyRequest("/products", "")
+	jsonReq.Header.Set("Accept", "application/json")
+
+	xmlReq, _ := readKeyRequest("/products", "")
+	xmlReq.Header.Set("Accept", "application/xml")
+
+	if c.key(jsonReq) == c.key(xmlReq) {
+		t.Errorf("expected JSON and XML under different keys, got %q", c.key(jsonReq))
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	c := newCache(time.Hour)
+
+	for _, tc := range []struct {
+		mode, uri, want string
+	}{
+		{TrailingSlashKeep, "/products/", "/products/"},
+		{TrailingSlashStrip, "/products/", "/products"},
+		{TrailingSlashStrip, "/products/?limit=10", "/products?limit=10"},
+		{TrailingSlashStrip, "/", "/"},
+		{TrailingSlashAdd, "/products?q=a/", "/products/?q=a/"},
+		{TrailingSlashAdd, "/feed.json", "/feed.json"},
+		{TrailingSlashAdd, "/products/", "/products/"},
+	} {
+		c.trailingSlash = tc.mode
+
+		r, _ := readKeyRequest(tc.uri, "")
+		if got := c.key(r); got != tc.want {
+			t.Errorf("%s %s: expected %q, got %q", tc.mode, tc.uri, tc.want, got)
+		}
+	}
+
+	c.trailingSlash, c.slashPaths = TrailingSlashStrip, []string{"/products"}
+
+	if got := c.slashed("/categories/"); got != "/categories/" {
+		t.Errorf("expected paths outside TRAILING_SLASH_PATHS untouched, got %q", got)
+	}
+}
+
+func TestMaxVariants(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.setKeyHeaders([]string{"X-Tenant"})
+	c.maxVariants = 2
+
+	get := func(uri, tenant string) string {
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL+uri, nil)
+		req.Header.Set("X-Tenant", tenant)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp.Header.Get("X-Cache")
+	}
+
+	get("/page", "a")
+	get("/page", "b")
+	get("/other", "a")
+	get("/page", "a")
+	get("/page", "c")
+
+	for _, tc := range []struct{ tenant, want string }{
+		{"a", XCacheHit},
+		{"c", XCacheHit},
+		{"b", XCacheMiss},
+	} {
+		if got := get("/page", tc.tenant); got != tc.want {
+			t.Errorf("tenant %s: expected %s, got %q", tc.tenant, tc.want, got)
+		}
+	}
+
+	if got := get("/other", "a"); got != XCacheHit {
+		t.Errorf("expected the variants of other URLs kept, got %q", got)
+	}
+}
+
+func TestLongKeys(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Query().Get("q")))
+	}))
+
+	defer backend.Close()
+
+	long := "/search?q=" + strings.Repeat("a", 200)
+
+	for _, mode := range []string{LongKeysHash, LongKeysBypass} {
+		proxyServer, c := newTestProxy(t, backend.URL, &config{})
+		c.keyPrefix = "v1:"
+		c.maxKeyBytes, c.longKeys = 64, mode
+
+		for _, uri := range []string{"/short", long, long + "b", long} {
+			resp, err := http.Get(proxyServer.URL + uri)
+			if err != nil {
+				t.Fatalf("proxy request failed: %v", err)
+			}
+
+			_ = resp.Body.Close()
+		}
+
+		if _, ok := c.data["v1:/short"]; !ok {
+			t.Errorf("%s: expected the short key stored as is", mode)
+		}
+
+		for key := range c.data {
+			if len(key) > 64 && len(key) != len("v1:sha256:")+64 {
+				t.Errorf("%s: expected keys bounded, got %q", mode, key)
+			}
+		}
+
+		want := 3
+		if mode == LongKeysBypass {
+			want = 1
+		}
+
+		if len(c.data) != want {
+			t.Errorf("%s: expected %d entries, got %d", mode, want, len(c.data))
+		}
+
+		r := httptest.NewRequest(http.MethodGet, long, nil)
+		if key := c.key(r); mode == LongKeysHash && (!strings.HasPrefix(key, "v1:sha256:") || key == c.key(httptest.NewRequest(http.MethodGet, long+"b", nil))) {
+			t.Errorf("expected distinct hashed keys keeping the prefix, got %q", key)
+		}
+
+		if mode == LongKeysHash {
+			c.invalidate(long)
+
+			if _, ok := c.data[c.key(r)]; ok {
+				t.Error("expected the hashed entry invalidated by its URL")
+			}
+		}
+	}
+}
+
+func TestFullURLKey(t *testing.T) {
+	request := func(host, proto string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/page?a=1", nil)
+		r.Host = host
+
+		if proto != "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+
+		return r
+	}
+
+	c := newCache(time.Hour)
+
+	if c.key(request("a.example.com", "")) != c.key(request("b.example.com", "")) {
+		t.Error("expected hosts to share keys by default")
+	}
+
+	c.keyFullURL = true
+
+	same := [][2]*http.Request{
+		{request("a.example.com", ""), request("A.Example.com:80", "")},
+		{request("a.example.com.", "https"), request("a.example.com:443", "https")},
+	}
+	for _, pair := range same {
+		if k1, k2 := c.key(pair[0]), c.key(pair[1]); k1 != k2 {
+			t.Errorf("expected equivalent URLs to share a key, got %q and %q", k1, k2)
+		}
+	}
+
+	distinct := [][2]*http.Request{
+		{request("a.example.com", ""), request("b.example.com", "")},
+		{request("a.example.com", ""), request("a.example.com", "https")},
+		{request("a.example.com", ""), request("a.example.com:8080", "")},
+	}
+	for _, pair := range distinct {
+		if k1, k2 := c.key(pair[0]), c.key(pair[1]); k1 == k2 {
+			t.Errorf("expected distinct keys for %s and %s, got %q", pair[0].Host, pair[1].Host, k1)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inFlightTransport counts the upstream requests in flight, from when they
+// are sent until their response body is closed.
+type inFlightTransport struct {
+	next http.RoundTripper
+	n    *atomic.Int64
+}
+
+func (t *inFlightTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.n.Add(1)
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.n.Add(-1)
+
+		return nil, err
+	}
+
+	// Upgraded connections need the body as is; they are no longer a fill.
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		t.n.Add(-1)
+
+		return res, nil
+	}
+
+	res.Body = &inFlightBody{ReadCloser: res.Body, done: sync.OnceFunc(func() { t.n.Add(-1) })}
+
+	return res, nil
+}
+
+func (t *inFlightTransport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
+
+type inFlightBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *inFlightBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+
+	return err
+}
+
+// staleUnderLoad reports whether the expired entry d is served as is rather
+// than fetched again, because LOAD_STALE_THRESHOLD upstream requests are in
+// flight already and it expired at most LOAD_STALE_MAX_AGE ago.
+func (c *cache) staleUnderLoad(d cacheData, ttl time.Duration) bool {
+	l := c.currentLimits()
+	if l.loadStaleThreshold <= 0 || c.upstreamInFlight.Load() < int64(l.loadStaleThreshold) {
+		return false
+	}
+
+	return c.since(d.age)-ttl <= l.loadStaleMaxAge
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleUnderLoad(t *testing.T) {
+	var fetches atomic.Int32
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	clock := newFakeClock()
+	c.clock = clock
+	c.loadStaleThreshold = 2
+	c.loadStaleMaxAge = time.Minute
+
+	get := func(cacheControl string) string {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp.Header.Get("X-Cache")
+	}
+
+	get("")
+
+	if n := c.upstreamInFlight.Load(); n != 0 {
+		t.Fatalf("expected no upstream request in flight after the fill, got %d", n)
+	}
+
+	clock.advance(90 * time.Second)
+
+	// Below the threshold the expired entry is fetched again.
+	c.upstreamInFlight.Store(1)
+	if got := get(""); got == XCacheStale || fetches.Load() != 2 {
+		t.Errorf("expected a fetch below the threshold, got %q after %d fetches", got, fetches.Load())
+	}
+
+	clock.advance(90 * time.Second)
+
+	c.upstreamInFlight.Store(2)
+	if got := get(""); got != XCacheStale || fetches.Load() != 2 {
+		t.Errorf("expected STALE at the threshold, got %q after %d fetches", got, fetches.Load())
+	}
+
+	if got := get("no-cache"); got == XCacheStale || fetches.Load() != 3 {
+		t.Errorf("expected no-cache to reach the origin, got %q after %d fetches", got, fetches.Load())
+	}
+
+	// Expired for longer than LOAD_STALE_MAX_AGE.
+	clock.advance(3 * time.Minute)
+
+	if got := get(""); got == XCacheStale || fetches.Load() != 4 {
+		t.Errorf("expected a fetch past the max age, got %q after %d fetches", got, fetches.Load())
+	}
+}
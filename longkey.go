@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// How keys longer than CACHE_MAX_KEY_BYTES are handled.
+const (
+	LongKeysHash   = "hash"
+	LongKeysBypass = "bypass"
+)
+
+// boundKey replaces what follows the first keep bytes of a key longer than
+// maxKeyBytes by its SHA-256 in hash mode, so the prefix and upstream
+// partition stay readable. Request URIs start with '/', so hashed keys never
+// collide with plain ones.
+func (c *cache) boundKey(key string, keep int) string {
+	if c.maxKeyBytes <= 0 || len(key) <= c.maxKeyBytes || c.longKeys == LongKeysBypass {
+		return key
+	}
+
+	sum := sha256.Sum256([]byte(key[keep:]))
+
+	return key[:keep] + "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// keyStorable reports whether responses may be stored under key, which is
+// not the case for long keys in bypass mode.
+func (c *cache) keyStorable(key string) bool {
+	return c.maxKeyBytes <= 0 || len(key) <= c.maxKeyBytes || c.longKeys != LongKeysBypass
+}
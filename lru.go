@@ -0,0 +1,73 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruList orders the keys held in memory from most to least recently used.
+// It has its own lock so hits can touch keys under the cache read lock.
+type lruList struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLRU() *lruList {
+	return &lruList{ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// add inserts key as the most recently used, or moves it there.
+func (l *lruList) add(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.items[key]; ok {
+		l.ll.MoveToFront(e)
+
+		return
+	}
+
+	l.items[key] = l.ll.PushFront(key)
+}
+
+// touch marks key as just used. Unlike add it ignores unknown keys, so a hit
+// racing with an eviction cannot bring the key back.
+func (l *lruList) touch(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.items[key]; ok {
+		l.ll.MoveToFront(e)
+	}
+}
+
+func (l *lruList) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.items[key]; ok {
+		l.ll.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *lruList) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ll.Len()
+}
+
+// oldest returns the least recently used key.
+func (l *lruList) oldest() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.ll.Back()
+	if e == nil {
+		return "", false
+	}
+
+	return e.Value.(string), true
+}
@@ -2,15 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,8 +29,10 @@ var TTL time.Duration = 0
 var CleanUpPeriod time.Duration = 0
 
 const (
-	XCacheMiss = "MISS"
-	XCacheHit  = "HIT"
+	XCacheMiss        = "MISS"
+	XCacheHit         = "HIT"
+	XCacheRevalidated = "REVALIDATED"
+	XCacheStale       = "STALE"
 )
 
 const (
@@ -31,23 +44,205 @@ const (
 type cacheData struct {
 	header http.Header
 	body   []byte
-	age    time.Time
+	ttl    time.Duration
+
+	// age is when the entry was stored. It comes straight from time.Now, so
+	// freshness is measured on the monotonic clock and wall-clock steps do
+	// not expire or revive entries. Wall-clock Date and Expires math stays
+	// in freshness.go.
+	age time.Time
+
+	// created is when the response was fetched. Only a sliding TTL moves age
+	// past it; zero means the same as age.
+	created time.Time
+
 	status int
+
+	// forcedStale is set by a soft purge. The entry is revalidated before it
+	// is served again but, not being stale by age, it is kept for
+	// stale-if-error as long as it would have been otherwise.
+	forcedStale bool
+
+	// bodyHash identifies the shared body buffer when bodies are
+	// deduplicated, empty otherwise.
+	bodyHash string
+
+	// fingerprint identifies the request the entry was stored for, zero
+	// unless key collisions are checked.
+	fingerprint uint64
+
+	// hits counts how often the entry was served, shared by the copies of
+	// the entry handed out by the map.
+	hits *atomic.Int64
+
+	// source is the request the entry was fetched for, which the refresher
+	// sends again. It is nil for entries stored otherwise.
+	source *fetchSource
+
+	// gzipBody caches the compressed identity body in identity encoding
+	// mode, or the transcoded Brotli body with BROTLI_TO_GZIP, computed on
+	// the first hit from a gzip capable client.
+	gzipBody []byte
 }
+
+// limits are the settings of a cache a reload may change while it keeps its
+// entries. They are guarded by the mutex of the cache once it serves.
+type limits struct {
+	ttl time.Duration
+
+	// grace keeps stale entries around for this long before cleanup deletes
+	// them.
+	grace time.Duration
+
+	// staleIfError is the age up to which entries stand in for origin errors
+	// and are kept by cleanup, zero disabling it.
+	staleIfError time.Duration
+
+	// With loadStaleThreshold upstream requests in flight, entries expired
+	// at most loadStaleMaxAge ago are served instead of fetched, and
+	// cleanup keeps them that long. Zero disables it.
+	loadStaleThreshold int
+	loadStaleMaxAge    time.Duration
+
+	// minBodySize and maxBodySize bound the size of stored bodies, zero
+	// meaning no bound.
+	minBodySize int64
+	maxBodySize int64
+
+	// maxHeaderBytes bounds the headers stored with an entry, zero meaning
+	// no bound.
+	maxHeaderBytes int
+
+	// statusTTLs replace ttl by status, see defaultTTL.
+	statusTTLs     []statusTTL
+	statusTTLsOnly bool
+
+	// slideFraction of the TTL is added to the age of an entry on each fresh
+	// hit, as long as it lives at most slideMax in total, see slide.
+	slideFraction float64
+	slideMax      time.Duration
+}
+
 type cache struct {
 	mu   sync.RWMutex
 	data map[string]cacheData
-	ttl  time.Duration
+	limits
+
+	// keyPrefix namespaces every key, so bumping it starts from an empty
+	// cache while entries under the old prefix age out.
+	keyPrefix string
+
+	// bytes is the total size of the stored bodies, counting each shared body
+	// once when dedupBodies is enabled.
+	bytes       int64
+	dedupBodies bool
+	bodies      map[string]*sharedBody
+
+	readPool *bodyPool
+
+	// keyHeaders are request headers always part of the key, canonical and
+	// without duplicates.
+	keyHeaders []string
+
+	// keyAccept folds the normalized Accept header into the key.
+	keyAccept bool
+
+	// keyFullURL folds the scheme and host the client used into the key.
+	keyFullURL bool
+
+	// maxKeyBytes bounds the length of keys, those longer being hashed or
+	// not stored depending on longKeys. Zero means no bound.
+	maxKeyBytes int
+	longKeys    string
+
+	// trailingSlash is one of the TrailingSlash modes, applied under
+	// slashPaths, or everywhere when empty.
+	trailingSlash string
+	slashPaths    []string
+
+	// checkCollisions stores request fingerprints with entries, see
+	// requestFingerprint.
+	checkCollisions bool
+
+	// admission, when set, decides which responses are worth storing.
+	admission *admissionFilter
+
+	// pool bounds the entries held in memory outside of the namespaces of
+	// CACHE_QUOTAS, evicting the least recently used to l2 when it is set.
+	pool       *namespace
+	namespaces []*namespace
+	l2         Store
+
+	stats   *cacheStats
+	started time.Time
+
+	// clock stores and ages entries; only tests set another one.
+	clock Clock
+
+	// overrides pin the TTL of individual keys, see ttlOverrideHandler.
+	overrides map[string]ttlOverride
+
+	// backoff holds requests back from the origin after it answered 429.
+	backoff backoff
+
+	// flights coalesces concurrent misses of the same key.
+	flights flightGroup
+
+	// fills caps the concurrent misses fetched from each origin.
+	fills fillLimiter
+
+	// upstreamInFlight counts the requests sent to the origin whose
+	// response hasn't been read to the end yet.
+	upstreamInFlight atomic.Int64
+
+	// maxVariants caps the entries stored for one URL with different key
+	// headers, zero meaning no cap. variants tracks them by URL.
+	maxVariants int
+	variants    map[string]*variantSet
+
+	// warming is the progress of start-up warming.
+	warming warmProgress
+
+	// slow keeps the slowest upstream requests, nil when not tracked.
+	slow *slowLog
+
+	// maintenance serves everything from cache, stale entries included, and
+	// never contacts the origin.
+	maintenance atomic.Bool
+}
+
+// currentLimits returns the limits of c, safe to use while a reload changes
+// them.
+func (c *cache) currentLimits() limits {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.limits
+}
+
+// setLimits replaces the limits of c, entries stored before keeping their TTL.
+func (c *cache) setLimits(l limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limits = l
 }
 
 func newCache(ttl time.Duration) *cache {
 	return &cache{
-		data: make(map[string]cacheData),
-		ttl:  ttl,
+		data:      make(map[string]cacheData),
+		limits:    limits{ttl: ttl},
+		bodies:    make(map[string]*sharedBody),
+		overrides: make(map[string]ttlOverride),
+		readPool:  newBodyPool(defaultMaxPooledBuffer),
+		pool:      newNamespace("", 0, 0),
+		stats:     newCacheStats(),
+		started:   time.Now(),
+		clock:     realClock{},
 	}
 }
 
-func newReverseProxy(urlName string) *httputil.ReverseProxy {
+func newReverseProxy(urlName string, cfg *config) *httputil.ReverseProxy {
 	target, err := url.Parse(urlName)
 
 	if err != nil {
@@ -55,15 +250,76 @@ func newReverseProxy(urlName string) *httputil.ReverseProxy {
 	}
 
 	d := func(req *http.Request) {
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.Host = target.Host
-		req.Header.Del("X-Forwarded-For")
+		t := target
+		if route := upstreamFrom(req.Context()); route != nil {
+			t = route.target
+		}
+
+		req.URL.Scheme = t.Scheme
+		req.URL.Host = t.Host
+		req.Host = t.Host
+
+		if cfg.stripForwardedFor {
+			req.Header.Del("X-Forwarded-For")
+		}
+
+		for _, h := range cfg.stripRequestHeaders {
+			req.Header.Del(h)
+		}
+
+		// Let the transport negotiate gzip with the origin and hand us the
+		// decoded body, which is what gets cached in identity mode.
+		if cfg.encodingMode == EncodingModeIdentity {
+			req.Header.Del("Accept-Encoding")
+		}
+
+		// Whatever the client takes, the origin sends gzip to be cached
+		// compressed and decoded on the way out when needed.
+		if cfg.upstreamCompression {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+
+		// Set after stripping, so clients can neither remove nor forge them.
+		for k, vv := range cfg.upstreamHeaders {
+			req.Header[k] = slices.Clone(vv)
+		}
+
+		addVia(req, cfg.proxyID)
+	}
+
+	var transport http.RoundTripper = newTransport(cfg)
+
+	if len(cfg.failoverOrigins) > 0 {
+		ft := &failoverTransport{
+			next:     transport,
+			origins:  cfg.failoverOrigins,
+			onError:  cfg.failoverOnError,
+			onStatus: make(map[int]bool),
+		}
+
+		for _, status := range cfg.failoverStatuses {
+			ft.onStatus[status] = true
+		}
+
+		transport = ft
 	}
 
 	return &httputil.ReverseProxy{
 		FlushInterval: FlushIntervalAmount * time.Millisecond,
 		Director:      d,
+		Transport:     &tracingTransport{next: transport},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("http: proxy error: %s", err)
+
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				cfg.writeError(w, r, http.StatusRequestEntityTooLarge)
+
+				return
+			}
+
+			cfg.writeError(w, r, http.StatusBadGateway)
+		},
 	}
 }
 
@@ -74,92 +330,810 @@ func main() {
 }
 
 func run() error {
-	rp := newReverseProxy("https://dummyjson.com")
 	ttl := getTTL()
 	c := newCache(ttl)
 
 	cup := getCleanUpPeriod()
 	c.startCleanupWorker(cup)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			c.mu.RLock()
-			d, ok := c.data[r.RequestURI]
-			c.mu.RUnlock()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration %s", err)
+	}
+	c.dedupBodies = cfg.dedupBodies
+	c.checkCollisions = cfg.checkKeyCollisions
+	c.setLimits(cfg.cacheLimits(ttl))
+	c.setKeyHeaders(cfg.keyHeaders)
+	c.keyAccept = cfg.keyAccept
+	c.keyFullURL = cfg.keyFullURL
+	c.maxKeyBytes, c.longKeys = cfg.maxKeyBytes, cfg.longKeys
+	c.trailingSlash, c.slashPaths = cfg.trailingSlash, cfg.slashPaths
+	c.readPool = newBodyPool(cfg.maxPooledBuffer)
+	c.fills.limit = cfg.fillConcurrency
+	c.maxVariants = cfg.maxVariants
 
-			if ok && !isCacheStale(d.age, c.ttl) {
-				writeToResponseCacheHit(w, d)
+	if cfg.slowTop > 0 {
+		c.slow = newSlowLog(cfg.slowTop, cfg.slowWindow)
+		c.slow.start()
+	}
 
-				return
-			}
+	if cfg.admissionPolicy == AdmissionPolicySeenBefore {
+		c.admission = newAdmissionFilter(cfg.admissionWindow, cfg.admissionMaxKeys, c.clock.Now())
+	}
 
-			handleMissedCache(rp, c)
+	c.pool.maxEntries = cfg.memoryMaxEntries
+	c.setQuotas(cfg.quotas)
+
+	if cfg.diskCacheDir != "" {
+		s, err := newDiskStore(cfg.diskCacheDir, cfg.diskCacheMaxBytes)
+		if err != nil {
+			return err
 		}
 
-		rp.ServeHTTP(w, r)
-	})
+		s.precompress = cfg.diskCachePrecompress
+		s.uncompressed = cfg.uncompressedTypes
+		c.l2 = s
+	}
+
+	if cfg.cacheKeyPrefix != "" {
+		c.keyPrefix = cfg.cacheKeyPrefix + ":"
+	}
+
+	shutdownTracing, err := setupTracing(cfg.otlpEndpoint)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Printf("cannot flush traces %s", err)
+		}
+	}()
+
+	const origin = "https://dummyjson.com"
+
+	p := newProxy(origin, c, cfg)
+	reloads := newReloader(origin, p)
+	c.maintenance.Store(cfg.maintenance)
 
+	if cfg.refreshThreshold > 0 {
+		newRefresher(reloads.current, c, cfg).start()
+	}
+
+	if len(cfg.warmPaths) > 0 {
+		c.warming.begin(len(cfg.warmPaths))
+		go warm(p.rp, cfg, cfg.warmPaths, &c.warming)
+	}
+
+	conns := &connCounter{}
 	srv := &http.Server{
 		Addr:         ":8080",
+		Handler:      reloads.Routes(),
 		ReadTimeout:  ReadTimeoutAmount * time.Second,
-		WriteTimeout: WriteTimeoutAmount * time.Second,
+		WriteTimeout: cfg.writeTimeout,
+		ConnState:    conns.track,
 	}
-	defer func(srv *http.Server) {
-		if err := srv.Close(); err != nil {
-			log.Fatal("Cannot close server")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	go func() {
+		for range hup {
+			if _, err := reloads.reload(); err != nil {
+				log.Printf("cannot reload configuration %s", err)
+			}
 		}
-	}(srv)
+	}()
 
-	log.Printf("Reverse-proxy listening on %s", srv.Addr)
+	errc := make(chan error, 2)
 
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	go func() {
+		log.Printf("Reverse-proxy listening on %s", srv.Addr)
+		errc <- srv.Serve(limitListener(ln, cfg))
+	}()
+
+	if cfg.adminAddr != "" {
+		admin := &http.Server{
+			Addr:        cfg.adminAddr,
+			Handler:     reloads.AdminRoutes(),
+			ReadTimeout: ReadTimeoutAmount * time.Second,
+		}
+		defer admin.Close()
+
+		go func() {
+			log.Printf("Admin listening on %s", admin.Addr)
+			errc <- admin.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	return drain(srv, conns, cfg.drainTimeout)
+}
+
+func cacheHandler(rp *httputil.ReverseProxy, c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if resp, ok := cfg.canned[r.URL.Path]; ok {
+			serveCanned(w, r, resp, cfg)
+
+			return
+		}
+
+		r = routeRequest(r, cfg)
+		r = takeDebugTTL(r, cfg)
+
+		// The origin gets the query the key was built from.
+		if strings.Contains(r.URL.RawQuery, "#") {
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = strings.ReplaceAll(r.URL.RawQuery, "#", "%23")
+		}
+
+		if cfg.unmatched == UnmatchedNotFound && upstreamFrom(r.Context()) == nil {
+			cfg.writeError(w, r, http.StatusNotFound)
+
+			return
+		}
+
+		if r.URL.Path == "/" && (cfg.rootMode == RootModeOK || cfg.rootMode == RootModeRedirect) {
+			serveRoot(w, r, cfg)
+
+			return
+		}
+
+		if hasVia(r.Header, cfg.proxyID) {
+			log.Printf("loop detected for %s, Via: %s", r.URL.RequestURI(), strings.Join(r.Header.Values("Via"), ", "))
+			cfg.writeError(w, r, http.StatusLoopDetected)
+
+			return
+		}
+
+		if cfg.rejectLargeBodies && cfg.maxRequestBody > 0 {
+			if r.ContentLength > cfg.maxRequestBody {
+				cfg.writeError(w, r, http.StatusRequestEntityTooLarge)
+
+				return
+			}
+
+			// Bodies of unknown length fail once they cross the limit.
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.maxRequestBody)
+		}
+
+		if r.Method == http.MethodGet {
+			sw := &sizeWriter{ResponseWriter: w}
+			defer func() {
+				if xCacheValue := sw.Header().Get("X-Cache"); xCacheValue != "" {
+					responseSize.WithLabelValues(strings.ToLower(xCacheValue)).Observe(float64(sw.n))
+				}
+			}()
+
+			w = sw
+		}
+
+		if c.maintenance.Load() {
+			serveMaintenance(w, r, c, cfg)
+
+			return
+		}
+
+		if r.Method == http.MethodGet && cfg.isSegmented(r) && serveSegmented(w, r, rp, c, cfg) {
+			return
+		}
+
+		// fill is set for the fetches of GETs that take a fill slot of their
+		// own: revalidations and misses refetched after their flight.
+		fill := false
+
+		// HEAD is answered from the entry of the GET when it is fresh.
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			rcc := cfg.requestCacheControl(r.Header)
+			key := c.key(r)
+			r = r.WithContext(context.WithValue(r.Context(), cacheKeyKey{}, key))
+			r = withFetchSource(r, c.sourceHeaders())
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("cache.key", key))
+
+			// Hits held on disk with a precompressed sibling are served
+			// from the disk as they are.
+			if c.servePrecompressed(w, r, key, rcc, cfg) {
+				return
+			}
+
+			d, ok := c.lookup(key)
+			ok = ok && !cfg.uncacheable(r)
+
+			usable, stale, immutable := false, false, false
+			var ttl time.Duration
+			if ok {
+				ttl = c.ttlFor(key, d)
+				usable, stale = rcc.usable(c.since(d.age), ttl)
+				if d.forcedStale {
+					usable, stale = false, false
+				}
+
+				// Fresh immutable entries are never revalidated, whatever
+				// the client asks for.
+				if immutable = isImmutable(d.header) && !c.isStale(d, ttl); immutable {
+					usable, stale = true, false
+				}
+			}
+
+			// only-if-cached never reaches the origin, whatever else the
+			// client asked for.
+			if rcc.onlyIfCached && !usable {
+				cfg.writeError(w, r, http.StatusGatewayTimeout)
+
+				return
+			}
+
+			if ok {
+				mustRevalidate := !usable || (cfg.honorPragma && !immutable && hasPragmaNoCache(r.Header))
+
+				// While its origin rate limits us, whatever is cached beats
+				// forwarding the request.
+				_, backingOff := c.backoff.remaining(fillOrigin(r), c.clock.Now())
+
+				// So does a recently expired entry while the origin is
+				// busy, unless the client asked for a fresh answer.
+				underLoad := mustRevalidate && !d.forcedStale && !rcc.noCache && c.staleUnderLoad(d, ttl)
+				if underLoad {
+					loadStaleServed.Inc()
+				}
+
+				if !mustRevalidate || backingOff || underLoad {
+					xCacheValue := XCacheHit
+					if stale || mustRevalidate {
+						xCacheValue = XCacheStale
+					}
+
+					traceEvent(r, "cache.hit")
+					c.countRequest(xCacheValue)
+					d.hit()
+
+					if xCacheValue == XCacheHit {
+						c.slide(key, d)
+					}
+
+					if notModified(r, d.header) {
+						c.writeToResponseCacheHit(w, r, notModifiedView(d), cfg, xCacheValue)
+					} else {
+						c.writeToResponseCacheHit(w, r, c.negotiateEncoding(r, d, cfg), cfg, xCacheValue)
+					}
+
+					return
+				}
+
+				if rr, ok := newRevalidationRequest(r, d); ok && r.Method == http.MethodGet {
+					traceEvent(r, "cache.revalidate",
+						attribute.String("cache.etag", d.header.Get("ETag")))
+					r = rr
+				}
+
+				fill = r.Method == http.MethodGet
+			} else {
+				traceEvent(r, "cache.miss")
+
+				if r.Method == http.MethodGet && !cfg.uncacheable(r) && c.keyStorable(key) {
+					f, done, leader := c.flights.join(key)
+					if leader {
+						c.countFlight(FlightRoleLeader)
+						defer done()
+
+						release, ok := c.fills.acquire(r.Context(), fillOrigin(r), cfg.fillQueueTimeout)
+						if !ok {
+							// Its followers would only make the origin
+							// busier still.
+							f.shed.Store(true)
+							cfg.shed(w, r, ShedCauseFillLimit, 0, nil)
+
+							return
+						}
+
+						defer release()
+
+						land := func() {
+							done()
+							release()
+						}
+						r = r.WithContext(context.WithValue(r.Context(), flightKey{}, land))
+					} else {
+						select {
+						case <-f.done:
+						case <-r.Context().Done():
+							return
+						}
+
+						if f.shed.Load() {
+							cfg.shed(w, r, ShedCauseFillLimit, 0, nil)
+
+							return
+						}
+
+						// The leader stored the entry; anything else, such
+						// as an uncacheable response, is fetched again.
+						if d, ok := c.lookup(key); ok && !c.isStale(d, c.ttlFor(key, d)) {
+							c.countFlight(FlightRoleShared)
+							traceEvent(r, "cache.hit")
+							c.countRequest(XCacheHit)
+							d.hit()
+
+							if notModified(r, d.header) {
+								c.writeToResponseCacheHit(w, r, notModifiedView(d), cfg, XCacheHit)
+							} else {
+								c.writeToResponseCacheHit(w, r, c.negotiateEncoding(r, d, cfg), cfg, XCacheHit)
+							}
+
+							return
+						}
+
+						c.countFlight(FlightRoleRefetched)
+						fill = true
+					}
+				}
+			}
+		}
+
+		if wait, ok := c.backoff.remaining(fillOrigin(r), c.clock.Now()); ok {
+			// Requests that would have gone to the origin while it rate
+			// limits us wait for as long as it asked.
+			cfg.shed(w, r, ShedCauseBackoff, wait, nil)
+
+			return
+		}
+
+		if fill {
+			release, ok := c.fills.acquire(r.Context(), fillOrigin(r), cfg.fillQueueTimeout)
+			if !ok {
+				cfg.shed(w, r, ShedCauseFillLimit, 0, nil)
+
+				return
+			}
+
+			defer release()
+		}
+
+		if gzipOK, forced := acceptsGzip(r.Header); cfg.encodingMode == EncodingModeIdentity && gzipOK {
+			gw := &gzipResponseWriter{ResponseWriter: w, forced: forced, uncompressed: cfg.uncompressedTypes}
+			defer func() {
+				if err := gw.Close(); err != nil {
+					log.Printf("can't write to body %s", err)
+				}
+			}()
+
+			w = gw
+		}
+
+		if cfg.serverTiming {
+			r = r.WithContext(context.WithValue(r.Context(), upstreamStartKey{}, time.Now()))
+		}
+
+		if cfg.upstreamCompression {
+			r = r.WithContext(context.WithValue(r.Context(), clientEncodingKey{}, r.Header.Clone()))
+		}
+
+		rp.ServeHTTP(w, r)
+	}
+}
+
+// serveRoot answers the bare "/" route without contacting the origin.
+func serveRoot(w http.ResponseWriter, r *http.Request, cfg *config) {
+	if cfg.rootMode == RootModeRedirect {
+		http.Redirect(w, r, cfg.rootRedirect, http.StatusFound)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if _, err := w.Write([]byte("ok\n")); err != nil {
+		log.Printf("can't write to body %s", err)
+	}
+}
+
+// serveMaintenance answers from cache only, serving stale entries as well,
+// and falls back to the maintenance page for anything not cached.
+func serveMaintenance(w http.ResponseWriter, r *http.Request, c *cache, cfg *config) {
+	if r.Method == http.MethodGet {
+		key := c.key(r)
+
+		if d, ok := c.lookup(key); ok {
+			xCacheValue := XCacheHit
+			if c.isStale(d, c.ttlFor(key, d)) {
+				xCacheValue = XCacheStale
+			}
+
+			c.countRequest(xCacheValue)
+			d.hit()
+
+			c.writeToResponseCacheHit(w, r, c.negotiateEncoding(r, d, cfg), cfg, xCacheValue)
+
+			return
+		}
+	}
+
+	cfg.shed(w, r, ShedCauseMaintenance, 0, cfg.maintenancePage)
 }
 
-func handleMissedCache(rp *httputil.ReverseProxy, c *cache) {
+func handleMissedCache(rp *httputil.ReverseProxy, c *cache, cfg *config) {
+	rp.ErrorHandler = serveStaleOnError(c, cfg, rp.ErrorHandler)
+	preferStale(rp.Transport, c)
+
+	if c.slow != nil {
+		rp.Transport = &timedTransport{next: rp.Transport, slow: c.slow, clock: c.clock}
+	}
+
+	rp.Transport = &inFlightTransport{next: rp.Transport, n: &c.upstreamInFlight}
+
+	rt := rp.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
 	rp.ModifyResponse = func(res *http.Response) error {
-		if res.Request.Method != http.MethodGet {
+		defer landFlight(res.Request)
+
+		if err := followInternalRedirects(res, rt, cfg); err != nil {
+			return err
+		}
+
+		if err := followRedirects(res, rt, cfg); err != nil {
+			return err
+		}
+
+		if cfg.storeDefaultContentType {
+			cfg.applyDefaultContentType(res.Request.URL.Path, res.StatusCode, res.Header)
+		} else {
+			defer func() {
+				cfg.applyDefaultContentType(res.Request.URL.Path, res.StatusCode, res.Header)
+			}()
+		}
+
+		defer transcodeBrotliResponse(res, cfg)
+		defer gunzipResponse(res, cfg)
+		defer cfg.applyClientCacheControl(res.Request.URL.Path, res.Header)
+		defer cfg.applyAddHeaders(res.Header)
+		defer res.Header.Del(ProxyCacheTTLHeader)
+		defer func() {
+			cfg.setServerTiming(res.Header, res.Request, res.Header.Get("X-Cache"))
+		}()
+
+		if res.Request.Method == http.MethodGet {
+			// Revalidations looked up a stale entry, everything else found
+			// nothing.
+			lookup := XCacheMiss
+			if _, ok := res.Request.Context().Value(revalidationKey{}).(cacheData); ok {
+				lookup = XCacheHit
+			}
+
+			defer cfg.setDebugHeaders(res.Header, lookup, 0)
+			defer func() {
+				c.countRequest(res.Header.Get("X-Cache"))
+			}()
+		}
+
+		if cfg.invalidateOnUnsafe && isUnsafeMethod(cfg.effectiveMethod(res.Request)) && res.StatusCode < http.StatusBadRequest {
+			for _, path := range cfg.invalidationPaths(res) {
+				c.invalidate(upstreamPartition(res.Request.Context()) + path)
+			}
+		}
+
+		if handleRateLimited(res, c, cfg) || handleOriginError(res, c) {
 			return nil
 		}
 
-		err := saveCacheData(res, c, XCacheMiss)
+		// A 304 to a client's own conditional request has no body worth
+		// keeping.
+		if res.Request.Method != http.MethodGet || handleNotModified(res, c) ||
+			res.StatusCode == http.StatusNotModified {
+			return nil
+		}
+
+		// Trailers only arrive once the body was read and are not kept with
+		// entries, so such responses stream through uncached. A 206 only
+		// holds part of the resource and must never stand in for all of it.
+		// Cookies set for one client must not be replayed to others, so only
+		// responses whose cookies may all be stripped are stored, and the
+		// same goes for responses to authorized requests.
+		if cfg.uncacheable(res.Request) || len(res.Trailer) > 0 ||
+			res.StatusCode == http.StatusPartialContent || cfg.streams(res) ||
+			!cfg.cookiesCacheable(res.Header) || !cfg.authorizedCacheable(res.Request, res.Header) {
+			res.Header.Add("X-Cache", XCacheMiss)
+
+			return nil
+		}
+
+		err := withoutCookies(res.Header, func() error {
+			return saveCacheData(res, c, XCacheMiss)
+		})
 
+		// The body is partly consumed by now, so rather than a truncated
+		// response the client gets a clean 502 from the error handler.
 		if nil != err {
 			log.Printf("error while saving stale cache %s", err)
+
+			return err
 		}
 
 		return nil
 	}
 }
 
-func writeToResponseCacheHit(w http.ResponseWriter, d cacheData) {
+func (c *cache) writeToResponseCacheHit(w http.ResponseWriter, r *http.Request, d cacheData, cfg *config, xCacheValue string) {
+	br, ranged := hitRange(r, d)
+	start, end, satisfiable := br.bounds(int64(len(d.body)))
+
+	if ranged && !satisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(d.body)))
+		w.Header().Set("X-Cache", xCacheValue)
+		cfg.writeError(w, r, http.StatusRequestedRangeNotSatisfiable)
+
+		return
+	}
+
+	c.writeHitHeaders(w, r, d, cfg, xCacheValue)
+
+	// The complete body of a 200 is held, so any range of it can be served.
+	if d.status == http.StatusOK {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	// A HEAD gets the headers of the GET, including the length of the body
+	// it does not get.
+	if r.Method == http.MethodHead {
+		if bodyAllowed(d.status) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(d.body)))
+		}
+
+		w.WriteHeader(d.status)
+
+		return
+	}
+
+	status, body := d.status, d.body
+	if ranged {
+		status, body = http.StatusPartialContent, d.body[start:end+1]
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(d.body)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	w.WriteHeader(status)
+
+	_, err := w.Write(body)
+
+	if err != nil {
+		log.Printf("can't write to body %s", err)
+	}
+}
+
+// writeHitHeaders sets the headers of the cached entry d on w, along with
+// those the proxy adds to every hit.
+func (c *cache) writeHitHeaders(w http.ResponseWriter, r *http.Request, d cacheData, cfg *config, xCacheValue string) {
 	for k, vv := range d.header {
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
 	}
 
-	w.Header().Set("X-Cache", XCacheHit)
-	w.WriteHeader(d.status)
+	cfg.applyAddHeaders(w.Header())
+	cfg.applyClientCacheControl(r.URL.Path, w.Header())
+	cfg.applyDefaultContentType(r.URL.Path, d.status, w.Header())
+	cfg.setDebugHeaders(w.Header(), XCacheHit, c.since(d.age))
 
-	_, err := w.Write(d.body)
+	w.Header().Set("X-Cache", xCacheValue)
+	cfg.setServerTiming(w.Header(), r, xCacheValue)
+}
 
-	if err != nil {
-		log.Printf("can't write to body %s", err)
+// key identifies the cached entry for r, within the configured key
+// namespace. It is derived from the parsed URL rather than RequestURI, which
+// is only set on requests received by the server, so requests the proxy makes
+// itself (warming, revalidation) map to the same key a client request would.
+func (c *cache) key(r *http.Request) string {
+	// The director may strip key headers from the outgoing request, whose
+	// response must still land under the key the lookup used.
+	if key, ok := r.Context().Value(cacheKeyKey{}).(string); ok {
+		return key
+	}
+
+	partition := upstreamPartition(r.Context())
+	key := c.keyPrefix + partition + c.slashed(keyURI(r.URL)) + c.headerComponent(r)
+
+	return c.boundKey(key, len(c.keyPrefix)+len(partition))
+}
+
+// keyURI is the request URI as it appears in keys. A raw request line can
+// leave a '#' in the query, which is escaped like RequestURI does in the path
+// so it never poses as the header component.
+func keyURI(u *url.URL) string {
+	return strings.ReplaceAll(u.RequestURI(), "#", "%23")
+}
+
+// requestScheme is the scheme the client used, as told by X-Forwarded-Proto
+// behind a TLS terminating load balancer.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "https" || proto == "http" {
+		return proto
+	}
+
+	return "http"
+}
+
+// normalizeHost lower-cases host and drops a trailing dot and the default
+// port of scheme, so equivalent spellings share their entries.
+func normalizeHost(host, scheme string) string {
+	host = strings.ToLower(host)
+
+	if h, port, err := net.SplitHostPort(host); err == nil &&
+		((scheme == "http" && port == "80") || (scheme == "https" && port == "443")) {
+		host = h
+		if strings.Contains(h, ":") {
+			host = "[" + h + "]"
+		}
+	}
+
+	return strings.TrimSuffix(host, ".")
+}
+
+type cacheKeyKey struct{}
+
+func (c *cache) setKeyHeaders(names []string) {
+	c.keyHeaders = nil
+
+	for _, name := range names {
+		if name = http.CanonicalHeaderKey(name); !slices.Contains(c.keyHeaders, name) {
+			c.keyHeaders = append(c.keyHeaders, name)
+		}
+	}
+}
+
+// headerComponent folds the CACHE_KEY_HEADERS a request carries into its key,
+// along with its normalized Accept with CACHE_KEY_ACCEPT, as a "#" suffix so
+// the key still starts with the request URI.
+func (c *cache) headerComponent(r *http.Request) string {
+	h := r.Header
+
+	var v url.Values
+
+	if c.keyFullURL {
+		scheme := requestScheme(r)
+		v = url.Values{"Scheme": {scheme}, "Host": {normalizeHost(r.Host, scheme)}}
+	}
+
+	for _, name := range c.keyHeaders {
+		if values := h.Values(name); len(values) > 0 {
+			if v == nil {
+				v = make(url.Values)
+			}
+
+			v.Set(name, strings.Join(values, ","))
+		}
+	}
+
+	if c.keyAccept {
+		if accept := normalizeAccept(h.Values("Accept")); accept != "" {
+			if v == nil {
+				v = make(url.Values)
+			}
+
+			v.Set("Accept", accept)
+		}
+	}
+
+	if v == nil {
+		return ""
+	}
+
+	return "#" + v.Encode()
+}
+
+// defaultTTL is the TTL of entries for r answered with status lacking
+// freshness information: that of STATUS_TTLS, of its UPSTREAMS route, or of
+// the cache. It reports false for statuses not to store.
+func (c *cache) defaultTTL(r *http.Request, status int) (time.Duration, bool) {
+	lim := c.currentLimits()
+
+	if ttl, ok := lim.ttlForStatus(status); ok {
+		return ttl, ttl > 0
+	}
+
+	if lim.statusTTLsOnly {
+		return 0, false
+	}
+
+	if route := upstreamFrom(r.Context()); route != nil && route.ttl > 0 {
+		return route.ttl, true
+	}
+
+	return lim.ttl, true
+}
+
+// ttlForStatus finds the STATUS_TTLS rule of status, the exact code first.
+func (l limits) ttlForStatus(status int) (time.Duration, bool) {
+	class := -1
+
+	for i, rule := range l.statusTTLs {
+		switch {
+		case !rule.class && rule.status == status:
+			return rule.ttl, true
+		case rule.class && rule.status == status/100 && class < 0:
+			class = i
+		}
+	}
+
+	if class < 0 {
+		return 0, false
 	}
+
+	return l.statusTTLs[class].ttl, true
 }
 
 func saveCacheData(res *http.Response, c *cache, xCacheValue string) error {
-	key := res.Request.RequestURI
+	key := c.key(res.Request)
+	lim := c.currentLimits()
+
+	if !c.keyStorable(key) || !c.admits(res.Request, key) {
+		res.Header.Add("X-Cache", xCacheValue)
 
-	b, err := io.ReadAll(res.Body)
+		return nil
+	}
+
+	if n := headerSize(res.Header); lim.maxHeaderBytes > 0 && n > lim.maxHeaderBytes {
+		log.Printf("headers of %s%s are %d bytes, over the %d bytes cap, not caching",
+			res.Request.URL.Host, res.Request.URL.Path, n, lim.maxHeaderBytes)
+		res.Header.Add("X-Cache", xCacheValue)
+
+		return nil
+	}
+
+	def, ok := c.defaultTTL(res.Request, res.StatusCode)
+	if !ok {
+		res.Header.Add("X-Cache", xCacheValue)
+
+		return nil
+	}
+
+	if lim.maxBodySize > 0 && res.ContentLength > lim.maxBodySize {
+		res.Header.Add("X-Cache", xCacheValue)
+
+		return nil
+	}
+
+	body := io.Reader(res.Body)
+	if lim.maxBodySize > 0 {
+		// One byte past the limit tells a body of unknown length is too
+		// large without buffering all of it.
+		body = io.LimitReader(res.Body, lim.maxBodySize+1)
+	}
+
+	b, err := c.readPool.read(body, res.ContentLength)
 	if err != nil {
 		return err
 	}
 
+	if lim.maxBodySize > 0 && int64(len(b)) > lim.maxBodySize {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), res.Body), res.Body}
+		res.Header.Add("X-Cache", xCacheValue)
+
+		return nil
+	}
+
 	err = res.Body.Close()
 	if err != nil {
 		return err
@@ -167,14 +1141,34 @@ func saveCacheData(res *http.Response, c *cache, xCacheValue string) error {
 
 	res.Body = io.NopCloser(bytes.NewReader(b))
 
-	c.mu.Lock()
-	c.data[key] = cacheData{
+	if int64(len(b)) < lim.minBodySize {
+		res.Header.Add("X-Cache", xCacheValue)
+
+		return nil
+	}
+
+	entrySize.Observe(float64(len(b)))
+
+	ttl := debugTTL(res.Request, entryTTL(res.Header, def, c.clock.Now()))
+	res.Header.Del(ProxyCacheTTLHeader)
+	entryLifetime.Observe(ttl.Seconds())
+
+	d := cacheData{
 		header: res.Header.Clone(),
 		body:   b,
-		age:    time.Now(),
+		ttl:    ttl,
 		status: res.StatusCode,
 	}
-	c.mu.Unlock()
+	d.age = c.clock.Now()
+	d.created = d.age
+
+	if c.checkCollisions {
+		d.fingerprint = requestFingerprint(res.Request, res.Header)
+	}
+
+	d.source, _ = res.Request.Context().Value(fetchSourceKey{}).(*fetchSource)
+
+	c.store(key, d)
 
 	res.Header.Add("X-Cache", xCacheValue)
 
@@ -221,35 +1215,200 @@ func getCleanUpPeriod() time.Duration {
 	return CleanUpPeriod
 }
 
-func isCacheStale(a time.Time, ttl time.Duration) bool {
-	return time.Now().After(a.Add(ttl))
+// headerSize is the size of h on the wire, which is roughly what it takes
+// in memory.
+func headerSize(h http.Header) int {
+	n := 0
+	for k, vv := range h {
+		for _, v := range vv {
+			n += len(k) + len(v) + len(": \r\n")
+		}
+	}
+
+	return n
+}
+
+// isCacheStale reports whether an entry stored at a outlived its ttl on the
+// clock of the cache. The elapsed time uses the monotonic reading of a, which
+// Time.Sub prefers.
+func (c *cache) isCacheStale(a time.Time, ttl time.Duration) bool {
+	return c.since(a) > ttl
+}
+
+// isStale reports whether d needs revalidation after ttl, whether it aged
+// out or was soft purged.
+func (c *cache) isStale(d cacheData, ttl time.Duration) bool {
+	return d.forcedStale || c.isCacheStale(d.age, ttl)
+}
+
+// isCacheDeletable reports whether an entry is stale for longer than the
+// grace period, during which it is kept around for revalidation and stale
+// serving.
+func (c *cache) isCacheDeletable(a time.Time, ttl, grace time.Duration) bool {
+	return c.isCacheStale(a, ttl+grace)
 }
 
 func (c *cache) startCleanupWorker(i time.Duration) {
 	go func() {
 		ticker := time.NewTicker(i)
-		ttl := getTTL()
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ticker.C:
-				c.cleanup(ttl)
+				c.cleanup()
 			}
 		}
 	}()
 }
 
-func (c *cache) cleanup(ttl time.Duration) {
+// store saves d under key, replacing any previous entry.
+func (c *cache) store(key string, d cacheData) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 
-	for key, d := range c.data {
-		if isCacheStale(d.age, ttl) {
-			delete(c.data, key)
+	ns := c.namespaceFor(key)
+
+	old, ok := c.data[key]
+	if ok {
+		c.release(old)
+		ns.entries--
+		ns.bytes -= int64(len(old.body))
+
+		if d.fingerprint != 0 && old.fingerprint != 0 && d.fingerprint != old.fingerprint {
+			log.Printf("WARNING: possible cache key collision on %s, stored for different requests", key)
+		}
+	}
+
+	c.bytes += int64(len(d.gzipBody))
+
+	// A refetched entry keeps counting the hits of the one it replaces.
+	if d.hits == nil {
+		d.hits = old.hits
+	}
+
+	if d.hits == nil {
+		d.hits = new(atomic.Int64)
+	}
+
+	if c.dedupBodies {
+		d = c.intern(d)
+	} else {
+		c.bytes += int64(len(d.body))
+	}
+
+	c.data[key] = d
+	ns.entries++
+	ns.bytes += int64(len(d.body))
+
+	if ns.bounded() {
+		ns.lru.add(key)
+	}
+
+	c.trackVariant(key)
+
+	demoted := c.shrink(ns)
+	c.mu.Unlock()
+
+	c.demote(demoted)
+}
+
+// evict removes key from the cache and records why it left. Callers must hold
+// c.mu for writing.
+func (c *cache) evict(key, reason string) {
+	ns := c.namespaceFor(key)
+
+	if d, ok := c.data[key]; ok {
+		c.release(d)
+		ns.entries--
+		ns.bytes -= int64(len(d.body))
+	}
+
+	delete(c.data, key)
+	ns.lru.remove(key)
+	c.forgetVariant(key)
+	cacheEvictions.WithLabelValues(reason).Inc()
+
+	// Only entries evicted for room live on in the second tier.
+	if reason != EvictionReasonLRU && reason != EvictionReasonBytes && c.l2 != nil {
+		c.l2.Delete(key)
+	}
+
+	if n, ok := c.stats.evictions[reason]; ok {
+		n.Add(1)
+	}
+}
+
+// release gives up the body of an entry leaving the cache. Callers must hold
+// c.mu for writing.
+func (c *cache) release(d cacheData) {
+	c.bytes -= int64(len(d.gzipBody))
+
+	if d.bodyHash == "" {
+		c.bytes -= int64(len(d.body))
+
+		return
+	}
+
+	sb, ok := c.bodies[d.bodyHash]
+	if !ok {
+		return
+	}
+
+	if sb.refs--; sb.refs == 0 {
+		delete(c.bodies, d.bodyHash)
+		c.bytes -= int64(len(sb.body))
+	}
+}
+
+// cleanupBatchSize is how many entries cleanup checks per write lock, so
+// requests get the lock in between on large caches.
+const cleanupBatchSize = 1000
+
+func (c *cache) cleanup() {
+	start := time.Now()
+	defer func() {
+		cleanupDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	c.mu.Lock()
+	for key, o := range c.overrides {
+		if o.expired(c.clock.Now()) {
+			delete(c.overrides, key)
+		}
+	}
+	c.mu.Unlock()
+
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.data))
+	for key := range c.data {
+		keys = append(keys, key)
+	}
+	c.mu.RUnlock()
+
+	for batch := range slices.Chunk(keys, cleanupBatchSize) {
+		var deleted []string
+
+		c.mu.Lock()
+		for _, key := range batch {
+			// The entry may have been replaced or removed since.
+			d, ok := c.data[key]
+			if !ok {
+				continue
+			}
+
+			if ttl := c.ttlForLocked(key, d); c.isCacheDeletable(d.age, ttl, c.keepFor(ttl)) {
+				c.evict(key, EvictionReasonTTL)
+				deleted = append(deleted, key)
+			}
+		}
+		c.mu.Unlock()
+
+		for _, key := range deleted {
 			log.Printf("deleted cache with key: %s", key)
 		}
 	}
 
+	c.cleanupDisk()
+
 	log.Println("cache cleanup completed")
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+)
+
+// Reasons an entry can leave the cache, used as the eviction counter label.
+const (
+	EvictionReasonTTL      = "ttl"
+	EvictionReasonLRU      = "lru"
+	EvictionReasonBytes    = "bytes"
+	EvictionReasonPurge    = "purge"
+	EvictionReasonFlush    = "flush"
+	EvictionReasonVariants = "variants"
+)
+
+var evictionReasons = []string{
+	EvictionReasonTTL,
+	EvictionReasonLRU,
+	EvictionReasonBytes,
+	EvictionReasonPurge,
+	EvictionReasonFlush,
+	EvictionReasonVariants,
+}
+
+var cacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_evictions_total",
+	Help: "Number of entries removed from the cache, by reason.",
+}, []string{"reason"})
+
+var loadStaleServed = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "cache_load_stale_served_total",
+	Help: "Number of expired entries served stale because the origin was busy.",
+})
+
+var softPurges = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "cache_soft_purges_total",
+	Help: "Number of entries marked stale by a soft purge, which are kept for revalidation.",
+})
+
+// Parts a cacheable miss takes in coalescing, used as the coalescing counter
+// label: the leader fetches from the origin, the others either share its
+// entry or, when it wasn't stored, fetch again on their own.
+const (
+	FlightRoleLeader    = "leader"
+	FlightRoleShared    = "shared"
+	FlightRoleRefetched = "refetched"
+)
+
+var flightRoles = []string{FlightRoleLeader, FlightRoleShared, FlightRoleRefetched}
+
+var coalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_coalesced_requests_total",
+	Help: "Number of cacheable misses, by the part they took in coalescing.",
+}, []string{"role"})
+
+// Reasons a request is shed with a 503, used as the shed requests counter
+// label: the fill concurrency limit, the backoff of a rate limiting origin and
+// maintenance mode.
+const (
+	ShedCauseFillLimit   = "fill_limit"
+	ShedCauseBackoff     = "backoff"
+	ShedCauseMaintenance = "maintenance"
+)
+
+var shedCauses = []string{ShedCauseFillLimit, ShedCauseBackoff, ShedCauseMaintenance}
+
+var shedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_shed_requests_total",
+	Help: "Number of requests answered 503 with a Retry-After to shed load, by cause.",
+}, []string{"cause"})
+
+var cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_requests_total",
+	Help: "Number of GET requests, by how the cache answered them.",
+}, []string{"result"})
+
+// sizeBuckets span web payloads from 256 bytes to 64 MiB.
+var sizeBuckets = prometheus.ExponentialBuckets(256, 4, 10)
+
+var responseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "cache_response_size_bytes",
+	Help:    "Body bytes sent to clients for GET requests, by how the cache answered them.",
+	Buckets: sizeBuckets,
+}, []string{"result"})
+
+var entrySize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "cache_entry_size_bytes",
+	Help:    "Body size of the entries stored in the cache.",
+	Buckets: sizeBuckets,
+})
+
+// ttlBuckets span entry lifetimes from a second to a week.
+var ttlBuckets = []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 7 * 24 * 3600}
+
+var entryLifetime = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "cache_entry_ttl_seconds",
+	Help:    "Freshness lifetime of the entries stored, once response headers, routes and status rules were applied.",
+	Buckets: ttlBuckets,
+})
+
+var cleanupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "cache_cleanup_duration_seconds",
+	Help:    "Time taken by the periodic clean-up of expired entries.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+})
+
+// sizeWriter counts the body bytes written through it.
+type sizeWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *sizeWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+
+	return n, err
+}
+
+func (w *sizeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func init() {
+	for _, reason := range evictionReasons {
+		cacheEvictions.WithLabelValues(reason)
+	}
+
+	for _, role := range flightRoles {
+		coalescedRequests.WithLabelValues(role)
+	}
+
+	for _, cause := range shedCauses {
+		shedRequests.WithLabelValues(cause)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ttlOverride pins the freshness lifetime of one key, set at runtime through
+// the admin API. A zero until never expires.
+type ttlOverride struct {
+	TTL   time.Duration `json:"ttl"`
+	Until time.Time     `json:"until,omitzero"`
+}
+
+// expired reports whether the override ran out by now.
+func (o ttlOverride) expired(now time.Time) bool {
+	return !o.Until.IsZero() && now.After(o.Until)
+}
+
+// ttlFor returns the freshness lifetime of the entry d stored under key,
+// taking an active override into account.
+func (c *cache) ttlFor(key string, d cacheData) time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.ttlForLocked(key, d)
+}
+
+// ttlForLocked is ttlFor for callers already holding c.mu.
+func (c *cache) ttlForLocked(key string, d cacheData) time.Duration {
+	if o, ok := c.overrides[key]; ok && !o.expired(c.clock.Now()) {
+		return o.TTL
+	}
+
+	return d.ttl
+}
+
+// ttlOverrideHandler lists overrides on GET, sets the override for ?key= to
+// ?ttl= on POST/PUT, optionally expiring after ?expires=, and clears it on
+// DELETE. Durations use Go syntax, e.g. 30m.
+func ttlOverrideHandler(c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key != "" {
+			key = c.keyPrefix + key
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			c.mu.RLock()
+			overrides := make(map[string]ttlOverride, len(c.overrides))
+			now := c.clock.Now()
+			for k, o := range c.overrides {
+				if !o.expired(now) {
+					overrides[k] = o
+				}
+			}
+			c.mu.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+
+			if err := json.NewEncoder(w).Encode(overrides); err != nil {
+				log.Printf("can't write to body %s", err)
+			}
+
+			return
+		case http.MethodPost, http.MethodPut:
+			ttl, err := time.ParseDuration(r.URL.Query().Get("ttl"))
+			if key == "" || err != nil || ttl < 0 {
+				cfg.writeError(w, r, http.StatusBadRequest)
+
+				return
+			}
+
+			o := ttlOverride{TTL: ttl}
+
+			if v := r.URL.Query().Get("expires"); v != "" {
+				expires, err := time.ParseDuration(v)
+				if err != nil || expires <= 0 {
+					cfg.writeError(w, r, http.StatusBadRequest)
+
+					return
+				}
+
+				o.Until = c.clock.Now().Add(expires)
+			}
+
+			c.mu.Lock()
+			c.overrides[key] = o
+			c.mu.Unlock()
+
+			log.Printf("ttl override for %s set to %s", key, ttl)
+		case http.MethodDelete:
+			if key == "" {
+				cfg.writeError(w, r, http.StatusBadRequest)
+
+				return
+			}
+
+			c.mu.Lock()
+			delete(c.overrides, key)
+			c.mu.Unlock()
+
+			log.Printf("ttl override for %s cleared", key)
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			cfg.writeError(w, r, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
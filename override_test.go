@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTTLOverride(t *testing.T) {
+	c := newCache(time.Hour)
+	cfg := &config{adminSecret: "secret"}
+	h := adminOnly(cfg, ttlOverrideHandler(c, cfg))
+	d := cacheData{ttl: time.Minute}
+
+	do := func(method, query string) int {
+		req := httptest.NewRequest(method, "/_cache/ttl?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rec := httptest.NewRecorder()
+		h(rec, req)
+
+		return rec.Code
+	}
+
+	if code := do(http.MethodPut, "key=/hot&ttl=6h"); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+
+	if got := c.ttlFor("/hot", d); got != 6*time.Hour {
+		t.Errorf("expected override of 6h, got %s", got)
+	}
+
+	if got := c.ttlFor("/other", d); got != time.Minute {
+		t.Errorf("expected other keys to keep their ttl, got %s", got)
+	}
+
+	if code := do(http.MethodDelete, "key=/hot"); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+
+	if got := c.ttlFor("/hot", d); got != time.Minute {
+		t.Errorf("expected cleared override, got %s", got)
+	}
+
+	if code := do(http.MethodPut, "key=/hot&ttl=bogus"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid ttl, got %d", code)
+	}
+
+	c.overrides["/hot"] = ttlOverride{TTL: 6 * time.Hour, Until: time.Now().Add(-time.Second)}
+
+	if got := c.ttlFor("/hot", d); got != time.Minute {
+		t.Errorf("expected expired override to be ignored, got %s", got)
+	}
+}
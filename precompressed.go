@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// siblingExtensions are the file extensions of the precompressed siblings of
+// a disk entry, by coding.
+var siblingExtensions = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// precompressedStore is a Store holding precompressed copies of entries,
+// which are served straight from it.
+type precompressedStore interface {
+	// Precompressed returns the entry of key, without its body, and the
+	// coding of its sibling ae prefers, if it has one.
+	Precompressed(key string, ae acceptEncoding) (cacheData, string, bool)
+
+	// ReadPrecompressed returns the sibling of key in coding once it passed
+	// its checksum, counting it as a use of the entry. A sibling that fails
+	// it is removed.
+	ReadPrecompressed(key, coding string) ([]byte, bool)
+}
+
+func isSiblingFile(name string) bool {
+	ext := filepath.Ext(name)
+
+	return ext == siblingExtensions["br"] || ext == siblingExtensions["gzip"]
+}
+
+func (s *diskStore) siblingPath(key, coding string) string {
+	return s.path(key) + siblingExtensions[coding]
+}
+
+// compressSiblings compresses the body of d in every coding the store keeps
+// siblings in, when precompression is on and the body is worth it. Only
+// complete identity bodies are, of the types left to compression.
+func (s *diskStore) compressSiblings(key string, d cacheData) map[string][]byte {
+	if !s.precompress || d.status != http.StatusOK || d.header.Get("Content-Encoding") != "" || isSegmentKey(key) {
+		return nil
+	}
+
+	if len(d.body) < gzipMinSize || !worthCompressing(d.header.Get("Content-Type"), s.uncompressed) {
+		return nil
+	}
+
+	// Identity mode may have compressed the body already for a hit.
+	gz := d.gzipBody
+	if gz == nil {
+		gz = gzipBytes(d.body)
+	}
+
+	br, err := brotliBytes(d.body)
+	if err != nil {
+		log.Printf("cannot compress %s with brotli %s", key, err)
+
+		return map[string][]byte{"gzip": gz}
+	}
+
+	return map[string][]byte{"br": br, "gzip": gz}
+}
+
+// scanSiblings checks the siblings the entry e of the file name lists
+// against their checksums, adding those that pass to m and removing the
+// others. It returns the file names of the siblings kept.
+func (s *diskStore) scanSiblings(name string, e diskEntry, m *diskMeta) []string {
+	var kept []string
+
+	for coding, sum := range e.Encodings {
+		sibling := name + siblingExtensions[coding]
+
+		b, err := os.ReadFile(sibling)
+		if err != nil || crc32.Checksum(b, castagnoli) != sum {
+			log.Printf("disk cache file %s is unreadable, discarding", sibling)
+			_ = os.Remove(sibling)
+
+			continue
+		}
+
+		m.size += int64(len(b))
+		m.encodings = append(m.encodings, coding)
+		m.sums[coding] = sum
+		kept = append(kept, sibling)
+	}
+
+	if len(m.encodings) > 0 {
+		sort.Strings(m.encodings)
+		m.header, m.status, m.forcedStale = e.Header, e.Status, e.ForcedStale
+	}
+
+	return kept
+}
+
+// removeOrphanSiblings removes the sibling files among files that no entry
+// kept by scan claims.
+func (s *diskStore) removeOrphanSiblings(files []fs.DirEntry, claimed map[string]bool) {
+	for _, f := range files {
+		name := filepath.Join(s.dir, f.Name())
+
+		if !f.IsDir() && isSiblingFile(name) && !claimed[name] {
+			_ = os.Remove(name)
+		}
+	}
+}
+
+// removeSiblingsLocked removes the siblings of key in encodings. Callers
+// must hold s.mu.
+func (s *diskStore) removeSiblingsLocked(key string, encodings []string) {
+	for _, coding := range encodings {
+		if err := os.Remove(s.siblingPath(key, coding)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("cannot delete disk cache entry %s %s", key, err)
+		}
+	}
+}
+
+func (s *diskStore) Precompressed(key string, ae acceptEncoding) (cacheData, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.index[key]
+	if !ok {
+		return cacheData{}, "", false
+	}
+
+	// Brotli, listed first, wins ties.
+	coding, best := "", 0.0
+	for _, offer := range m.encodings {
+		if q := ae.quality(offer); q > best && ae.preferredEncoding(offer) == offer {
+			coding, best = offer, q
+		}
+	}
+
+	if coding == "" {
+		return cacheData{}, "", false
+	}
+
+	d := cacheData{header: m.header, age: m.age, ttl: m.ttl, status: m.status, forcedStale: m.forcedStale, hits: m.hits}
+
+	return d, coding, true
+}
+
+func (s *diskStore) ReadPrecompressed(key, coding string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Read under the lock, so a concurrent Save or Delete can't swap the
+	// file between the index lookup and the read.
+	sum, ok := s.index[key].sums[coding]
+	if !ok {
+		return nil, false
+	}
+
+	b, err := os.ReadFile(s.siblingPath(key, coding))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("cannot read disk cache entry %s %s", key, err)
+	}
+
+	if err != nil || crc32.Checksum(b, castagnoli) != sum {
+		log.Printf("disk cache entry %s failed its %s checksum, discarding", key, coding)
+		s.dropSiblingLocked(key, coding)
+
+		return nil, false
+	}
+
+	s.order.touch(key)
+
+	return b, true
+}
+
+// dropSiblingLocked removes the sibling of key in coding, leaving the entry
+// itself to be served in identity. Callers must hold s.mu.
+func (s *diskStore) dropSiblingLocked(key, coding string) {
+	m := s.index[key]
+
+	var size int64
+	if info, err := os.Stat(s.siblingPath(key, coding)); err == nil {
+		size = info.Size()
+	}
+
+	s.removeSiblingsLocked(key, []string{coding})
+
+	encodings := make([]string, 0, len(m.encodings))
+	for _, c := range m.encodings {
+		if c != coding {
+			encodings = append(encodings, c)
+		}
+	}
+
+	sums := make(map[string]uint32, len(m.sums))
+	for c, sum := range m.sums {
+		if c != coding {
+			sums[c] = sum
+		}
+	}
+
+	m.encodings, m.sums = encodings, sums
+	m.size -= size
+	s.bytes -= size
+	s.index[key] = m
+}
+
+// servePrecompressed answers a fresh hit held on disk with its sibling in
+// the coding the client prefers, read from the file without moving the
+// entry back to memory or compressing it again. It reports whether it
+// answered; entries in memory, conditional and range requests, clients
+// taking no coding of a sibling and siblings failing their checksum are left
+// to the usual lookup, which serves the identity body.
+func (c *cache) servePrecompressed(w http.ResponseWriter, r *http.Request, key string, rcc requestCacheControl, cfg *config) bool {
+	ps, ok := c.l2.(precompressedStore)
+	if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Range") != "" || cfg.uncacheable(r) {
+		return false
+	}
+
+	if cfg.honorPragma && hasPragmaNoCache(r.Header) {
+		return false
+	}
+
+	c.mu.RLock()
+	_, inMemory := c.data[key]
+	c.mu.RUnlock()
+
+	if inMemory {
+		return false
+	}
+
+	d, coding, ok := ps.Precompressed(key, parseAcceptEncoding(r.Header))
+	if !ok {
+		return false
+	}
+
+	usable, stale := rcc.usable(c.since(d.age), c.ttlFor(key, d))
+	if !usable || stale || d.forcedStale || notModified(r, d.header) {
+		return false
+	}
+
+	body, ok := ps.ReadPrecompressed(key, coding)
+	if !ok {
+		return false
+	}
+
+	v := d
+	v.header = d.header.Clone()
+	v.header.Set("Content-Encoding", coding)
+	v.header.Set("Content-Length", strconv.Itoa(len(body)))
+	varyOnEncoding(v.header)
+
+	traceEvent(r, "cache.hit")
+	c.countRequest(XCacheHit)
+	d.hit()
+	c.writeHitHeaders(w, r, v, cfg, XCacheHit)
+	w.WriteHeader(v.status)
+
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	if _, err := w.Write(body); err != nil {
+		log.Printf("can't write to body %s", err)
+	}
+
+	return true
+}
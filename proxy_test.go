@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	dto "github.com/prometheus/client_model/go"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestXForwardedForIsRemoved(t *testing.T) {
@@ -20,7 +30,7 @@ func TestXForwardedForIsRemoved(t *testing.T) {
 
 	defer backend.Close()
 
-	proxy := newReverseProxy(backend.URL)
+	proxy := newReverseProxy(backend.URL, &config{stripForwardedFor: true})
 	proxyServer := httptest.NewServer(proxy)
 
 	defer proxyServer.Close()
@@ -57,3 +67,1283 @@ func TestXForwardedForIsRemoved(t *testing.T) {
 		t.Errorf("expected X-Forwarded-For to be removed, but got: %q, expected %q", got, host)
 	}
 }
+
+func TestAddHeadersAreNotCached(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "origin")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	c := newCache(time.Hour)
+	cfg := &config{
+		addHeaders:     http.Header{"X-Served-By": {"proxy-01"}},
+		addHeadersMode: AddHeadersModeSet,
+	}
+	proxy := newReverseProxy(backend.URL, cfg)
+	handleMissedCache(proxy, c, cfg)
+
+	proxyServer := httptest.NewServer(proxy)
+
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if got := resp.Header.Get("X-Served-By"); got != "proxy-01" {
+		t.Errorf("expected injected X-Served-By, got %q", got)
+	}
+
+	c.mu.RLock()
+	d, ok := c.data["/test"]
+	c.mu.RUnlock()
+
+	if !ok {
+		t.Fatal("expected response to be cached")
+	}
+
+	if got := d.header.Get("X-Served-By"); got != "origin" {
+		t.Errorf("expected cached header from origin, got %q", got)
+	}
+}
+
+func TestStripRequestHeaders(t *testing.T) {
+	var receivedHeaders http.Header
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header.Clone()
+	}))
+
+	defer backend.Close()
+
+	proxy := newReverseProxy(backend.URL, &config{stripRequestHeaders: []string{"X-Internal-Token"}})
+	proxyServer := httptest.NewServer(proxy)
+
+	defer proxyServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("X-Internal-Token", "secret")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if got := receivedHeaders.Get("X-Internal-Token"); got != "" {
+		t.Errorf("expected X-Internal-Token to be stripped, got %q", got)
+	}
+
+	if got := receivedHeaders.Get("X-Forwarded-For"); !strings.HasPrefix(got, "1.2.3.4") {
+		t.Errorf("expected client X-Forwarded-For to be kept, got %q", got)
+	}
+}
+
+// newTestProxy serves the full caching handler in front of backendURL.
+func newTestProxy(t *testing.T, backendURL string, cfg *config) (*httptest.Server, *cache) {
+	t.Helper()
+
+	c := newCache(time.Hour)
+
+	srv := httptest.NewServer(newProxy(backendURL, c, cfg).Handler())
+	t.Cleanup(srv.Close)
+
+	return srv, c
+}
+
+func TestProxyCacheTTLHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set(ProxyCacheTTLHeader, "300")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(proxyServer.URL + "/test")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if got := resp.Header.Get(ProxyCacheTTLHeader); got != "" {
+			t.Errorf("expected %s to be stripped, got %q", ProxyCacheTTLHeader, got)
+		}
+	}
+
+	c.mu.RLock()
+	d := c.data["/test"]
+	c.mu.RUnlock()
+
+	if d.ttl != 5*time.Minute {
+		t.Errorf("expected ttl of 5m, got %s", d.ttl)
+	}
+}
+
+func TestMaintenanceModeServesOnlyFromCache(t *testing.T) {
+	var requests int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{maintenancePage: []byte("down")})
+
+	c.mu.Lock()
+	c.data["/cached"] = cacheData{header: http.Header{}, body: []byte("stale"), status: http.StatusOK}
+	c.mu.Unlock()
+
+	c.maintenance.Store(true)
+
+	resp, err := http.Get(proxyServer.URL + "/cached")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if got := resp.Header.Get("X-Cache"); got != XCacheStale {
+		t.Errorf("expected stale entry to be served, got X-Cache %q", got)
+	}
+
+	resp, err = http.Get(proxyServer.URL + "/uncached")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for uncached request, got %d", resp.StatusCode)
+	}
+
+	if requests != 0 {
+		t.Errorf("expected origin to be untouched, got %d requests", requests)
+	}
+}
+
+func TestCleanupKeepsEntriesWithinGrace(t *testing.T) {
+	c := newCache(time.Hour)
+	c.grace = time.Hour
+
+	c.store("/grace", cacheData{age: time.Now().Add(-90 * time.Minute), ttl: time.Hour})
+	c.store("/expired", cacheData{age: time.Now().Add(-3 * time.Hour), ttl: time.Hour})
+
+	c.cleanup()
+
+	if _, ok := c.data["/grace"]; !ok {
+		t.Error("expected entry within grace period to be kept")
+	}
+
+	if _, ok := c.data["/expired"]; ok {
+		t.Error("expected entry past grace period to be deleted")
+	}
+}
+
+func TestCleanupInBatches(t *testing.T) {
+	c := newCache(time.Hour)
+
+	n := 2*cleanupBatchSize + cleanupBatchSize/2
+	for i := range n {
+		age := time.Now()
+		if i%2 == 0 {
+			age = age.Add(-2 * time.Hour)
+		}
+
+		c.store("/entry/"+strconv.Itoa(i), cacheData{age: age, ttl: time.Hour})
+	}
+
+	var before dto.Metric
+	if err := cleanupDuration.Write(&before); err != nil {
+		t.Fatalf("cannot read the cleanup histogram: %v", err)
+	}
+
+	c.cleanup()
+
+	if len(c.data) != n/2 {
+		t.Errorf("expected %d entries left, got %d", n/2, len(c.data))
+	}
+
+	for key := range c.data {
+		if i, _ := strconv.Atoi(strings.TrimPrefix(key, "/entry/")); i%2 == 0 {
+			t.Errorf("expected the expired %s deleted", key)
+		}
+	}
+
+	var after dto.Metric
+	if err := cleanupDuration.Write(&after); err != nil {
+		t.Fatalf("cannot read the cleanup histogram: %v", err)
+	}
+
+	if after.GetHistogram().GetSampleCount() != before.GetHistogram().GetSampleCount()+1 {
+		t.Error("expected the cleanup duration observed")
+	}
+}
+
+func TestWarmingPopulatesClientKey(t *testing.T) {
+	var requests int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{}
+	c := newCache(time.Hour)
+	rp := newReverseProxy(backend.URL, cfg)
+	handleMissedCache(rp, c, cfg)
+
+	proxyServer := httptest.NewServer(cacheHandler(rp, c, cfg))
+
+	defer proxyServer.Close()
+
+	warm(rp, cfg, []string{"/products?limit=10"}, &c.warming)
+
+	resp, err := http.Get(proxyServer.URL + "/products?limit=10")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if got := resp.Header.Get("X-Cache"); got != XCacheHit {
+		t.Errorf("expected warmed entry to be a HIT, got %q", got)
+	}
+
+	if requests != 1 {
+		t.Errorf("expected a single origin request, got %d", requests)
+	}
+}
+
+func TestCacheKeyPrefix(t *testing.T) {
+	c := newCache(time.Hour)
+	c.keyPrefix = "v2:"
+
+	req := httptest.NewRequest(http.MethodGet, "/products?limit=10", nil)
+
+	if got := c.key(req); got != "v2:/products?limit=10" {
+		t.Errorf("expected prefixed key, got %q", got)
+	}
+}
+
+func TestRootMode(t *testing.T) {
+	var requests int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{rootMode: RootModeOK})
+
+	for _, path := range []string{"/", "/other"} {
+		resp, err := http.Get(proxyServer.URL + path)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	if requests != 1 {
+		t.Errorf("expected only /other to reach the origin, got %d requests", requests)
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{
+		debugHeaders: true,
+		lookupHeader: "X-Edge-Lookup",
+		ageHeader:    "X-Edge-Age",
+	})
+	clock := newFakeClock()
+	c.clock = clock
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if got := resp.Header.Get("X-Edge-Lookup"); got != XCacheMiss {
+		t.Errorf("expected lookup MISS, got %q", got)
+	}
+
+	clock.advance(42 * time.Second)
+
+	resp, err = http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if got := resp.Header.Get("X-Edge-Lookup"); got != XCacheHit {
+		t.Errorf("expected lookup HIT, got %q", got)
+	}
+
+	if got := resp.Header.Get("X-Edge-Age"); got != "42" {
+		t.Errorf("expected age of 42 seconds, got %q", got)
+	}
+}
+
+func TestTrailersPassThrough(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write([]byte("OK"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(proxyServer.URL + "/test")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if string(body) != "OK" || resp.Trailer.Get("X-Checksum") != "abc" {
+			t.Errorf("expected body with trailer, got %q and %v", body, resp.Trailer)
+		}
+
+		if resp.Header.Get("X-Cache") != XCacheMiss {
+			t.Errorf("expected MISS, got %q", resp.Header.Get("X-Cache"))
+		}
+	}
+
+	if len(c.data) != 0 {
+		t.Errorf("expected response with trailers not to be cached, got %d entries", len(c.data))
+	}
+}
+
+func TestSkipQueryStrings(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{skipQueryStrings: true})
+
+	for _, path := range []string{"/search?q=a", "/search?q=a", "/search"} {
+		resp, err := http.Get(proxyServer.URL + path)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if resp.Header.Get("X-Cache") != XCacheMiss {
+			t.Errorf("%s: expected MISS, got %q", path, resp.Header.Get("X-Cache"))
+		}
+	}
+
+	if _, ok := c.data["/search"]; !ok || len(c.data) != 1 {
+		t.Errorf("expected only /search to be cached, got %d entries", len(c.data))
+	}
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	do := func(url, method string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp
+	}
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{maxRequestBody: 4})
+
+	do(proxyServer.URL+"/big", http.MethodGet, strings.NewReader("too large"))
+	do(proxyServer.URL+"/small", http.MethodGet, strings.NewReader("ok"))
+
+	if _, ok := c.data["/big"]; ok {
+		t.Error("expected request over the limit not to be cached")
+	}
+
+	if _, ok := c.data["/small"]; !ok {
+		t.Error("expected request within the limit to be cached")
+	}
+
+	proxyServer, _ = newTestProxy(t, backend.URL, &config{maxRequestBody: 4, rejectLargeBodies: true})
+
+	if resp := do(proxyServer.URL+"/upload", http.MethodPost, strings.NewReader("too large")); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", resp.StatusCode)
+	}
+
+	// Hide the length so the body is only cut off while it streams.
+	chunked := io.MultiReader(strings.NewReader("too large"))
+
+	if resp := do(proxyServer.URL+"/upload", http.MethodPost, chunked); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a chunked body, got %d", resp.StatusCode)
+	}
+}
+
+func TestClientCacheControl(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{clientCacheControl: []routeCacheControl{
+		{prefix: "/", value: "no-cache"},
+		{prefix: "/static/", value: "public, max-age=60"},
+	}})
+
+	for i, want := range []string{XCacheMiss, XCacheHit} {
+		resp, err := http.Get(proxyServer.URL + "/static/app.js")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if resp.Header.Get("X-Cache") != want || resp.Header.Get("Cache-Control") != "public, max-age=60" {
+			t.Errorf("request %d: got %q with Cache-Control %q", i, resp.Header.Get("X-Cache"), resp.Header.Get("Cache-Control"))
+		}
+	}
+
+	if d := c.data["/static/app.js"]; d.header.Get("Cache-Control") != "max-age=600" || d.ttl != 10*time.Minute {
+		t.Errorf("expected the entry to keep the origin freshness, got %q and %s", d.header.Get("Cache-Control"), d.ttl)
+	}
+}
+
+func TestPartialContentNotCached(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader("0123456789"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+
+	get := func(rangeHeader string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/file.txt", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	if resp, body := get("bytes=0-3"); resp.StatusCode != http.StatusPartialContent || body != "0123" {
+		t.Fatalf("expected the partial body, got %d %q", resp.StatusCode, body)
+	}
+
+	if _, ok := c.data["/file.txt"]; ok {
+		t.Fatal("expected the 206 not to be cached")
+	}
+
+	if resp, body := get(""); resp.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Errorf("expected the full body, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestAcceptRangesOnHits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses with trailers are streamed through uncached.
+		if r.URL.Path == "/streamed" {
+			w.Header().Set("Trailer", "X-Checksum")
+			defer w.Header().Set("X-Checksum", "1")
+		}
+
+		w.Header().Set("Accept-Ranges", "none")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{})
+
+	get := func(path string, header map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	if resp, _ := get("/file.txt", nil); resp.Header.Get("Accept-Ranges") != "none" {
+		t.Errorf("expected the origin Accept-Ranges on a miss, got %q", resp.Header.Get("Accept-Ranges"))
+	}
+
+	if resp, _ := get("/file.txt", nil); resp.Header.Get("X-Cache") != XCacheHit || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("expected Accept-Ranges bytes on a hit, got %q %q", resp.Header.Get("X-Cache"), resp.Header.Get("Accept-Ranges"))
+	}
+
+	resp, body := get("/file.txt", map[string]string{"Range": "bytes=2-5"})
+	if resp.StatusCode != http.StatusPartialContent || body != "2345" || resp.Header.Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("expected the range from cache, got %d %q %q", resp.StatusCode, body, resp.Header.Get("Content-Range"))
+	}
+
+	if resp, body := get("/file.txt", map[string]string{"Range": "bytes=-3", "If-Range": `"v0"`}); resp.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Errorf("expected the whole entry on an If-Range mismatch, got %d %q", resp.StatusCode, body)
+	}
+
+	if resp, _ := get("/file.txt", map[string]string{"Range": "bytes=20-"}); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Errorf("expected 416 past the end, got %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+
+	get("/streamed", nil)
+	if resp, _ := get("/streamed", nil); resp.Header.Get("X-Cache") != XCacheMiss || resp.Header.Get("Accept-Ranges") != "none" {
+		t.Errorf("expected the origin Accept-Ranges on a streamed response, got %q %q", resp.Header.Get("X-Cache"), resp.Header.Get("Accept-Ranges"))
+	}
+}
+
+func TestStreamedResponsesNotCached(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/movie":
+			w.Header().Set("Content-Type", "video/mp4")
+		case "/big":
+			w.Header().Set("Content-Length", "1000")
+			_, _ = w.Write(make([]byte, 1000))
+
+			return
+		}
+
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{streamContentTypes: []string{"video/"}, streamMinBytes: 512})
+
+	for _, path := range []string{"/movie", "/big", "/api"} {
+		resp, err := http.Get(proxyServer.URL + path)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	if _, ok := c.data["/api"]; !ok || len(c.data) != 1 {
+		t.Errorf("expected only /api to be cached, got %d entries", len(c.data))
+	}
+}
+
+func TestHeadServedFromCache(t *testing.T) {
+	var requests int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte("cached body"))
+	}))
+
+	defer backend.Close()
+
+	h := newProxy(backend.URL, newCache(time.Hour), &config{}).Handler()
+
+	for _, method := range []string{http.MethodGet, http.MethodGet, http.MethodHead} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/test", nil))
+
+		if method == http.MethodHead {
+			if rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "11" || rec.Header().Get("X-Cache") != XCacheHit {
+				t.Errorf("expected a bodiless HIT with Content-Length 11, got %q %q and %d body bytes",
+					rec.Header().Get("X-Cache"), rec.Header().Get("Content-Length"), rec.Body.Len())
+			}
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("expected only the first GET to reach the origin, got %d requests", requests)
+	}
+}
+
+func TestFailedBodyReadNotCached(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("partial"))
+
+		// Drop the connection before the promised length was sent.
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway || strings.Contains(string(body), "partial") {
+		t.Errorf("expected a clean 502, got %d %q", resp.StatusCode, body)
+	}
+
+	if len(c.data) != 0 {
+		t.Errorf("expected nothing cached, got %d entries", len(c.data))
+	}
+}
+
+func TestCacheKeyHeaders(t *testing.T) {
+	var requests int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	// The tenant header is keyed on but never reaches the origin.
+	proxyServer, c := newTestProxy(t, backend.URL, &config{stripRequestHeaders: []string{"X-Tenant"}})
+	c.setKeyHeaders([]string{"x-tenant", "X-Tenant"})
+
+	for _, tenant := range []string{"a", "b", "a", "", ""} {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	if requests != 3 {
+		t.Errorf("expected one origin request per tenant, got %d", requests)
+	}
+
+	for _, key := range []string{"/test", "/test#X-Tenant=a", "/test#X-Tenant=b"} {
+		if _, ok := c.data[key]; !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+}
+
+func TestCacheableBodySize(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+
+		if r.URL.Query().Has("chunked") {
+			// Flushing first leaves the length unknown to the proxy.
+			w.(http.Flusher).Flush()
+		}
+
+		_, _ = w.Write(bytes.Repeat([]byte("x"), n))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.minBodySize, c.maxBodySize = 4, 8
+
+	for uri, cached := range map[string]bool{
+		"/3":          false,
+		"/4":          true,
+		"/8":          true,
+		"/9":          false,
+		"/8?chunked":  true,
+		"/20?chunked": false,
+	} {
+		resp, err := http.Get(proxyServer.URL + uri)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		n, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimSuffix(uri, "?chunked"), "/"))
+		if len(body) != n {
+			t.Errorf("%s: expected %d bytes, got %d", uri, n, len(body))
+		}
+
+		if _, ok := c.data[uri]; ok != cached {
+			t.Errorf("%s: expected cached %v, got %v", uri, cached, ok)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server-Timing", "db;dur=5")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{serverTiming: true})
+
+	for _, want := range []string{"cache;desc=miss, upstream;dur=", "cache;desc=hit"} {
+		resp, err := http.Get(proxyServer.URL + "/test")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		timings := resp.Header.Values("Server-Timing")
+		if len(timings) != 2 || timings[0] != "db;dur=5" || !strings.HasPrefix(timings[1], want) {
+			t.Errorf("expected %q after the origin's timing, got %q", want, timings)
+		}
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Padding", strings.Repeat("x", 100))
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.maxHeaderBytes = 100
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != "OK" || resp.Header.Get("X-Padding") == "" {
+		t.Errorf("expected the response to be served, got %q", body)
+	}
+
+	if len(c.data) != 0 {
+		t.Errorf("expected nothing cached, got %d entries", len(c.data))
+	}
+}
+
+func TestServerSentEventsStream(t *testing.T) {
+	release := make(chan struct{})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: hello\n\n"))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+
+	defer backend.Close()
+	defer close(release)
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+
+	// The second subscriber must not wait for the first stream to end.
+	for range 2 {
+		resp, err := http.Get(proxyServer.URL + "/events")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		defer resp.Body.Close()
+
+		line := make(chan string, 1)
+		go func() {
+			s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+			line <- s
+		}()
+
+		select {
+		case s := <-line:
+			if s != "data: hello\n" {
+				t.Errorf("expected the first event, got %q", s)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the event was not flushed through")
+		}
+	}
+
+	if len(c.data) != 0 {
+		t.Errorf("expected nothing cached, got %d entries", len(c.data))
+	}
+}
+
+func TestUpstreamHeadersInjected(t *testing.T) {
+	var received []string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Authorization"))
+		w.Header().Set("Cache-Control", "max-age=0")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{upstreamHeaders: http.Header{"Authorization": {"Bearer origin-key"}}}
+	proxyServer, c := newTestProxy(t, backend.URL, cfg)
+
+	for _, auth := range []string{"", "Bearer forged"} {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	if len(received) != 2 || received[0] != "Bearer origin-key" || received[1] != "Bearer origin-key" {
+		t.Errorf("expected the configured credentials upstream, got %q", received)
+	}
+
+	for key, d := range c.data {
+		if strings.Contains(key, "origin-key") || d.header.Get("Authorization") != "" {
+			t.Errorf("expected the credentials kept out of %q", key)
+		}
+	}
+}
+
+func TestSetCookieResponses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range strings.Split(r.URL.Query().Get("set"), ",") {
+			http.SetCookie(w, &http.Cookie{Name: name, Value: "1"})
+		}
+
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{
+		stripCookies:  []string{"_ga"},
+		bypassCookies: []string{"session"},
+	})
+
+	for uri, cached := range map[string]bool{
+		"/page?set=_ga":         true,
+		"/page?set=_ga,theme":   false,
+		"/page?set=session":     false,
+		"/page?set=_ga,session": false,
+	} {
+		resp, err := http.Get(proxyServer.URL + uri)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if len(resp.Cookies()) == 0 {
+			t.Errorf("%s: expected the cookies to reach the client", uri)
+		}
+
+		d, ok := c.data[uri]
+		if ok != cached {
+			t.Errorf("%s: expected cached %v, got %v", uri, cached, ok)
+		}
+
+		if ok && d.header.Get("Set-Cookie") != "" {
+			t.Errorf("%s: expected the cookie stripped from the entry, got %q", uri, d.header.Get("Set-Cookie"))
+		}
+	}
+
+	resp, err := http.Get(proxyServer.URL + "/page?set=_ga")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.Header.Get("X-Cache") != XCacheHit || len(resp.Cookies()) != 0 {
+		t.Errorf("expected a HIT without cookies, got %q %v", resp.Header.Get("X-Cache"), resp.Cookies())
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/typed" {
+			w.Header().Set("Content-Type", "text/html")
+		} else {
+			w.Header()["Content-Type"] = nil
+		}
+
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+
+	defer backend.Close()
+
+	for _, store := range []bool{false, true} {
+		proxyServer, c := newTestProxy(t, backend.URL, &config{
+			defaultContentTypes: []routeContentType{
+				{prefix: "/", value: "text/plain"},
+				{prefix: "/api/", value: "application/json"},
+			},
+			storeDefaultContentType: store,
+		})
+
+		for uri, want := range map[string]string{
+			"/api/items": "application/json",
+			"/page":      "text/plain",
+			"/typed":     "text/html",
+		} {
+			for range 2 {
+				resp, err := http.Get(proxyServer.URL + uri)
+				if err != nil {
+					t.Fatalf("proxy request failed: %v", err)
+				}
+
+				_ = resp.Body.Close()
+
+				if got := resp.Header.Get("Content-Type"); got != want {
+					t.Errorf("store %v, %s: expected Content-Type %q, got %q", store, uri, want, got)
+				}
+			}
+
+			if uri == "/typed" {
+				continue
+			}
+
+			if got := c.data[uri].header.Get("Content-Type"); store != (got == want) {
+				t.Errorf("store %v, %s: unexpected stored Content-Type %q", store, uri, got)
+			}
+		}
+	}
+}
+
+func TestInternalRedirect(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/download":
+			w.Header().Set("X-Accel-Redirect", "/internal/files/a.bin?v=2")
+			_, _ = w.Write([]byte("ignored"))
+		case "/internal/files/a.bin":
+			_, _ = w.Write([]byte("file " + r.URL.Query().Get("v")))
+		case "/loop", "/internal/loop":
+			w.Header().Set("X-Accel-Redirect", "/internal/loop")
+		case "/escape":
+			w.Header().Set("X-Accel-Redirect", "/internal/../secret")
+		default:
+			_, _ = w.Write([]byte("secret"))
+		}
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{
+		internalRedirectHeader: "X-Accel-Redirect",
+		internalRedirectPaths:  []string{"/internal/"},
+	})
+
+	get := func(uri string) (*http.Response, string) {
+		resp, err := http.Get(proxyServer.URL + uri)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	for range 2 {
+		resp, body := get("/download")
+		if resp.StatusCode != http.StatusOK || body != "file 2" {
+			t.Errorf("expected the internal target served, got %d %q", resp.StatusCode, body)
+		}
+
+		if resp.Header.Get("X-Accel-Redirect") != "" {
+			t.Error("expected the internal redirect header hidden from clients")
+		}
+	}
+
+	count := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return requests[path]
+	}
+
+	if n := count("/download"); n != 1 {
+		t.Errorf("expected the redirected response cached, got %d origin requests", n)
+	}
+
+	if resp, _ := get("/loop"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected a redirect loop to fail with 502, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := get("/escape"); resp.StatusCode != http.StatusBadGateway || count("/secret") != 0 {
+		t.Errorf("expected a target outside the allowed paths refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestInternalRedirectPathsMatchSegments(t *testing.T) {
+	cfg := &config{internalRedirectPaths: []string{"/internal", "/files/"}}
+
+	for p, want := range map[string]bool{
+		"/internal":       true,
+		"/internal/a.bin": true,
+		"/internalx":      false,
+		"/internal-other": false,
+		"/files/a.bin":    true,
+		"/filesystem":     false,
+		"/files":          false,
+	} {
+		if got := cfg.internalRedirectAllowed(p); got != want {
+			t.Errorf("%s: expected %v, got %v", p, want, got)
+		}
+	}
+}
+
+func TestCannedResponses(t *testing.T) {
+	var requests atomic.Int64
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte("origin"))
+	}))
+
+	defer backend.Close()
+
+	robots := filepath.Join(t.TempDir(), "robots.txt")
+	if err := os.WriteFile(robots, []byte("User-agent: *\nDisallow: /\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("CANNED_RESPONSES", "/robots.txt: 200 text/plain @"+robots+"; /healthz: 200 application/json {\"ok\": true}")
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{
+		canned:         new(configLoader).envCannedResponses("CANNED_RESPONSES"),
+		addHeaders:     http.Header{"X-Served-By": {"proxy-01"}},
+		addHeadersMode: AddHeadersModeSet,
+	})
+
+	for uri, want := range map[string]string{
+		"/robots.txt": "User-agent: *\nDisallow: /\n",
+		"/healthz":    `{"ok": true}`,
+	} {
+		resp, err := http.Get(proxyServer.URL + uri)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("%s: expected the canned body, got %d %q", uri, resp.StatusCode, body)
+		}
+
+		if got := resp.Header.Get("X-Served-By"); got != "proxy-01" {
+			t.Errorf("%s: expected ADD_HEADERS on the canned response, got %q", uri, got)
+		}
+	}
+
+	if n := requests.Load(); n != 0 || len(c.data) != 0 {
+		t.Errorf("expected neither the origin nor the cache involved, got %d requests and %d entries", n, len(c.data))
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	var sawAuthorization, sawAPIKey atomic.Bool
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawAuthorization.Store(r.Header.Get("Authorization") != "")
+		sawAPIKey.Store(r.Header.Get("X-Api-Key") != "")
+		_, _ = w.Write([]byte("other " + r.URL.Path))
+	}))
+
+	defer other.Close()
+
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("forbidden"))
+	}))
+
+	defer forbidden.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		case "/new":
+			_, _ = w.Write([]byte("new"))
+		case "/chain":
+			http.Redirect(w, r, "/hop", http.StatusFound)
+		case "/hop":
+			http.Redirect(w, r, other.URL+"/file", http.StatusTemporaryRedirect)
+		case "/away":
+			http.Redirect(w, r, forbidden.URL+"/x", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop2", http.StatusFound)
+		case "/loop2":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}
+	}))
+
+	defer backend.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	otherHost := strings.TrimPrefix(other.URL, "http://")
+	proxyServer, c := newTestProxy(t, backend.URL, &config{
+		followRedirects: true,
+		redirectHosts:   []string{otherHost},
+		upstreamHeaders: http.Header{"X-Api-Key": {"origin-only"}},
+	})
+
+	get := func(server *httptest.Server, uri string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+uri, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if uri == "/chain" {
+			req.Header.Set("Authorization", "Bearer origin-only")
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	for _, xCache := range []string{XCacheMiss, XCacheHit} {
+		if resp, body := get(proxyServer, "/old"); resp.StatusCode != http.StatusOK || body != "new" || resp.Header.Get("X-Cache") != xCache {
+			t.Errorf("expected the redirect target as a %s, got %d %q %q", xCache, resp.StatusCode, resp.Header.Get("X-Cache"), body)
+		}
+	}
+
+	if d, ok := c.data["/old"]; !ok || string(d.body) != "new" {
+		t.Errorf("expected the target cached under the original key")
+	}
+
+	if resp, body := get(proxyServer, "/chain"); resp.StatusCode != http.StatusOK || body != "other /file" {
+		t.Errorf("expected the chain followed to the allowed host, got %d %q", resp.StatusCode, body)
+	}
+
+	if sawAuthorization.Load() {
+		t.Error("expected Authorization kept from the other host")
+	}
+
+	if sawAPIKey.Load() {
+		t.Error("expected the upstream headers kept from the other host")
+	}
+
+	if resp, _ := get(proxyServer, "/away"); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != forbidden.URL+"/x" {
+		t.Errorf("expected the off-origin redirect passed through, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	if resp, _ := get(proxyServer, "/loop"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 for a redirect loop, got %d", resp.StatusCode)
+	}
+
+	passThrough, _ := newTestProxy(t, backend.URL, &config{})
+
+	if resp, _ := get(passThrough, "/old"); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/new" {
+		t.Errorf("expected redirects passed through by default, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
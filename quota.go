@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// namespace bounds the entries stored under a path prefix. Evictions to make
+// room in a namespace only ever hit its own entries. Entry sizes are counted
+// per entry, even when dedupBodies shares their bodies.
+type namespace struct {
+	prefix     string
+	maxEntries int
+	maxBytes   int64
+
+	lru     *lruList
+	entries int
+	bytes   int64
+}
+
+func newNamespace(prefix string, maxEntries int, maxBytes int64) *namespace {
+	return &namespace{prefix: prefix, maxEntries: maxEntries, maxBytes: maxBytes, lru: newLRU()}
+}
+
+// bounded reports whether the namespace has a quota, only then is the usage
+// order of its keys tracked.
+func (ns *namespace) bounded() bool {
+	return ns.maxEntries > 0 || ns.maxBytes > 0
+}
+
+// overQuota returns the eviction reason while the namespace exceeds its quota.
+func (ns *namespace) overQuota() (string, bool) {
+	switch {
+	case ns.maxEntries > 0 && ns.entries > ns.maxEntries:
+		return EvictionReasonLRU, true
+	case ns.maxBytes > 0 && ns.bytes > ns.maxBytes:
+		return EvictionReasonBytes, true
+	}
+
+	return "", false
+}
+
+// setQuotas gives each quota prefix its own namespace, the longest prefix
+// matching first. Keys under none of them share the default pool.
+func (c *cache) setQuotas(quotas []cacheQuota) {
+	c.namespaces = nil
+
+	for _, q := range quotas {
+		c.namespaces = append(c.namespaces, newNamespace(q.prefix, q.entries, q.bytes))
+	}
+
+	sort.Slice(c.namespaces, func(i, j int) bool {
+		return len(c.namespaces[i].prefix) > len(c.namespaces[j].prefix)
+	})
+}
+
+func (c *cache) namespaceFor(key string) *namespace {
+	_, path := splitPartition(strings.TrimPrefix(key, c.keyPrefix))
+
+	for _, ns := range c.namespaces {
+		if strings.HasPrefix(path, ns.prefix) {
+			return ns
+		}
+	}
+
+	return c.pool
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNamespaceQuotas(t *testing.T) {
+	c := newCache(time.Hour)
+	c.setQuotas([]cacheQuota{
+		{prefix: "/search", entries: 2},
+		{prefix: "/img/", bytes: 10},
+	})
+
+	put := func(key string, size int) {
+		c.store(key, cacheData{body: []byte(strings.Repeat("x", size)), age: time.Now(), ttl: time.Hour})
+	}
+
+	put("/products/1", 100)
+	put("/search?q=a", 1)
+	put("/search?q=b", 1)
+
+	// Touch q=a so q=b is the least recently used search.
+	c.lookup("/search?q=a")
+	put("/search?q=c", 1)
+
+	put("/img/a.png", 6)
+	put("/img/b.png", 6)
+
+	for key, want := range map[string]bool{
+		"/products/1": true,
+		"/search?q=a": true,
+		"/search?q=b": false,
+		"/search?q=c": true,
+		"/img/a.png":  false,
+		"/img/b.png":  true,
+	} {
+		if _, ok := c.data[key]; ok != want {
+			t.Errorf("%s: expected cached %v, got %v", key, want, ok)
+		}
+	}
+
+	if n := c.stats.evictions[EvictionReasonBytes].Load(); n != 1 {
+		t.Errorf("expected one eviction for bytes, got %d", n)
+	}
+
+	if ns := c.namespaceFor("/img/b.png"); ns.entries != 1 || ns.bytes != 6 {
+		t.Errorf("expected /img/ to hold 1 entry of 6 bytes, got %d of %d", ns.entries, ns.bytes)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "net/http"
+
+// hitRange is the byte range of the entry d a GET asks for, when it can be
+// served from cache: a single range of a complete 200 body, whose If-Range,
+// if any, still matches. Other requests get the whole entry.
+func hitRange(r *http.Request, d cacheData) (byteRange, bool) {
+	v := r.Header.Get("Range")
+	if v == "" || r.Method != http.MethodGet || d.status != http.StatusOK {
+		return byteRange{}, false
+	}
+
+	br, ok := parseRange(v)
+	if !ok {
+		return byteRange{}, false
+	}
+
+	if ir := r.Header.Get("If-Range"); ir != "" && !ifRangeMatches(ir, d.header) {
+		return byteRange{}, false
+	}
+
+	return br, true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRateLimitBackoff is how long the origin is left alone after a 429
+// without a usable Retry-After.
+const defaultRateLimitBackoff = 30 * time.Second
+
+// backoff remembers, per origin, until when it asked not to be sent
+// requests. Origins are named like fillOrigin does, so one rate limiting
+// upstream never holds the others back.
+type backoff struct {
+	until sync.Map // origin → *atomic.Int64
+}
+
+// extend pushes the end of the backoff of origin d from now, never
+// shortening it.
+func (b *backoff) extend(origin string, now time.Time, d time.Duration) {
+	until := now.Add(d).UnixNano()
+
+	v, _ := b.until.LoadOrStore(origin, new(atomic.Int64))
+	end := v.(*atomic.Int64)
+
+	for {
+		cur := end.Load()
+		if cur >= until || end.CompareAndSwap(cur, until) {
+			return
+		}
+	}
+}
+
+// remaining reports how long the backoff of origin still lasts at now.
+func (b *backoff) remaining(origin string, now time.Time) (time.Duration, bool) {
+	v, ok := b.until.Load(origin)
+	if !ok {
+		return 0, false
+	}
+
+	d := time.Unix(0, v.(*atomic.Int64).Load()).Sub(now)
+
+	return d, d > 0
+}
+
+// retryAfter reads a Retry-After of delay seconds or an HTTP date.
+func retryAfter(h http.Header, now time.Time) time.Duration {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+
+	if d, ok := parseDeltaSeconds(v); ok {
+		return d
+	}
+
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return defaultRateLimitBackoff
+}
+
+// handleRateLimited starts backing off when the origin answered 429 and swaps
+// the answer for the cached entry, stale or not, when there is one. The 429
+// itself is never stored. It reports whether res was a 429.
+func handleRateLimited(res *http.Response, c *cache, cfg *config) bool {
+	if res.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+
+	if !cfg.ignoreRetryAfter {
+		now := c.clock.Now()
+		wait := retryAfter(res.Header, now)
+		c.backoff.extend(fillOrigin(res.Request), now, wait)
+		log.Printf("origin rate limited %s, backing off for %s", res.Request.URL.RequestURI(), wait)
+	}
+
+	if res.Request.Method != http.MethodGet {
+		return true
+	}
+
+	d, ok := c.lookup(c.key(res.Request))
+	if !ok {
+		res.Header.Add("X-Cache", XCacheMiss)
+
+		return true
+	}
+
+	_ = res.Body.Close()
+
+	res.StatusCode = d.status
+	res.Header = d.header.Clone()
+	res.Header.Set("X-Cache", XCacheStale)
+	res.Body = io.NopCloser(bytes.NewReader(d.body))
+	res.ContentLength = int64(len(d.body))
+
+	return true
+}
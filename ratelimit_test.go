@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBackoff(t *testing.T) {
+	var upstream atomic.Int64
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstream.Add(1) > 1 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=0")
+		_, _ = w.Write([]byte("cached"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	clock := newFakeClock()
+	c.clock = clock
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(proxyServer.URL + path)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	get("/a")
+
+	for i := 0; i < 2; i++ {
+		resp, body := get("/a")
+
+		if resp.StatusCode != http.StatusOK || body != "cached" || resp.Header.Get("X-Cache") != XCacheStale {
+			t.Errorf("request %d: expected the stale entry, got %d %q %q", i, resp.StatusCode, resp.Header.Get("X-Cache"), body)
+		}
+	}
+
+	resp, _ := get("/b")
+
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "60" {
+		t.Errorf("expected 503 with Retry-After 60, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	if upstream.Load() != 2 {
+		t.Errorf("expected the origin to be left alone during the backoff, got %d requests", upstream.Load())
+	}
+
+	if d := c.data["/a"]; string(d.body) != "cached" {
+		t.Errorf("expected the 429 not to replace the entry, got %q", d.body)
+	}
+
+	clock.advance(time.Minute)
+	get("/b")
+
+	if upstream.Load() != 3 {
+		t.Errorf("expected the origin to be asked again after the backoff, got %d requests", upstream.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+
+	for v, want := range map[string]time.Duration{
+		"120": 2 * time.Minute,
+		now.Add(time.Hour).UTC().Format(http.TimeFormat): time.Hour,
+		"":      defaultRateLimitBackoff,
+		"bogus": defaultRateLimitBackoff,
+	} {
+		if got := retryAfter(http.Header{"Retry-After": {v}}, now.Truncate(time.Second)); got != want {
+			t.Errorf("%q: expected %s, got %s", v, want, got)
+		}
+	}
+}
+
+func TestRateLimitBackoffPerOrigin(t *testing.T) {
+	var tenantRequests atomic.Int64
+
+	def := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+
+	defer def.Close()
+
+	tenant := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantRequests.Add(1)
+		_, _ = w.Write([]byte("tenant"))
+	}))
+
+	defer tenant.Close()
+
+	tenantURL, _ := url.Parse(tenant.URL)
+
+	cfg := &config{adminSecret: "secret", upstreams: []upstreamRoute{{host: "tenant.example", target: tenantURL}}}
+	c := newCache(time.Hour)
+	srv := httptest.NewServer(newProxy(def.URL, c, cfg).routes())
+
+	defer srv.Close()
+
+	get := func(host, path string) int {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if host != "" {
+			req.Host = host
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	get("", "/a")
+
+	if status := get("", "/b"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected the default origin to be backed off, got %d", status)
+	}
+
+	if status := get("tenant.example", "/b"); status != http.StatusOK || tenantRequests.Load() != 1 {
+		t.Errorf("expected the tenant origin to be asked, got %d after %d requests", status, tenantRequests.Load())
+	}
+}
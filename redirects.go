@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultRedirectMaxHops bounds the redirects followed for one request unless
+// REDIRECT_MAX_HOPS says otherwise.
+const defaultRedirectMaxHops = 5
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+// followRedirects swaps a redirect of the origin for the response it leads
+// to, with FOLLOW_REDIRECTS, which is then cached under the key of the
+// original request. A redirect to another host than the origin is passed to
+// the client as is unless the host is one of REDIRECT_ALLOWED_HOSTS. Loops
+// and chains longer than REDIRECT_MAX_HOPS get a 502.
+func followRedirects(res *http.Response, rt http.RoundTripper, cfg *config) error {
+	if !cfg.followRedirects || !isRedirect(res.StatusCode) {
+		return nil
+	}
+
+	if m := res.Request.Method; m != http.MethodGet && m != http.MethodHead {
+		return nil
+	}
+
+	maxHops := cfg.redirectMaxHops
+	if maxHops <= 0 {
+		maxHops = defaultRedirectMaxHops
+	}
+
+	origin := res.Request.URL.Host
+	cur := res.Request.URL
+	seen := map[string]bool{cur.String(): true}
+
+	for hops := 0; isRedirect(res.StatusCode); hops++ {
+		u, err := cur.Parse(res.Header.Get("Location"))
+		if err != nil || res.Header.Get("Location") == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil
+		}
+
+		u.Fragment = ""
+
+		if !strings.EqualFold(u.Host, origin) && !cfg.redirectHostAllowed(u.Host) {
+			// The client resolves a relative Location against the URL
+			// it requested, not the one redirecting it.
+			if hops > 0 {
+				res.Header.Set("Location", u.String())
+			}
+
+			return nil
+		}
+
+		if seen[u.String()] {
+			return fmt.Errorf("redirect loop of %s at %s", res.Request.URL.Path, u)
+		}
+
+		if hops == maxHops {
+			return fmt.Errorf("more than %d redirects for %s", maxHops, res.Request.URL.Path)
+		}
+
+		seen[u.String()] = true
+
+		sub := res.Request.Clone(res.Request.Context())
+		sub.URL, sub.Host = u, u.Host
+		dropConditionals(sub.Header)
+
+		// Credentials meant for the origin stay with it, and so do the
+		// UPSTREAM_HEADERS, which often carry some.
+		if !strings.EqualFold(u.Host, origin) {
+			sub.Header.Del("Authorization")
+			sub.Header.Del("Cookie")
+
+			for k := range cfg.upstreamHeaders {
+				sub.Header.Del(k)
+			}
+		}
+
+		next, err := rt.RoundTrip(sub)
+		if err != nil {
+			return err
+		}
+
+		replaceResponse(res, next)
+		cur = u
+	}
+
+	return nil
+}
+
+// redirectHostAllowed reports whether host is one of the
+// REDIRECT_ALLOWED_HOSTS.
+func (cfg *config) redirectHostAllowed(host string) bool {
+	for _, allowed := range cfg.redirectHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchSource is what the refresher needs of the request an entry was
+// fetched for: its URI and Host, and the headers its key was made of, taken
+// before the director rewrote them. Keys holding headers or hashed for
+// length can't be turned back into such a request.
+type fetchSource struct {
+	uri    string
+	host   string
+	header http.Header
+}
+
+type fetchSourceKey struct{}
+
+// sourceHeaders are the request headers keys are made of.
+func (c *cache) sourceHeaders() []string {
+	if !c.keyAccept {
+		return c.keyHeaders
+	}
+
+	return append(c.keyHeaders[:len(c.keyHeaders):len(c.keyHeaders)], "Accept")
+}
+
+// withFetchSource records in the context of r the request it is, with its
+// headers among names, unless a source was recorded already.
+func withFetchSource(r *http.Request, names []string) *http.Request {
+	if _, ok := r.Context().Value(fetchSourceKey{}).(*fetchSource); ok {
+		return r
+	}
+
+	src := &fetchSource{uri: r.URL.RequestURI(), host: r.Host}
+
+	for _, name := range names {
+		if values := r.Header.Values(name); len(values) > 0 {
+			if src.header == nil {
+				src.header = make(http.Header)
+			}
+
+			src.header[name] = append([]string(nil), values...)
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), fetchSourceKey{}, src))
+}
+
+// refresher refetches popular entries shortly before they expire, so hot keys
+// stay fresh without waiting for a client to miss.
+type refresher struct {
+	// current is the proxy to fetch through, the one serving since the
+	// last reload.
+	current func() *proxy
+
+	c         *cache
+	threshold int64
+	lead      time.Duration
+
+	// slots bounds the fetches in flight.
+	slots chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]bool
+
+	// baseline is the hit count of a key at its last refresh.
+	baseline map[string]int64
+}
+
+func newRefresher(current func() *proxy, c *cache, cfg *config) *refresher {
+	return &refresher{
+		current:   current,
+		c:         c,
+		threshold: int64(cfg.refreshThreshold),
+		lead:      cfg.refreshLead,
+		slots:     make(chan struct{}, max(cfg.refreshConcurrency, 1)),
+		inflight:  make(map[string]bool),
+		baseline:  make(map[string]int64),
+	}
+}
+
+// start checks for due entries twice per lead time.
+func (rf *refresher) start() {
+	go func() {
+		ticker := time.NewTicker(max(rf.lead/2, time.Second))
+		defer ticker.Stop()
+
+		for range ticker.C {
+			rf.refreshDue()
+		}
+	}()
+}
+
+// due lists the keys that are popular enough and about to expire.
+func (rf *refresher) due() []string {
+	var keys []string
+
+	rf.c.mu.RLock()
+	defer rf.c.mu.RUnlock()
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for key := range rf.baseline {
+		if _, ok := rf.c.data[key]; !ok {
+			delete(rf.baseline, key)
+		}
+	}
+
+	for key, d := range rf.c.data {
+		// Segments are fetched by range and left to their own requests.
+		if d.hits == nil || d.source == nil || rf.inflight[key] || isSegmentKey(key) {
+			continue
+		}
+
+		remaining := rf.c.ttlForLocked(key, d) - rf.c.since(d.age)
+
+		if remaining > 0 && remaining <= rf.lead && d.hits.Load()-rf.baseline[key] >= rf.threshold {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// refreshDue starts a fetch for each due key while slots are free, leaving
+// the rest for the next round.
+func (rf *refresher) refreshDue() {
+	for _, key := range rf.due() {
+		select {
+		case rf.slots <- struct{}{}:
+		default:
+			return
+		}
+
+		rf.mu.Lock()
+		rf.inflight[key] = true
+		rf.mu.Unlock()
+
+		go func() {
+			defer func() {
+				<-rf.slots
+			}()
+
+			rf.refresh(key)
+		}()
+	}
+}
+
+func (rf *refresher) refresh(key string) {
+	hits := int64(0)
+
+	rf.c.mu.RLock()
+	d, ok := rf.c.data[key]
+	if ok && d.hits != nil {
+		hits = d.hits.Load()
+	}
+	rf.c.mu.RUnlock()
+
+	// Evicted since it was due.
+	if !ok || d.source == nil {
+		rf.mu.Lock()
+		delete(rf.inflight, key)
+		rf.mu.Unlock()
+
+		return
+	}
+
+	err := rf.fetch(key, d.source)
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	delete(rf.inflight, key)
+
+	// A failed refresh is retried on the next round.
+	if err != nil {
+		log.Printf("cannot refresh %s %s", key, err)
+
+		return
+	}
+
+	rf.baseline[key] = hits
+}
+
+// fetch sends the request src again to the upstream of the partition of
+// key, storing the response under key.
+func (rf *refresher) fetch(key string, src *fetchSource) error {
+	partition, _ := splitPartition(strings.TrimPrefix(key, rf.c.keyPrefix))
+
+	req, err := newFetchRequest(src.uri)
+	if err != nil {
+		return err
+	}
+
+	req.Host = src.host
+	if src.header != nil {
+		req.Header = src.header.Clone()
+	}
+
+	// The refreshed entry lands under the same key, keeping its source.
+	ctx := context.WithValue(req.Context(), cacheKeyKey{}, key)
+	ctx = context.WithValue(ctx, fetchSourceKey{}, src)
+
+	p := rf.current()
+	if route := p.cfg.upstreamByPartition(partition); route != nil {
+		ctx = context.WithValue(ctx, upstreamKey{}, route)
+	}
+
+	req = req.WithContext(ctx)
+
+	return fetchInto(p.rp, req)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitRefreshes waits for the refreshes rf started by taking every slot
+// they hold, then gives the slots back.
+func waitRefreshes(rf *refresher) {
+	for range cap(rf.slots) {
+		rf.slots <- struct{}{}
+	}
+
+	for range cap(rf.slots) {
+		<-rf.slots
+	}
+}
+
+func TestRefresherRefetchesPopularKeys(t *testing.T) {
+	var upstream atomic.Int64
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{refreshThreshold: 2, refreshLead: 2 * time.Minute, refreshConcurrency: 1}
+	c := newCache(time.Hour)
+	clock := newFakeClock()
+	c.clock = clock
+	p := newProxy(backend.URL, c, cfg)
+
+	proxyServer := httptest.NewServer(p.Handler())
+	defer proxyServer.Close()
+
+	for _, path := range []string{"/hot", "/hot", "/hot", "/cold", "/cold"} {
+		resp, err := http.Get(proxyServer.URL + path)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	c.mu.RLock()
+	stored := c.data["/hot"].age
+	c.mu.RUnlock()
+
+	rf := newRefresher(func() *proxy { return p }, c, cfg)
+
+	clock.advance(30 * time.Second)
+
+	if keys := rf.due(); len(keys) != 1 || keys[0] != "/hot" {
+		t.Fatalf("expected only /hot to be due, got %v", keys)
+	}
+
+	rf.refreshDue()
+	waitRefreshes(rf)
+
+	if upstream.Load() != 3 {
+		t.Fatalf("expected one refresh upstream, got %d requests", upstream.Load())
+	}
+
+	c.mu.RLock()
+	d := c.data["/hot"]
+	c.mu.RUnlock()
+
+	if !d.age.After(stored) || d.hits.Load() != 2 {
+		t.Errorf("expected a refreshed entry keeping its 2 hits, got age %s and %d hits", d.age, d.hits.Load())
+	}
+
+	if keys := rf.due(); len(keys) != 0 {
+		t.Errorf("expected no key due right after a refresh, got %v", keys)
+	}
+}
+
+func TestRefresherReplaysTheRequest(t *testing.T) {
+	var upstream atomic.Int64
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(r.URL.RequestURI() + " " + r.Header.Get("X-Tenant")))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{refreshThreshold: 1, refreshLead: 2 * time.Minute, refreshConcurrency: 2}
+	c := newCache(time.Hour)
+	clock := newFakeClock()
+	c.clock = clock
+	c.setKeyHeaders([]string{"X-Tenant"})
+	c.maxKeyBytes, c.longKeys = 64, LongKeysHash
+	p := newProxy(backend.URL, c, cfg)
+
+	proxyServer := httptest.NewServer(p.Handler())
+	defer proxyServer.Close()
+
+	long := "/long?q=" + strings.Repeat("x", 80)
+
+	for i := 0; i < 2; i++ {
+		for _, path := range []string{"/tenant", long} {
+			req, err := http.NewRequest(http.MethodGet, proxyServer.URL+path, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			req.Header.Set("X-Tenant", "acme")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("proxy request failed: %v", err)
+			}
+
+			_ = resp.Body.Close()
+		}
+	}
+
+	stored := make(map[string]cacheData)
+
+	c.mu.RLock()
+	for key, d := range c.data {
+		stored[key] = d
+	}
+	c.mu.RUnlock()
+
+	rf := newRefresher(func() *proxy { return p }, c, cfg)
+
+	clock.advance(30 * time.Second)
+
+	if keys := rf.due(); len(keys) != 2 {
+		t.Fatalf("expected both keys to be due, got %v", keys)
+	}
+
+	rf.refreshDue()
+	waitRefreshes(rf)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.data) != 2 {
+		t.Fatalf("expected the refreshes to land under the same keys, got %d entries", len(c.data))
+	}
+
+	for key, before := range stored {
+		d := c.data[key]
+
+		if !d.age.After(before.age) || string(d.body) != string(before.body) || !strings.HasSuffix(string(d.body), " acme") {
+			t.Errorf("%s: expected a refresh of the same request, got %q", key, d.body)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// inheritedEnv names the variables set before the .env file was loaded. They
+// keep precedence over the file on reload, as they do at start-up.
+var inheritedEnv = envNames(os.Environ())
+
+func envNames(environ []string) map[string]bool {
+	names := make(map[string]bool, len(environ))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		names[name] = true
+	}
+
+	return names
+}
+
+// reloadConfig reads the .env file and the environment again. Variables
+// removed from the .env file keep their previous value.
+func reloadConfig() (*config, error) {
+	vars, err := godotenv.Read()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	for name, value := range vars {
+		if !inheritedEnv[name] {
+			if err := os.Setenv(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return loadConfig()
+}
+
+// cacheLimits returns the limits cfg sets on a cache with ttl.
+func (cfg *config) cacheLimits(ttl time.Duration) limits {
+	return limits{
+		ttl:                ttl,
+		grace:              cfg.staleGracePeriod,
+		staleIfError:       cfg.staleIfErrorMaxAge,
+		loadStaleThreshold: cfg.loadStaleThreshold,
+		loadStaleMaxAge:    cfg.loadStaleMaxAge,
+		minBodySize:        cfg.minBodySize,
+		maxBodySize:        cfg.maxBodySize,
+		maxHeaderBytes:     cfg.maxHeaderBytes,
+		statusTTLs:         cfg.statusTTLs,
+		statusTTLsOnly:     cfg.statusTTLsOnly,
+		slideFraction:      cfg.slideFraction,
+		slideMax:           cfg.slideMax,
+	}
+}
+
+// reloader serves through the proxy built from the configuration last
+// loaded. A reload builds a new one around the same cache, so entries stay
+// while TTLs, limits and header rules change.
+type reloader struct {
+	mu     sync.Mutex
+	origin string
+	cur    *proxy
+
+	routes atomic.Pointer[http.ServeMux]
+	admin  atomic.Pointer[http.ServeMux]
+}
+
+func newReloader(origin string, p *proxy) *reloader {
+	l := &reloader{origin: origin}
+	l.serve(p)
+
+	return l
+}
+
+func (l *reloader) serve(p *proxy) {
+	p.reloads = l
+	l.cur = p
+	l.routes.Store(p.routes())
+	l.admin.Store(p.adminRoutes())
+}
+
+// current returns the proxy serving since the last reload.
+func (l *reloader) current() *proxy {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.cur
+}
+
+// Routes serves the routes of the current proxy.
+func (l *reloader) Routes() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.routes.Load().ServeHTTP(w, r)
+	})
+}
+
+// AdminRoutes serves the admin routes of the current proxy.
+func (l *reloader) AdminRoutes() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.admin.Load().ServeHTTP(w, r)
+	})
+}
+
+// reloadReport is the outcome of a reload.
+type reloadReport struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// RequiresRestart lists the changed settings left as they were, as they
+	// only apply at start-up.
+	RequiresRestart []string `json:"requires_restart,omitempty"`
+}
+
+// reload applies the configuration as it is now, keeping the settings that
+// can't change while serving at their current value.
+func (l *reloader) reload() (reloadReport, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next, err := reloadConfig()
+	if err != nil {
+		return reloadReport{Status: "failed", Error: err.Error()}, err
+	}
+
+	ttl := l.cur.c.currentLimits().ttl
+	if v := os.Getenv("TTL"); v != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil {
+			err = fmt.Errorf("invalid TTL %q", v)
+
+			return reloadReport{Status: "failed", Error: err.Error()}, err
+		}
+
+		ttl = time.Duration(hours) * time.Hour
+	}
+
+	cur := l.cur.cfg
+
+	var restart []string
+
+	keepSetting(&restart, "ADMIN_ADDR", &next.adminAddr, cur.adminAddr)
+	keepSetting(&restart, "DISK_CACHE_DIR", &next.diskCacheDir, cur.diskCacheDir)
+	keepSetting(&restart, "DISK_CACHE_MAX_BYTES", &next.diskCacheMaxBytes, cur.diskCacheMaxBytes)
+	keepSetting(&restart, "DISK_CACHE_PRECOMPRESS", &next.diskCachePrecompress, cur.diskCachePrecompress)
+	keepSetting(&restart, "MEMORY_MAX_ENTRIES", &next.memoryMaxEntries, cur.memoryMaxEntries)
+	keepSetting(&restart, "CACHE_QUOTAS", &next.quotas, cur.quotas)
+	keepSetting(&restart, "DEDUPLICATE_BODIES", &next.dedupBodies, cur.dedupBodies)
+	keepSetting(&restart, "CACHE_KEY_INTEGRITY", &next.checkKeyCollisions, cur.checkKeyCollisions)
+	keepSetting(&restart, "CACHE_KEY_PREFIX", &next.cacheKeyPrefix, cur.cacheKeyPrefix)
+	keepSetting(&restart, "CACHE_KEY_HEADERS", &next.keyHeaders, cur.keyHeaders)
+	keepSetting(&restart, "CACHE_KEY_ACCEPT", &next.keyAccept, cur.keyAccept)
+	keepSetting(&restart, "CACHE_KEY_FULL_URL", &next.keyFullURL, cur.keyFullURL)
+	keepSetting(&restart, "CACHE_MAX_VARIANTS", &next.maxVariants, cur.maxVariants)
+	keepSetting(&restart, "CACHE_MAX_KEY_BYTES", &next.maxKeyBytes, cur.maxKeyBytes)
+	keepSetting(&restart, "CACHE_LONG_KEYS", &next.longKeys, cur.longKeys)
+	keepSetting(&restart, "TRAILING_SLASH", &next.trailingSlash, cur.trailingSlash)
+	keepSetting(&restart, "TRAILING_SLASH_PATHS", &next.slashPaths, cur.slashPaths)
+	keepSetting(&restart, "MAX_POOLED_BUFFER_BYTES", &next.maxPooledBuffer, cur.maxPooledBuffer)
+	keepSetting(&restart, "ADMISSION_POLICY", &next.admissionPolicy, cur.admissionPolicy)
+	keepSetting(&restart, "ADMISSION_WINDOW", &next.admissionWindow, cur.admissionWindow)
+	keepSetting(&restart, "ADMISSION_MAX_KEYS", &next.admissionMaxKeys, cur.admissionMaxKeys)
+	keepSetting(&restart, "FILL_CONCURRENCY", &next.fillConcurrency, cur.fillConcurrency)
+	keepSetting(&restart, "REFRESH_HIT_THRESHOLD", &next.refreshThreshold, cur.refreshThreshold)
+	keepSetting(&restart, "REFRESH_LEAD_TIME", &next.refreshLead, cur.refreshLead)
+	keepSetting(&restart, "REFRESH_CONCURRENCY", &next.refreshConcurrency, cur.refreshConcurrency)
+	keepSetting(&restart, "SLOW_UPSTREAM_TOP", &next.slowTop, cur.slowTop)
+	keepSetting(&restart, "SLOW_UPSTREAM_WINDOW", &next.slowWindow, cur.slowWindow)
+	keepSetting(&restart, "OTLP_ENDPOINT", &next.otlpEndpoint, cur.otlpEndpoint)
+	keepSetting(&restart, "UPSTREAM_COMPRESSION", &next.upstreamCompression, cur.upstreamCompression)
+	keepSetting(&restart, "WRITE_TIMEOUT", &next.writeTimeout, cur.writeTimeout)
+	keepSetting(&restart, "MAX_CONNECTIONS", &next.maxConnections, cur.maxConnections)
+	keepSetting(&restart, "CONNECTION_LIMIT_MODE", &next.connLimitMode, cur.connLimitMode)
+
+	// The runtime toggle of /_cache/maintenance stands until the setting
+	// itself changes.
+	if next.maintenance != cur.maintenance {
+		l.cur.c.maintenance.Store(next.maintenance)
+		log.Printf("maintenance mode set to %v", next.maintenance)
+	}
+
+	old := l.cur
+	l.cur.c.setLimits(next.cacheLimits(ttl))
+	l.serve(newProxy(l.origin, l.cur.c, next))
+
+	// Requests still in flight on the old transport finish on their
+	// connections, which then time out idle.
+	closeIdleConnections(old.rp.Transport)
+
+	log.Println("configuration reloaded")
+
+	for _, name := range restart {
+		log.Printf("%s changed, restart to apply it", name)
+	}
+
+	return reloadReport{Status: "reloaded", RequiresRestart: restart}, nil
+}
+
+// keepSetting puts the value of the setting back to cur when next changed
+// it, listing name as requiring a restart.
+func keepSetting[T any](restart *[]string, name string, next *T, cur T) {
+	if !reflect.DeepEqual(*next, cur) {
+		*restart = append(*restart, name)
+		*next = cur
+	}
+}
+
+// reloadHandler reloads the configuration on POST, answering with the
+// reloadReport.
+func reloadHandler(l *reloader, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			cfg.writeError(w, r, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		report, err := l.reload()
+		if err != nil {
+			log.Printf("cannot reload configuration %s", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("can't write to body %s", err)
+		}
+	}
+}
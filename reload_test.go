@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	t.Setenv("ADMIN_SECRET", "s3cret")
+	t.Setenv("ADD_HEADERS", "X-Tuned: before")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("cannot load the configuration: %v", err)
+	}
+
+	c := newCache(time.Hour)
+	l := newReloader(backend.URL, newProxy(backend.URL, c, cfg))
+
+	proxyServer := httptest.NewServer(l.Routes())
+	defer proxyServer.Close()
+
+	get := func(uri string) *http.Response {
+		t.Helper()
+
+		resp, err := http.Get(proxyServer.URL + uri)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		return resp
+	}
+
+	reload := func() (int, reloadReport) {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodPost, proxyServer.URL+"/_cache/reload", nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("reload request failed: %v", err)
+		}
+
+		defer resp.Body.Close()
+
+		var report reloadReport
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatalf("cannot decode the reload report: %v", err)
+		}
+
+		return resp.StatusCode, report
+	}
+
+	get("/warm")
+
+	t.Setenv("ADD_HEADERS", "X-Tuned: after")
+	t.Setenv("CACHE_MAX_BODY_BYTES", "1")
+	t.Setenv("TTL", "2")
+	t.Setenv("ADMIN_ADDR", "127.0.0.1:0")
+
+	status, report := reload()
+	if status != http.StatusOK || report.Status != "reloaded" {
+		t.Fatalf("expected a reload, got %d %+v", status, report)
+	}
+
+	if !slices.Equal(report.RequiresRestart, []string{"ADMIN_ADDR"}) {
+		t.Errorf("expected ADMIN_ADDR to require a restart, got %v", report.RequiresRestart)
+	}
+
+	if resp := get("/warm"); resp.Header.Get("X-Cache") != XCacheHit || resp.Header.Get("X-Tuned") != "after" {
+		t.Errorf("expected a hit with the reloaded header, got %q %q", resp.Header.Get("X-Cache"), resp.Header.Get("X-Tuned"))
+	}
+
+	get("/large")
+
+	if _, ok := c.data["/large"]; ok {
+		t.Error("expected the reloaded body limit to apply")
+	}
+
+	if ttl := c.currentLimits().ttl; ttl != 2*time.Hour {
+		t.Errorf("expected the reloaded TTL, got %s", ttl)
+	}
+
+	t.Setenv("TRAILING_SLASH", "sideways")
+	t.Setenv("ADD_HEADERS", "X-Tuned: invalid")
+
+	status, report = reload()
+	if status != http.StatusUnprocessableEntity || report.Error == "" {
+		t.Fatalf("expected the invalid configuration refused, got %d %+v", status, report)
+	}
+
+	if resp := get("/warm"); resp.Header.Get("X-Tuned") != "after" {
+		t.Errorf("expected the previous configuration kept, got %q", resp.Header.Get("X-Tuned"))
+	}
+
+	// A template that doesn't parse is refused like any invalid setting.
+	tmpl := filepath.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(tmpl, []byte("{{ .Status "), 0o600); err != nil {
+		t.Fatalf("cannot write template: %v", err)
+	}
+
+	t.Setenv("TRAILING_SLASH", "keep")
+	t.Setenv("ERROR_HTML_TEMPLATE", tmpl)
+
+	status, report = reload()
+	if status != http.StatusUnprocessableEntity || !strings.Contains(report.Error, "ERROR_HTML_TEMPLATE") {
+		t.Fatalf("expected the broken template refused, got %d %+v", status, report)
+	}
+
+	t.Setenv("ERROR_HTML_TEMPLATE", "")
+	t.Setenv("MAINTENANCE_MODE", "true")
+
+	if status, report = reload(); status != http.StatusOK || slices.Contains(report.RequiresRestart, "MAINTENANCE_MODE") {
+		t.Fatalf("expected MAINTENANCE_MODE reloaded, got %d %+v", status, report)
+	}
+
+	if !c.maintenance.Load() {
+		t.Error("expected the reloaded MAINTENANCE_MODE to apply")
+	}
+}
+
+func TestLoadConfigReportsEveryError(t *testing.T) {
+	t.Setenv("TRAILING_SLASH", "sideways")
+	t.Setenv("CACHE_MAX_BODY_BYTES", "lots")
+
+	cfg, err := loadConfig()
+	if cfg != nil || err == nil {
+		t.Fatal("expected the invalid configuration refused")
+	}
+
+	for _, name := range []string{"TRAILING_SLASH", "CACHE_MAX_BODY_BYTES"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected %s reported, got %v", name, err)
+		}
+	}
+}
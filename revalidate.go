@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type revalidationKey struct{}
+
+// newRevalidationRequest turns r into a conditional request for the cached
+// entry d using its ETag and Last-Modified validators. It reports false when
+// d has no validators or the client already sent its own conditions, in which
+// case the request should be forwarded as is.
+func newRevalidationRequest(r *http.Request, d cacheData) (*http.Request, bool) {
+	etag := d.header.Get("ETag")
+	lastModified := d.header.Get("Last-Modified")
+
+	if etag == "" && lastModified == "" {
+		return nil, false
+	}
+
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return nil, false
+	}
+
+	out := r.Clone(context.WithValue(r.Context(), revalidationKey{}, d))
+
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+
+	if lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	return out, true
+}
+
+// notModifiedKeeps are the headers of a stored entry a 304 doesn't replace,
+// as they describe the stored body or are not for the cache to reuse.
+var notModifiedKeeps = []string{"Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding", "Set-Cookie"}
+
+// mergeNotModified returns the headers of the entry revalidated by a 304 with
+// header: those of the 304 replace the stored ones, see RFC 9111 section
+// 4.3.4.
+func mergeNotModified(stored, header http.Header) http.Header {
+	merged := stored.Clone()
+
+	for name, values := range header {
+		if slices.Contains(notModifiedKeeps, name) {
+			continue
+		}
+
+		merged[name] = slices.Clone(values)
+	}
+
+	return merged
+}
+
+// handleNotModified answers a 304 to one of our revalidation requests with the
+// cached entry, refreshing its age and merging in the headers of the 304, from
+// which its freshness is computed again. It reports whether res was handled.
+func handleNotModified(res *http.Response, c *cache) bool {
+	d, ok := res.Request.Context().Value(revalidationKey{}).(cacheData)
+	if !ok || res.StatusCode != http.StatusNotModified {
+		return false
+	}
+
+	def, ok := c.defaultTTL(res.Request, d.status)
+	if !ok {
+		def = d.ttl
+	}
+
+	d.header = mergeNotModified(d.header, res.Header)
+	d.ttl = entryTTL(d.header, def, c.clock.Now())
+	d.header.Del(ProxyCacheTTLHeader)
+	entryLifetime.Observe(d.ttl.Seconds())
+	d.age = c.clock.Now()
+	d.created = d.age
+	d.forcedStale = false
+
+	c.store(c.key(res.Request), d)
+
+	_ = res.Body.Close()
+
+	res.StatusCode = d.status
+	res.Header = d.header.Clone()
+	res.Header.Set("X-Cache", XCacheRevalidated)
+	res.Body = io.NopCloser(bytes.NewReader(d.body))
+	res.ContentLength = int64(len(d.body))
+
+	return true
+}
+
+// notModifiedView is the 304 answer to a client whose conditional request
+// matches the cached entry d.
+func notModifiedView(d cacheData) cacheData {
+	v := d
+	v.status = http.StatusNotModified
+	v.body = nil
+	v.header = d.header.Clone()
+	v.header.Del("Content-Length")
+
+	return v
+}
+
+// hasPragmaNoCache reports whether a request asks for revalidation through the
+// legacy Pragma header. Pragma is ignored when Cache-Control is present, as
+// RFC 7234 section 5.4 requires, except for the bare "no-cache" net/http adds
+// on its own when it reads a Pragma: no-cache request.
+func hasPragmaNoCache(h http.Header) bool {
+	if cc, ok := h["Cache-Control"]; ok && (len(cc) != 1 || cc[0] != "no-cache") {
+		return false
+	}
+
+	for _, v := range h.Values("Pragma") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "no-cache") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPragmaNoCacheRevalidates(t *testing.T) {
+	var conditional int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("body"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{honorPragma: true})
+
+	get := func(pragma string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if pragma != "" {
+			req.Header.Set("Pragma", pragma)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	get("")
+
+	if resp, _ := get(""); resp.Header.Get("X-Cache") != XCacheHit {
+		t.Errorf("expected HIT, got %q", resp.Header.Get("X-Cache"))
+	}
+
+	resp, body := get("no-cache")
+
+	if conditional != 1 {
+		t.Errorf("expected one conditional request upstream, got %d", conditional)
+	}
+
+	if resp.StatusCode != http.StatusOK || body != "body" {
+		t.Errorf("expected cached body after 304, got %d %q", resp.StatusCode, body)
+	}
+
+	if got := resp.Header.Get("X-Cache"); got != XCacheRevalidated {
+		t.Errorf("expected %s, got %q", XCacheRevalidated, got)
+	}
+}
+
+func TestNotModifiedMergesHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("Cache-Control", "max-age=600")
+			w.Header().Set("X-Version", "2")
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Version", "1")
+		w.Header().Set("X-Kept", "yes")
+		_, _ = w.Write([]byte("body"))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+
+	get := func() (*http.Response, string) {
+		resp, err := http.Get(proxyServer.URL + "/test")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	get()
+
+	d := c.data["/test"]
+	d.age = d.age.Add(-2 * time.Minute)
+	c.data["/test"] = d
+
+	resp, body := get()
+	if resp.Header.Get("X-Cache") != XCacheRevalidated || body != "body" {
+		t.Fatalf("expected the stored body revalidated, got %q %q", resp.Header.Get("X-Cache"), body)
+	}
+
+	for name, want := range map[string]string{"Cache-Control": "max-age=600", "X-Version": "2", "X-Kept": "yes"} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("expected %s %q, got %q", name, want, got)
+		}
+	}
+
+	if d := c.data["/test"]; d.ttl != 10*time.Minute || d.header.Get("X-Version") != "2" {
+		t.Errorf("expected the entry updated from the 304, got ttl %s and version %q", d.ttl, d.header.Get("X-Version"))
+	}
+
+	if resp, _ := get(); resp.Header.Get("X-Cache") != XCacheHit {
+		t.Errorf("expected a fresh HIT after revalidation, got %q", resp.Header.Get("X-Cache"))
+	}
+}
+
+func TestMergeNotModifiedKeepsBodyHeaders(t *testing.T) {
+	stored := http.Header{"Content-Encoding": {"gzip"}, "Content-Length": {"42"}, "Etag": {`"v1"`}}
+	merged := mergeNotModified(stored, http.Header{"Content-Length": {"0"}, "Etag": {`"v2"`}, "Set-Cookie": {"id=1"}})
+
+	if merged.Get("Content-Length") != "42" || merged.Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected the body headers kept, got %v", merged)
+	}
+
+	if merged.Get("ETag") != `"v2"` || merged.Get("Set-Cookie") != "" {
+		t.Errorf("expected the validator replaced and no cookie, got %v", merged)
+	}
+
+	if stored.Get("ETag") != `"v1"` {
+		t.Errorf("expected the stored headers untouched, got %v", stored)
+	}
+}
+
+func TestSoftPurgeRevalidates(t *testing.T) {
+	var conditional int
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("body"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{adminSecret: "secret"}
+	proxyServer, c := newTestProxy(t, backend.URL, cfg)
+	c.staleIfError = time.Hour
+
+	get := func() (*http.Response, string) {
+		resp, err := http.Get(proxyServer.URL + "/page?v=1")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	get()
+
+	purge := func(query string) (int, int) {
+		req := httptest.NewRequest(http.MethodPost, "/_cache/purge?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rec := httptest.NewRecorder()
+		adminOnly(cfg, purgeHandler(c, cfg))(rec, req)
+
+		var report struct {
+			Purged int `json:"purged"`
+		}
+
+		_ = json.NewDecoder(rec.Body).Decode(&report)
+
+		return rec.Code, report.Purged
+	}
+
+	if code, n := purge("path=/page&soft=true"); code != http.StatusOK || n != 1 {
+		t.Fatalf("expected one entry soft purged, got %d entries and status %d", n, code)
+	}
+
+	d, ok := c.data["/page?v=1"]
+	if !ok || !c.isStale(d, time.Hour) || c.isCacheStale(d.age, time.Hour) {
+		t.Fatalf("expected the entry kept, marked stale without aging out")
+	}
+
+	if _, ok := c.staleOnError(httptest.NewRequest(http.MethodGet, "/page?v=1", nil)); !ok {
+		t.Errorf("expected the soft purged entry to remain for stale-if-error")
+	}
+
+	resp, body := get()
+
+	if got := resp.Header.Get("X-Cache"); got != XCacheRevalidated || conditional != 1 || body != "body" {
+		t.Errorf("expected the soft purged entry revalidated, got %q after %d conditional requests", got, conditional)
+	}
+
+	if resp, _ := get(); resp.Header.Get("X-Cache") != XCacheHit {
+		t.Errorf("expected HIT after revalidation, got %q", resp.Header.Get("X-Cache"))
+	}
+
+	if code, _ := purge("path=/page&soft=maybe"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid soft flag, got %d", code)
+	}
+
+	if code, n := purge("path=/page"); code != http.StatusOK || n != 1 {
+		t.Errorf("expected one entry purged, got %d entries and status %d", n, code)
+	}
+
+	if _, ok := c.data["/page?v=1"]; ok {
+		t.Errorf("expected a hard purge to evict the entry")
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errRangeUnsupported is returned when the origin ignores a segment's range
+// request, so the object cannot be cached in segments.
+var errRangeUnsupported = errors.New("origin does not support range requests")
+
+// isSegmented reports whether r targets a path cached in fixed-size segments
+// rather than as a whole object.
+func (cfg *config) isSegmented(r *http.Request) bool {
+	if cfg.segmentSize <= 0 {
+		return false
+	}
+
+	for _, prefix := range cfg.segmentPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func segmentKey(uri string, i int64) string {
+	return fmt.Sprintf("%s#segment=%d", uri, i)
+}
+
+// isSegmentKey reports whether key holds a segment rather than a whole object.
+func isSegmentKey(key string) bool {
+	i := strings.LastIndex(key, "#segment=")
+	if i < 0 {
+		return false
+	}
+
+	_, err := strconv.ParseInt(key[i+len("#segment="):], 10, 64)
+
+	return err == nil
+}
+
+// byteRange is an inclusive byte range. A negative start asks for the last
+// end bytes of the object (a suffix range).
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange parses a single range Range header. Multi-range requests are
+// reported as not ok and left for the origin to answer.
+func parseRange(v string) (byteRange, bool) {
+	spec, ok := strings.CutPrefix(v, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false
+	}
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false
+		}
+
+		return byteRange{start: -1, end: n}, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+
+	end := int64(-1)
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return byteRange{}, false
+		}
+	}
+
+	return byteRange{start: start, end: end}, true
+}
+
+// bounds resolves the range against an object of total bytes, reporting
+// false when it starts past the end.
+func (br byteRange) bounds(total int64) (start, end int64, ok bool) {
+	start, end = br.start, br.end
+	if start < 0 {
+		start, end = max(total-br.end, 0), total-1
+	} else if end < 0 || end >= total {
+		end = total - 1
+	}
+
+	return start, end, start < total
+}
+
+// contentRangeTotal extracts the complete length from a Content-Range header.
+func contentRangeTotal(v string) (int64, bool) {
+	_, total, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(total, 10, 64)
+
+	return n, err == nil && n >= 0
+}
+
+// serveSegmented answers r from segments of the object, fetching only the
+// missing ones from the origin with range requests, so the whole object is
+// never buffered. It reports false, without writing anything, when the
+// request has to be proxied as usual instead.
+func serveSegmented(w http.ResponseWriter, r *http.Request, rp *httputil.ReverseProxy, c *cache, cfg *config) bool {
+	if cfg.uncacheable(r) {
+		return false
+	}
+
+	br := byteRange{start: 0, end: -1}
+	ranged := r.Header.Get("Range") != ""
+
+	if ranged {
+		var ok bool
+		if br, ok = parseRange(r.Header.Get("Range")); !ok {
+			return false
+		}
+	}
+
+	first := int64(0)
+	if br.start > 0 {
+		first = br.start / cfg.segmentSize
+	}
+
+	seg, xCacheValue, err := getSegment(r, first, rp, c, cfg)
+	if err != nil {
+		if !errors.Is(err, errRangeUnsupported) {
+			log.Printf("cannot fetch segment %d of %s %s", first, c.key(r), err)
+		}
+
+		return false
+	}
+
+	// A range is only served while the client's copy is still the same
+	// object, otherwise the whole object is sent.
+	if v := r.Header.Get("If-Range"); ranged && v != "" && !ifRangeMatches(v, seg.header) {
+		ranged, br = false, byteRange{start: 0, end: -1}
+
+		if first != 0 {
+			first = 0
+
+			if seg, xCacheValue, err = getSegment(r, first, rp, c, cfg); err != nil {
+				log.Printf("cannot fetch segment %d of %s %s", first, c.key(r), err)
+
+				return false
+			}
+		}
+	}
+
+	total, ok := contentRangeTotal(seg.header.Get("Content-Range"))
+	if !ok {
+		return false
+	}
+
+	start, end, ok := br.bounds(total)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		cfg.writeError(w, r, http.StatusRequestedRangeNotSatisfiable)
+
+		return true
+	}
+
+	for k, vv := range seg.header {
+		if k == "Content-Range" || k == "Content-Length" {
+			continue
+		}
+
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+
+	cfg.applyAddHeaders(w.Header())
+	cfg.applyClientCacheControl(r.URL.Path, w.Header())
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.Header().Set("X-Cache", xCacheValue)
+	c.countRequest(xCacheValue)
+
+	if xCacheValue == XCacheHit {
+		seg.hit()
+	}
+
+	status := http.StatusOK
+	if ranged {
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	}
+
+	w.WriteHeader(status)
+
+	head := seg
+
+	for i := start / cfg.segmentSize; i <= end/cfg.segmentSize; i++ {
+		if i != first {
+			if seg, _, err = getSegment(r, i, rp, c, cfg); err != nil {
+				log.Printf("cannot fetch segment %d of %s %s", i, c.key(r), err)
+
+				return true
+			}
+		}
+
+		// The object changed between segments. Past the headers the
+		// response can only be cut short; the next request fetches
+		// every segment again.
+		if !sameObject(head, seg) {
+			log.Printf("segment %d of %s is from another version of the object, dropping its segments", i, c.key(r))
+			c.dropSegments(c.key(r))
+
+			return true
+		}
+
+		offset := i * cfg.segmentSize
+		lo := max(start-offset, 0)
+		hi := min(end-offset+1, int64(len(seg.body)))
+
+		if lo >= hi {
+			continue
+		}
+
+		if _, err := w.Write(seg.body[lo:hi]); err != nil {
+			log.Printf("can't write to body %s", err)
+
+			return true
+		}
+	}
+
+	return true
+}
+
+// getSegment returns segment i of the object requested by r, from cache when
+// fresh and otherwise from the origin.
+func getSegment(r *http.Request, i int64, rp *httputil.ReverseProxy, c *cache, cfg *config) (cacheData, string, error) {
+	key := segmentKey(c.key(r), i)
+
+	d, ok := c.lookup(key)
+
+	if ok && !c.isStale(d, c.ttlFor(key, d)) {
+		return d, XCacheHit, nil
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", i*cfg.segmentSize, (i+1)*cfg.segmentSize-1))
+	out.Header.Del("If-Range")
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	rp.Director(out)
+
+	res, err := rp.Transport.RoundTrip(out)
+	if err != nil {
+		return cacheData{}, "", err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusPartialContent {
+		return cacheData{}, "", errRangeUnsupported
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, cfg.segmentSize))
+	if err != nil {
+		return cacheData{}, "", err
+	}
+
+	d = cacheData{
+		header: res.Header.Clone(),
+		body:   b,
+		age:    c.clock.Now(),
+		status: res.StatusCode,
+	}
+	d.header.Del(ProxyCacheTTLHeader)
+
+	ttl, ok := c.segmentTTL(out, res, key, cfg)
+	if !ok {
+		return d, XCacheMiss, nil
+	}
+
+	// Unlike the client, the stored segment never replays the cookies.
+	stored := d
+	stored.ttl = ttl
+	stored.header = d.header.Clone()
+	stored.header.Del("Set-Cookie")
+
+	entrySize.Observe(float64(len(b)))
+	c.store(key, stored)
+
+	return d, XCacheMiss, nil
+}
+
+// segmentTTL applies to a segment the checks whole responses pass before
+// being stored, returning the TTL to store it with. A segment is part of a
+// 200, so STATUS_TTLS applies to it as to one.
+func (c *cache) segmentTTL(out *http.Request, res *http.Response, key string, cfg *config) (time.Duration, bool) {
+	if len(res.Trailer) > 0 || !cfg.cookiesCacheable(res.Header) || !cfg.authorizedCacheable(out, res.Header) ||
+		!c.keyStorable(key) {
+		return 0, false
+	}
+
+	if n, limit := headerSize(res.Header), c.currentLimits().maxHeaderBytes; limit > 0 && n > limit {
+		return 0, false
+	}
+
+	def, ok := c.defaultTTL(out, http.StatusOK)
+	if !ok {
+		return 0, false
+	}
+
+	return debugTTL(out, entryTTL(res.Header, def, c.clock.Now())), true
+}
+
+// sameObject reports whether two segments are parts of the same version of
+// an object: of the same length and with the same validators.
+func sameObject(a, b cacheData) bool {
+	ta, _ := contentRangeTotal(a.header.Get("Content-Range"))
+	tb, _ := contentRangeTotal(b.header.Get("Content-Range"))
+
+	return ta == tb && a.header.Get("ETag") == b.header.Get("ETag") &&
+		a.header.Get("Last-Modified") == b.header.Get("Last-Modified")
+}
+
+// dropSegments evicts every segment of the object with key, from both tiers.
+func (c *cache) dropSegments(key string) {
+	match := func(k string) bool {
+		return strings.HasPrefix(k, key+"#segment=") && isSegmentKey(k)
+	}
+
+	c.mu.Lock()
+	for k := range c.data {
+		if match(k) {
+			c.evict(k, EvictionReasonPurge)
+		}
+	}
+	c.mu.Unlock()
+
+	c.purgeDisk(match)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSegmentedCache(t *testing.T) {
+	content := []byte("0123456789")
+
+	var ranges []string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{segmentSize: 4, segmentPaths: []string{"/videos/"}})
+
+	get := func(rangeHeader string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/videos/a.mp4", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	resp, body := get("bytes=3-8")
+
+	if resp.StatusCode != http.StatusPartialContent || body != "345678" {
+		t.Errorf("expected 206 with 345678, got %d %q", resp.StatusCode, body)
+	}
+
+	if got := resp.Header.Get("Content-Range"); got != "bytes 3-8/10" {
+		t.Errorf("unexpected Content-Range %q", got)
+	}
+
+	if len(ranges) != 3 {
+		t.Errorf("expected 3 segment fetches, got %v", ranges)
+	}
+
+	resp, body = get("bytes=-2")
+
+	if body != "89" || resp.Header.Get("X-Cache") != XCacheHit {
+		t.Errorf("expected cached suffix 89, got %q (%s)", body, resp.Header.Get("X-Cache"))
+	}
+
+	resp, body = get("")
+
+	if resp.StatusCode != http.StatusOK || body != string(content) {
+		t.Errorf("expected full object, got %d %q", resp.StatusCode, body)
+	}
+
+	if len(ranges) != 3 {
+		t.Errorf("expected segments to be reused, got %v", ranges)
+	}
+}
+
+func TestSegmentsAreNotVariants(t *testing.T) {
+	content := []byte("0123456789")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{segmentSize: 2, segmentPaths: []string{"/videos/"}})
+	c.maxVariants = 2
+
+	resp, err := http.Get(proxyServer.URL + "/videos/a.mp4")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != string(content) {
+		t.Fatalf("expected the full object, got %q", body)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.data) != 5 {
+		t.Errorf("expected all 5 segments kept under CACHE_MAX_VARIANTS, got %d", len(c.data))
+	}
+
+	if len(c.variants) != 0 {
+		t.Errorf("expected segments left out of the variants, got %d URLs tracked", len(c.variants))
+	}
+}
+
+func TestSegmentsOfChangedObjectDropped(t *testing.T) {
+	content, etag := []byte("0123456789"), `"v1"`
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{segmentSize: 4, segmentPaths: []string{"/videos/"}})
+
+	get := func(rangeHeader string) string {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/videos/a.mp4", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return string(b)
+	}
+
+	if body := get("bytes=0-3"); body != "0123" {
+		t.Fatalf("expected the first segment, got %q", body)
+	}
+
+	content, etag = []byte("abcdefghij"), `"v2"`
+
+	if body := get(""); body == "0123efghij" {
+		t.Fatal("expected segments of two versions never stitched together")
+	}
+
+	c.mu.RLock()
+	n := len(c.data)
+	c.mu.RUnlock()
+
+	if n != 0 {
+		t.Errorf("expected the segments of the changed object dropped, got %d entries", n)
+	}
+
+	if body := get(""); body != "abcdefghij" {
+		t.Errorf("expected the new version whole, got %q", body)
+	}
+}
+
+func TestSegmentsFollowCachePolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader([]byte("0123456789")))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{segmentSize: 4, segmentPaths: []string{"/videos/"}})
+
+	resp, err := http.Get(proxyServer.URL + "/videos/a.mp4")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != "0123456789" {
+		t.Fatalf("expected the full object, got %q", body)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.data) != 0 {
+		t.Errorf("expected segments setting a cookie not stored, got %d entries", len(c.data))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// selftestReport is the outcome of a self-test with enough about the
+// instance to tell it apart from its peers.
+type selftestReport struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	GoVersion  string `json:"go_version"`
+	Uptime     string `json:"uptime"`
+	ConfigHash string `json:"config_hash"`
+}
+
+// selftest stores a synthetic entry, reads it back and deletes it again,
+// reading through the same path as proxied responses.
+func (c *cache) selftest() error {
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+	key := c.keyPrefix + "/_cache/selftest?nonce=" + nonce
+
+	c.storeSelftest(key, cacheData{
+		header: http.Header{"Content-Type": {"text/plain"}},
+		body:   []byte(nonce),
+		age:    c.clock.Now(),
+		ttl:    time.Minute,
+		status: http.StatusOK,
+	})
+
+	d, ok := c.lookup(key)
+
+	c.removeSelftest(key)
+
+	switch {
+	case !ok:
+		return errors.New("stored entry not found")
+	case !bytes.Equal(d.body, []byte(nonce)) || d.status != http.StatusOK:
+		return errors.New("stored entry read back altered")
+	}
+
+	if _, ok := c.lookup(key); ok {
+		return errors.New("deleted entry still found")
+	}
+
+	return nil
+}
+
+// storeSelftest puts the self-test entry in memory as store does, but
+// outside of every quota: it counts against no namespace and never evicts
+// other entries to make room.
+func (c *cache) storeSelftest(key string, d cacheData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d.hits = new(atomic.Int64)
+
+	if c.dedupBodies {
+		d = c.intern(d)
+	} else {
+		c.bytes += int64(len(d.body))
+	}
+
+	c.data[key] = d
+}
+
+// removeSelftest deletes the self-test entry again. It never left the memory
+// tier and was not evicted, so no eviction is counted.
+func (c *cache) removeSelftest(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if d, ok := c.data[key]; ok {
+		c.release(d)
+		delete(c.data, key)
+	}
+}
+
+// configHash identifies the settings reported by the stats endpoint, except
+// for the maintenance mode which changes at runtime.
+func (cfg *config) configHash(c *cache) string {
+	summary := cfg.summary(c)
+	delete(summary, "maintenance")
+
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// selftestHandler runs the self-test on GET, answering 500 when it fails.
+func selftestHandler(c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			cfg.writeError(w, r, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		report := selftestReport{
+			Status:     "ok",
+			GoVersion:  runtime.Version(),
+			Uptime:     time.Since(c.started).Round(time.Second).String(),
+			ConfigHash: cfg.configHash(c),
+		}
+
+		status := http.StatusOK
+		if err := c.selftest(); err != nil {
+			log.Printf("cache self-test failed %s", err)
+
+			report.Status, report.Error = "fail", err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("can't write to body %s", err)
+		}
+	}
+}
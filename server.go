@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/netutil"
+)
+
+// What happens to connections over MAX_CONNECTIONS. ConnLimitWait leaves them
+// in the accept queue until a connection closes, ConnLimitRefuse closes them.
+const (
+	ConnLimitWait   = "wait"
+	ConnLimitRefuse = "refuse"
+)
+
+// openConnections exports what connCounter counts. Goroutines, heap and GC
+// pauses come with the Go collector of the default registry, as go_goroutines,
+// go_memstats_heap_alloc_bytes and go_gc_duration_seconds.
+var openConnections = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "cache_open_connections",
+	Help: "Number of client connections currently open on the proxy listener.",
+})
+
+var connectionsRefused = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "cache_connections_refused_total",
+	Help: "Number of client connections closed for being over MAX_CONNECTIONS.",
+})
+
+// connCounter tracks the connections currently open on the server through
+// http.Server.ConnState.
+type connCounter struct {
+	open atomic.Int64
+}
+
+func (cc *connCounter) track(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		cc.open.Add(1)
+		openConnections.Inc()
+	case http.StateClosed, http.StateHijacked:
+		cc.open.Add(-1)
+		openConnections.Dec()
+	}
+}
+
+// drain stops srv from accepting new connections and lets in-flight requests,
+// streamed responses included, finish for up to timeout before forcibly
+// closing whatever is still open.
+func drain(srv *http.Server, conns *connCounter, timeout time.Duration) error {
+	log.Printf("draining connections for up to %s", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	log.Printf("drain timeout elapsed, force closing %d active connections", conns.open.Load())
+
+	return srv.Close()
+}
+
+// limitListener bounds the connections open on ln to MAX_CONNECTIONS.
+func limitListener(ln net.Listener, cfg *config) net.Listener {
+	if cfg.maxConnections <= 0 {
+		return ln
+	}
+
+	if cfg.connLimitMode == ConnLimitRefuse {
+		return &refusingListener{Listener: ln, sem: make(chan struct{}, cfg.maxConnections)}
+	}
+
+	return netutil.LimitListener(ln, cfg.maxConnections)
+}
+
+// refusingListener closes the connections accepted over its limit instead of
+// holding them back like netutil.LimitListener.
+type refusingListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *refusingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case l.sem <- struct{}{}:
+			return &limitedConn{Conn: conn, release: sync.OnceFunc(func() { <-l.sem })}, nil
+		default:
+			connectionsRefused.Inc()
+			_ = conn.Close()
+		}
+	}
+}
+
+// limitedConn gives its slot back once closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainLetsInFlightRequestsFinish(t *testing.T) {
+	started, shuttingDown := make(chan struct{}), make(chan struct{})
+
+	conns := &connCounter{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-shuttingDown
+		_, _ = w.Write([]byte("done"))
+	}))
+	srv.Config.ConnState = conns.track
+	srv.Config.RegisterOnShutdown(func() { close(shuttingDown) })
+	srv.Start()
+
+	defer srv.Close()
+
+	type result struct {
+		body string
+		err  error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			done <- result{err: err}
+
+			return
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		done <- result{body: string(b), err: err}
+	}()
+
+	<-started
+
+	if err := drain(srv.Config, conns, time.Second); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+
+	res := <-done
+	if res.err != nil || res.body != "done" {
+		t.Errorf("expected in-flight request to complete, got %q %v", res.body, res.err)
+	}
+
+	if n := conns.open.Load(); n != 0 {
+		t.Errorf("expected no open connections after drain, got %d", n)
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	conns := &connCounter{}
+	srv := httptest.NewUnstartedServer(promhttp.Handler())
+	srv.Config.ConnState = conns.track
+	srv.Start()
+
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("metrics request failed: %v", err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	for _, metric := range []string{"go_goroutines", "go_memstats_heap_alloc_bytes", "go_gc_duration_seconds", "cache_open_connections"} {
+		if !strings.Contains(string(body), "\n"+metric) {
+			t.Errorf("expected %s in the metrics", metric)
+		}
+	}
+
+	// The scrape itself holds a connection open.
+	var m dto.Metric
+	if err := openConnections.Write(&m); err != nil {
+		t.Fatalf("cannot read the connection gauge: %v", err)
+	}
+
+	if n := m.GetGauge().GetValue(); n < 1 || conns.open.Load() != 1 {
+		t.Errorf("expected the open connection counted, got %v and %d", n, conns.open.Load())
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	for _, mode := range []string{ConnLimitWait, ConnLimitRefuse} {
+		t.Run(mode, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("ok"))
+			}))
+			srv.Listener = limitListener(srv.Listener, &config{maxConnections: 1, connLimitMode: mode})
+			srv.Start()
+
+			defer srv.Close()
+
+			get := func(client *http.Client) error {
+				resp, err := client.Get(srv.URL)
+				if err != nil {
+					return err
+				}
+
+				_, _ = io.ReadAll(resp.Body)
+
+				return resp.Body.Close()
+			}
+
+			// The kept-alive connection of the first client holds the only
+			// slot.
+			first := &http.Client{Transport: &http.Transport{}}
+			if err := get(first); err != nil {
+				t.Fatalf("first request failed: %v", err)
+			}
+
+			var before dto.Metric
+			_ = connectionsRefused.Write(&before)
+
+			done := make(chan error, 1)
+
+			go func() {
+				done <- get(&http.Client{Transport: &http.Transport{DisableKeepAlives: true}})
+			}()
+
+			if mode == ConnLimitRefuse {
+				if err := <-done; err == nil {
+					t.Errorf("expected the connection over the limit to be refused")
+				}
+
+				var after dto.Metric
+				_ = connectionsRefused.Write(&after)
+
+				if after.GetCounter().GetValue() <= before.GetCounter().GetValue() {
+					t.Errorf("expected the refused connection to be counted")
+				}
+
+				return
+			}
+
+			select {
+			case err := <-done:
+				t.Fatalf("expected the connection over the limit to wait, got %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			first.CloseIdleConnections()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("expected the waiting request to succeed, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the waiting request to get the freed slot")
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upstreamStartKey holds when a request was handed to the reverse proxy.
+type upstreamStartKey struct{}
+
+// setServerTiming reports the cache decision and, for requests that went
+// upstream, how long the origin took to answer with headers. Entries the
+// origin sent itself are kept.
+func (cfg *config) setServerTiming(h http.Header, r *http.Request, xCacheValue string) {
+	if !cfg.serverTiming {
+		return
+	}
+
+	var metrics []string
+	if xCacheValue != "" {
+		metrics = append(metrics, "cache;desc="+strings.ToLower(xCacheValue))
+	}
+
+	if start, ok := r.Context().Value(upstreamStartKey{}).(time.Time); ok {
+		metrics = append(metrics, fmt.Sprintf("upstream;dur=%.1f", float64(time.Since(start))/float64(time.Millisecond)))
+	}
+
+	if len(metrics) > 0 {
+		h.Add("Server-Timing", strings.Join(metrics, ", "))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultShedRetryAfter is the Retry-After of shed requests unless
+// SHED_RETRY_AFTER says otherwise.
+const defaultShedRetryAfter = 5 * time.Second
+
+// shed answers a request the proxy turns away to shed load with 503, a
+// Retry-After and the error page of the client's Accept, counting it under
+// cause. wait is the Retry-After when known, such as the remaining backoff of
+// a rate limiting origin, SHED_RETRY_AFTER otherwise. page replaces the HTML
+// error page when set.
+func (cfg *config) shed(w http.ResponseWriter, r *http.Request, cause string, wait time.Duration, page []byte) {
+	shedRequests.WithLabelValues(cause).Inc()
+
+	if wait <= 0 {
+		wait = cfg.shedRetryAfter
+	}
+
+	if wait <= 0 {
+		wait = defaultShedRetryAfter
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+
+	if page == nil || prefersJSON(r.Header.Get("Accept")) {
+		cfg.writeError(w, r, http.StatusServiceUnavailable)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	cfg.applyAddHeaders(w.Header())
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	if _, err := w.Write(page); err != nil {
+		log.Printf("can't write to body %s", err)
+	}
+}
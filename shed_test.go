@@ -0,0 +1,78 @@
+package main
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShed(t *testing.T) {
+	cfg := &config{
+		shedRetryAfter: 10 * time.Second,
+		addHeaders:     http.Header{"X-Served-By": {"proxy-01"}},
+		addHeadersMode: AddHeadersModeSet,
+	}
+
+	tests := []struct {
+		name        string
+		accept      string
+		cause       string
+		wait        time.Duration
+		page        []byte
+		retryAfter  string
+		contentType string
+		body        string
+	}{
+		{"json", "application/json", ShedCauseFillLimit, 0, nil, "10", "application/json", `"status":503`},
+		{"html", "text/html", ShedCauseFillLimit, 0, nil, "10", "text/html; charset=utf-8", "503"},
+		{"origin backoff", "", ShedCauseBackoff, 1500 * time.Millisecond, nil, "2", "text/html; charset=utf-8", "503"},
+		{"page", "text/html", ShedCauseMaintenance, 0, []byte("down"), "10", "text/html; charset=utf-8", "down"},
+		{"page to json client", "application/json", ShedCauseMaintenance, 0, []byte("down"), "10", "application/json", `"status":503`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before dto.Metric
+			_ = shedRequests.WithLabelValues(tt.cause).Write(&before)
+
+			req := httptest.NewRequest(http.MethodGet, "/page", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			rec := httptest.NewRecorder()
+			cfg.shed(rec, req, tt.cause, tt.wait, tt.page)
+
+			if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != tt.retryAfter {
+				t.Errorf("expected 503 with Retry-After %s, got %d %q", tt.retryAfter, rec.Code, rec.Header().Get("Retry-After"))
+			}
+
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType || !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("expected %s body with %q, got %s %q", tt.contentType, tt.body, got, rec.Body.String())
+			}
+
+			if got := rec.Header().Get("X-Served-By"); got != "proxy-01" {
+				t.Errorf("expected ADD_HEADERS on the shed response, got %q", got)
+			}
+
+			var after dto.Metric
+			_ = shedRequests.WithLabelValues(tt.cause).Write(&after)
+
+			if after.GetCounter().GetValue() != before.GetCounter().GetValue()+1 {
+				t.Errorf("expected the request counted as shed for %s", tt.cause)
+			}
+		})
+	}
+}
+
+func TestShedDefaultRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&config{}).shed(rec, httptest.NewRequest(http.MethodGet, "/", nil), ShedCauseFillLimit, 0, nil)
+
+	if got := rec.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("expected the default Retry-After of 5 seconds, got %q", got)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// How a trailing slash in the path is treated in cache keys.
+// TrailingSlashKeep leaves paths as they are, TrailingSlashStrip removes it
+// and TrailingSlashAdd adds it to paths not naming a file.
+const (
+	TrailingSlashKeep  = "keep"
+	TrailingSlashStrip = "strip"
+	TrailingSlashAdd   = "add"
+)
+
+// slashed normalizes the trailing slash of the path in uri, so that /products
+// and /products/ share an entry. The root path, paths outside slashPaths when
+// given and, when adding, paths whose last segment has an extension, such as
+// /feed.json, are left alone.
+func (c *cache) slashed(uri string) string {
+	if c.trailingSlash == "" || c.trailingSlash == TrailingSlashKeep {
+		return uri
+	}
+
+	p, query, hasQuery := strings.Cut(uri, "?")
+	if p == "/" || !c.slashApplies(p) {
+		return uri
+	}
+
+	switch c.trailingSlash {
+	case TrailingSlashStrip:
+		p = strings.TrimSuffix(p, "/")
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(p, "/") && path.Ext(p) == "" {
+			p += "/"
+		}
+	}
+
+	if hasQuery {
+		return p + "?" + query
+	}
+
+	return p
+}
+
+func (c *cache) slashApplies(p string) bool {
+	if len(c.slashPaths) == 0 {
+		return true
+	}
+
+	for _, prefix := range c.slashPaths {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+)
+
+// slide moves the age of a freshly hit entry forward by slideFraction of its
+// TTL, so hot entries rarely expire. The age never passes now, nor lets the
+// entry outlive slideMax since it was fetched.
+func (c *cache) slide(key string, d cacheData) {
+	// Every fresh hit comes here, so with sliding off it must not contend
+	// for the write lock.
+	if c.currentLimits().slideFraction <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.slideFraction <= 0 {
+		return
+	}
+
+	// Someone else stored or slid the entry meanwhile.
+	cur, ok := c.data[key]
+	if !ok || !cur.age.Equal(d.age) {
+		return
+	}
+
+	if cur.created.IsZero() {
+		cur.created = cur.age
+	}
+
+	ttl := c.ttlForLocked(key, cur)
+	age := cur.age.Add(time.Duration(float64(ttl) * c.slideFraction))
+
+	if now := c.clock.Now(); age.After(now) {
+		age = now
+	}
+
+	if latest := cur.created.Add(c.slideMax - ttl); c.slideMax > 0 && age.After(latest) {
+		age = latest
+	}
+
+	if age.After(cur.age) {
+		cur.age = age
+		c.data[key] = cur
+	}
+}
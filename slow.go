@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// slowRequest is an upstream request and how long the origin took to send
+// the response headers.
+type slowRequest struct {
+	URI      string `json:"uri"`
+	Duration string `json:"duration"`
+
+	d time.Duration
+}
+
+// slowLog keeps the top slowest upstream requests of the current window and
+// of the one before, logging each window's as it ends.
+type slowLog struct {
+	top    int
+	window time.Duration
+
+	mu       sync.Mutex
+	current  []slowRequest
+	previous []slowRequest
+}
+
+func newSlowLog(top int, window time.Duration) *slowLog {
+	return &slowLog{top: top, window: window}
+}
+
+// record keeps the request when it is among the slowest of the window. A
+// window only holds top requests, so recording is cheap.
+func (s *slowLog) record(uri string, d time.Duration) {
+	if s == nil || s.top <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.current) == s.top && d <= s.current[len(s.current)-1].d {
+		return
+	}
+
+	i := sort.Search(len(s.current), func(i int) bool { return s.current[i].d < d })
+	s.current = append(s.current, slowRequest{})
+	copy(s.current[i+1:], s.current[i:])
+	s.current[i] = slowRequest{URI: uri, Duration: d.String(), d: d}
+
+	if len(s.current) > s.top {
+		s.current = s.current[:s.top]
+	}
+}
+
+// rotate ends the current window, logging its slowest requests.
+func (s *slowLog) rotate() {
+	s.mu.Lock()
+	ended := s.current
+	s.previous, s.current = ended, nil
+	s.mu.Unlock()
+
+	for _, r := range ended {
+		log.Printf("slow upstream request %s took %s", r.URI, r.Duration)
+	}
+}
+
+// start rotates the windows in the background.
+func (s *slowLog) start() {
+	if s == nil || s.top <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.window)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.rotate()
+		}
+	}()
+}
+
+// slowest returns the slowest requests of the last and the current window.
+func (s *slowLog) slowest() []slowRequest {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	all := append(append([]slowRequest(nil), s.previous...), s.current...)
+	s.mu.Unlock()
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].d > all[j].d })
+
+	return all[:min(s.top, len(all))]
+}
+
+// timedTransport records the duration of every upstream round trip.
+type timedTransport struct {
+	next  http.RoundTripper
+	slow  *slowLog
+	clock Clock
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := t.clock.Now()
+	res, err := t.next.RoundTrip(req)
+	t.slow.record(req.URL.RequestURI(), t.clock.Now().Sub(start))
+
+	return res, err
+}
+
+func (t *timedTransport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	s := newSlowLog(2, time.Minute)
+
+	s.record("/a", 10*time.Millisecond)
+	s.record("/b", 30*time.Millisecond)
+	s.record("/c", 20*time.Millisecond)
+	s.record("/d", 5*time.Millisecond)
+
+	if got := s.slowest(); len(got) != 2 || got[0].URI != "/b" || got[1].URI != "/c" {
+		t.Fatalf("expected /b then /c, got %+v", got)
+	}
+
+	s.rotate()
+	s.record("/e", 25*time.Millisecond)
+
+	if got := s.slowest(); len(got) != 2 || got[0].URI != "/b" || got[1].URI != "/e" {
+		t.Errorf("expected the last window kept along the current one, got %+v", got)
+	}
+
+	s.rotate()
+	s.rotate()
+
+	if got := s.slowest(); len(got) != 0 {
+		t.Errorf("expected older windows dropped, got %+v", got)
+	}
+}
+
+func TestSlowUpstreamRecorded(t *testing.T) {
+	clock := newFakeClock()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clock.advance(20 * time.Millisecond)
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	c := newCache(time.Hour)
+	c.clock = clock
+	c.slow = newSlowLog(10, time.Minute)
+
+	srv := httptest.NewServer(newProxy(backend.URL, c, &config{}).Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/slow?x=1")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	got := c.snapshot(0).SlowUpstream
+	if len(got) != 1 || got[0].URI != "/slow?x=1" || got[0].d != 20*time.Millisecond {
+		t.Errorf("expected /slow?x=1 reported, got %+v", got)
+	}
+}
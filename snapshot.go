@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// snapshotEntry is the portable form of an entry, one JSON object per line.
+// Keys are stored without the cache key prefix so a snapshot can seed an
+// instance using another one.
+type snapshotEntry struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Stored time.Time   `json:"stored"`
+	TTL    string      `json:"ttl"`
+}
+
+// export writes every entry to w. The lock is only held to collect them.
+func (c *cache) export(w io.Writer) (int, error) {
+	c.mu.RLock()
+	entries := make([]snapshotEntry, 0, len(c.data))
+
+	for key, d := range c.data {
+		entries = append(entries, snapshotEntry{
+			Key:    strings.TrimPrefix(key, c.keyPrefix),
+			Status: d.status,
+			Header: d.header,
+			Body:   d.body,
+			Stored: d.age,
+			TTL:    d.ttl.String(),
+		})
+	}
+	c.mu.RUnlock()
+
+	enc := json.NewEncoder(w)
+
+	for i, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return i, err
+		}
+	}
+
+	return len(entries), nil
+}
+
+// load stores the entries read from r, skipping those that expired since
+// they were exported.
+func (c *cache) load(r io.Reader) (imported, skipped int, err error) {
+	dec := json.NewDecoder(r)
+
+	for {
+		var e snapshotEntry
+
+		if err := dec.Decode(&e); errors.Is(err, io.EOF) {
+			return imported, skipped, nil
+		} else if err != nil {
+			return imported, skipped, err
+		}
+
+		ttl, err := time.ParseDuration(e.TTL)
+		if err != nil {
+			return imported, skipped, err
+		}
+
+		if e.Key == "" || c.isCacheStale(e.Stored, ttl) {
+			skipped++
+
+			continue
+		}
+
+		c.store(c.keyPrefix+e.Key, cacheData{
+			header: e.Header,
+			body:   e.Body,
+			age:    e.Stored,
+			ttl:    ttl,
+			status: e.Status,
+		})
+		imported++
+	}
+}
+
+// snapshotHandler exports the cache as JSON lines on GET and imports such a
+// snapshot on POST/PUT.
+func snapshotHandler(c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+
+			n, err := c.export(w)
+			if err != nil {
+				log.Printf("can't write to body %s", err)
+
+				return
+			}
+
+			log.Printf("exported %d cache entries", n)
+		case http.MethodPost, http.MethodPut:
+			imported, skipped, err := c.load(r.Body)
+			log.Printf("imported %d cache entries, skipped %d expired", imported, skipped)
+
+			if err != nil {
+				log.Printf("invalid cache snapshot %s", err)
+
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					cfg.writeError(w, r, http.StatusRequestEntityTooLarge)
+
+					return
+				}
+
+				cfg.writeError(w, r, http.StatusBadRequest)
+
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+
+			if err := json.NewEncoder(w).Encode(map[string]int{"imported": imported, "skipped": skipped}); err != nil {
+				log.Printf("can't write to body %s", err)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT")
+			cfg.writeError(w, r, http.StatusMethodNotAllowed)
+		}
+	}
+}
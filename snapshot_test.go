@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	src := newCache(time.Hour)
+	src.keyPrefix = "v1:"
+	src.store("v1:/fresh", cacheData{
+		header: http.Header{"Content-Type": {"text/plain"}},
+		body:   []byte("fresh"),
+		age:    time.Now().Add(-time.Minute),
+		ttl:    time.Hour,
+		status: http.StatusOK,
+	})
+	src.store("v1:/expired", cacheData{body: []byte("old"), age: time.Now().Add(-2 * time.Hour), ttl: time.Hour, status: http.StatusOK})
+
+	cfg := &config{adminSecret: "secret"}
+
+	do := func(c *cache, method string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/_cache/snapshot", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rec := httptest.NewRecorder()
+		adminOnly(cfg, snapshotHandler(c, cfg))(rec, req)
+
+		return rec
+	}
+
+	export := do(src, http.MethodGet, nil)
+	if export.Code != http.StatusOK || strings.Count(export.Body.String(), "\n") != 2 {
+		t.Fatalf("expected 2 exported lines, got %d %q", export.Code, export.Body.String())
+	}
+
+	dst := newCache(time.Hour)
+	if rec := do(dst, http.MethodPost, export.Body.Bytes()); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"skipped":1`) {
+		t.Fatalf("expected one skipped entry, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	d, ok := dst.data["/fresh"]
+	if !ok || string(d.body) != "fresh" || d.status != http.StatusOK || d.header.Get("Content-Type") != "text/plain" || d.ttl != time.Hour {
+		t.Errorf("expected the fresh entry with its metadata, got %v %+v", ok, d)
+	}
+
+	if _, ok := dst.data["/expired"]; ok {
+		t.Error("expected the expired entry to be skipped")
+	}
+
+	if rec := do(dst, http.MethodPost, []byte("{not json")); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid snapshot, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// staleOnError returns the entry to answer a GET with when the origin fails:
+// any entry stored at most staleIfError ago, however stale.
+func (c *cache) staleOnError(r *http.Request) (cacheData, bool) {
+	maxAge := c.currentLimits().staleIfError
+	if maxAge <= 0 || r.Method != http.MethodGet {
+		return cacheData{}, false
+	}
+
+	d, ok := c.lookup(c.key(r))
+	if !ok || c.since(d.age) > maxAge {
+		return cacheData{}, false
+	}
+
+	return d, true
+}
+
+// keepFor is how long cleanup keeps an entry with ttl after it went stale:
+// the grace period, or longer when it may still stand in for origin errors
+// or be served under load. Callers must hold c.mu.
+func (c *cache) keepFor(ttl time.Duration) time.Duration {
+	keep := max(c.grace, c.staleIfError-ttl)
+	if c.loadStaleThreshold > 0 {
+		keep = max(keep, c.loadStaleMaxAge)
+	}
+
+	return keep
+}
+
+// handleOriginError swaps a 5xx of the origin for the entry staleOnError
+// finds. It reports whether res was swapped.
+func handleOriginError(res *http.Response, c *cache) bool {
+	if res.StatusCode < http.StatusInternalServerError {
+		return false
+	}
+
+	d, ok := c.staleOnError(res.Request)
+	if !ok {
+		return false
+	}
+
+	log.Printf("origin answered %d for %s, serving stale", res.StatusCode, res.Request.URL.RequestURI())
+
+	_ = res.Body.Close()
+
+	res.StatusCode = d.status
+	res.Header = d.header.Clone()
+	res.Header.Set("X-Cache", XCacheStale)
+	res.Body = io.NopCloser(bytes.NewReader(d.body))
+	res.ContentLength = int64(len(d.body))
+
+	return true
+}
+
+// serveStaleOnError answers with the entry staleOnError finds when the
+// origin could not be reached, falling back to next.
+func serveStaleOnError(c *cache, cfg *config, next func(http.ResponseWriter, *http.Request, error)) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		d, ok := c.staleOnError(r)
+		if !ok {
+			next(w, r, err)
+
+			return
+		}
+
+		log.Printf("http: proxy error: %s, serving stale", err)
+		c.countRequest(XCacheStale)
+		d.hit()
+		c.writeToResponseCacheHit(w, r, c.negotiateEncoding(r, d, cfg), cfg, XCacheStale)
+	}
+}
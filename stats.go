@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTopKeys is how many of the most hit keys the stats endpoint lists.
+const defaultTopKeys = 10
+
+// cacheStats counts how requests were answered and why entries left. Unlike
+// the Prometheus metrics they are per cache, which the stats endpoint needs.
+type cacheStats struct {
+	requests  map[string]*atomic.Int64
+	evictions map[string]*atomic.Int64
+	flights   map[string]*atomic.Int64
+}
+
+func newCacheStats() *cacheStats {
+	s := &cacheStats{
+		requests:  make(map[string]*atomic.Int64),
+		evictions: make(map[string]*atomic.Int64),
+		flights:   make(map[string]*atomic.Int64),
+	}
+
+	for _, result := range []string{XCacheHit, XCacheMiss, XCacheRevalidated, XCacheStale} {
+		s.requests[result] = new(atomic.Int64)
+	}
+
+	for _, reason := range evictionReasons {
+		s.evictions[reason] = new(atomic.Int64)
+	}
+
+	for _, role := range flightRoles {
+		s.flights[role] = new(atomic.Int64)
+	}
+
+	return s
+}
+
+// countRequest records how a GET was answered, by its X-Cache value.
+func (c *cache) countRequest(xCacheValue string) {
+	if n, ok := c.stats.requests[xCacheValue]; ok {
+		n.Add(1)
+	}
+
+	cacheRequests.WithLabelValues(strings.ToLower(xCacheValue)).Inc()
+}
+
+// countFlight records the part a cacheable miss took in coalescing, one of
+// flightRoles.
+func (c *cache) countFlight(role string) {
+	if n, ok := c.stats.flights[role]; ok {
+		n.Add(1)
+	}
+
+	coalescedRequests.WithLabelValues(role).Inc()
+}
+
+// hit counts a hit on the entry, driving the top keys in the stats.
+func (d cacheData) hit() {
+	if d.hits != nil {
+		d.hits.Add(1)
+	}
+}
+
+type keyHits struct {
+	Key  string `json:"key"`
+	Hits int64  `json:"hits"`
+}
+
+type statsSnapshot struct {
+	Entries   int              `json:"entries"`
+	Bytes     int64            `json:"bytes"`
+	Requests  map[string]int64 `json:"requests"`
+	Evictions map[string]int64 `json:"evictions"`
+	Flights   map[string]int64 `json:"coalescing"`
+	Uptime    string           `json:"uptime"`
+	Config    map[string]any   `json:"config"`
+	TopKeys   []keyHits        `json:"top_keys"`
+	Warm      warmStatus       `json:"warm"`
+
+	SlowUpstream []slowRequest `json:"slow_upstream,omitempty"`
+}
+
+// snapshot collects the stats. The cache lock is only held to copy entry
+// counters, sorting happens after it is released.
+func (c *cache) snapshot(topN int) statsSnapshot {
+	s := statsSnapshot{
+		Requests:  make(map[string]int64),
+		Evictions: make(map[string]int64),
+		Flights:   make(map[string]int64),
+		Uptime:    time.Since(c.started).Round(time.Second).String(),
+		Warm:      c.warming.status(),
+
+		SlowUpstream: c.slow.slowest(),
+	}
+
+	for result, n := range c.stats.requests {
+		s.Requests[strings.ToLower(result)] = n.Load()
+	}
+
+	for reason, n := range c.stats.evictions {
+		s.Evictions[reason] = n.Load()
+	}
+
+	for role, n := range c.stats.flights {
+		s.Flights[role] = n.Load()
+	}
+
+	c.mu.RLock()
+	s.Entries = len(c.data)
+	s.Bytes = c.bytes
+	keys := make([]keyHits, 0, len(c.data))
+
+	for key, d := range c.data {
+		if d.hits != nil {
+			keys = append(keys, keyHits{Key: key, Hits: d.hits.Load()})
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Hits != keys[j].Hits {
+			return keys[i].Hits > keys[j].Hits
+		}
+
+		return keys[i].Key < keys[j].Key
+	})
+
+	s.TopKeys = keys[:min(topN, len(keys))]
+
+	return s
+}
+
+// summary lists the settings worth seeing in the stats, leaving out secrets.
+func (cfg *config) summary(c *cache) map[string]any {
+	lim := c.currentLimits()
+
+	return map[string]any{
+		"ttl":                lim.ttl.String(),
+		"stale_grace_period": lim.grace.String(),
+		"cache_key_prefix":   cfg.cacheKeyPrefix,
+		"encoding_mode":      cfg.encodingMode,
+		"admission_policy":   cfg.admissionPolicy,
+		"deduplicate_bodies": c.dedupBodies,
+		"maintenance":        c.maintenance.Load(),
+		"honor_pragma":       cfg.honorPragma,
+	}
+}
+
+// statsHandler serves a JSON snapshot of the cache, with the ?top= most hit
+// keys.
+func statsHandler(c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			cfg.writeError(w, r, http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		topN := defaultTopKeys
+
+		if v := r.URL.Query().Get("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				cfg.writeError(w, r, http.StatusBadRequest)
+
+				return
+			}
+
+			topN = n
+		}
+
+		s := c.snapshot(topN)
+		s.Config = cfg.summary(c)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(s); err != nil {
+			log.Printf("can't write to body %s", err)
+		}
+	}
+}
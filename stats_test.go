@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{adminSecret: "secret"}
+	proxyServer, c := newTestProxy(t, backend.URL, cfg)
+
+	for _, path := range []string{"/a", "/a", "/a", "/b", "/b"} {
+		resp, err := http.Get(proxyServer.URL + path)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_cache/stats?top=1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rec := httptest.NewRecorder()
+	adminOnly(cfg, statsHandler(c, cfg))(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var s statsSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if s.Entries != 2 || s.Bytes != 4 {
+		t.Errorf("expected 2 entries of 4 bytes, got %d entries of %d bytes", s.Entries, s.Bytes)
+	}
+
+	if s.Requests["hit"] != 3 || s.Requests["miss"] != 2 {
+		t.Errorf("expected 3 hits and 2 misses, got %v", s.Requests)
+	}
+
+	if len(s.TopKeys) != 1 || s.TopKeys[0] != (keyHits{Key: "/a", Hits: 2}) {
+		t.Errorf("expected /a with 2 hits on top, got %v", s.TopKeys)
+	}
+
+	rec = httptest.NewRecorder()
+	adminOnly(cfg, statsHandler(c, cfg))(rec, httptest.NewRequest(http.MethodGet, "/_cache/stats", nil))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the secret, got %d", rec.Code)
+	}
+}
+
+func TestSizeHistograms(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(make([]byte, 1000))
+	}))
+
+	defer backend.Close()
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{})
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(proxyServer.URL + "/sized")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	hits := &dto.Metric{}
+	if err := responseSize.WithLabelValues("hit").(prometheus.Histogram).Write(hits); err != nil {
+		t.Fatalf("cannot read histogram: %v", err)
+	}
+
+	if hits.Histogram.GetSampleCount() == 0 || hits.Histogram.GetSampleSum() < 1000 {
+		t.Errorf("expected the hit to be observed, got %d samples summing to %v", hits.Histogram.GetSampleCount(), hits.Histogram.GetSampleSum())
+	}
+}
+
+func TestSelftestHandler(t *testing.T) {
+	cfg := &config{adminSecret: "secret"}
+	c := newCache(time.Hour)
+
+	// A full pool, which the self-test entry must not push /kept out of.
+	c.pool.maxEntries = 1
+	c.store("/kept", cacheData{body: []byte("OK"), age: time.Now(), ttl: time.Hour})
+
+	req := httptest.NewRequest(http.MethodGet, "/_cache/selftest", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rec := httptest.NewRecorder()
+	adminOnly(cfg, selftestHandler(c, cfg))(rec, req)
+
+	var report selftestReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if rec.Code != http.StatusOK || report.Status != "ok" || report.ConfigHash == "" {
+		t.Errorf("expected a passing self-test, got %d %+v", rec.Code, report)
+	}
+
+	if _, ok := c.data["/kept"]; !ok || len(c.data) != 1 {
+		t.Errorf("expected only the existing entry left, got %d entries", len(c.data))
+	}
+
+	if c.pool.entries != 1 || c.bytes != 2 {
+		t.Errorf("expected the self-test left out of the accounting, got %d entries of %d bytes", c.pool.entries, c.bytes)
+	}
+
+	for reason, n := range c.stats.evictions {
+		if n.Load() != 0 {
+			t.Errorf("expected no eviction counted, got %d for %s", n.Load(), reason)
+		}
+	}
+}
+
+func TestEvictionReasonCounters(t *testing.T) {
+	evicted := func(reason string) float64 {
+		var m dto.Metric
+		if err := cacheEvictions.WithLabelValues(reason).Write(&m); err != nil {
+			t.Fatalf("cannot read the eviction counter: %v", err)
+		}
+
+		return m.GetCounter().GetValue()
+	}
+
+	reasons := []string{EvictionReasonTTL, EvictionReasonLRU, EvictionReasonPurge, EvictionReasonFlush}
+
+	before := make(map[string]float64)
+	for _, reason := range reasons {
+		before[reason] = evicted(reason)
+	}
+
+	c := newCache(time.Hour)
+	clock := newFakeClock()
+	c.clock = clock
+	c.pool.maxEntries = 2
+
+	for _, key := range []string{"/a", "/b", "/c"} {
+		c.store(key, cacheData{body: []byte(key), age: clock.Now(), ttl: time.Minute, status: http.StatusOK})
+	}
+
+	c.invalidate("/b")
+
+	clock.advance(2 * time.Hour)
+	c.cleanup()
+
+	c.store("/d", cacheData{body: []byte("/d"), age: clock.Now(), ttl: time.Minute, status: http.StatusOK})
+
+	if n := c.flush(); n != 1 || len(c.data) != 0 {
+		t.Errorf("expected the flush to evict the one entry left, got %d with %d left", n, len(c.data))
+	}
+
+	for _, reason := range reasons {
+		if got := evicted(reason) - before[reason]; got != 1 {
+			t.Errorf("expected one %s eviction on /metrics, got %v", reason, got)
+		}
+
+		if got := c.stats.evictions[reason].Load(); got != 1 {
+			t.Errorf("expected one %s eviction in the stats, got %d", reason, got)
+		}
+	}
+
+	if got := c.stats.evictions[EvictionReasonBytes].Load(); got != 0 {
+		t.Errorf("expected no bytes eviction, got %d", got)
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store is the second tier behind the in-memory cache. Entries the memory
+// tier evicts for room are demoted to it, and memory misses are looked up in
+// it before going to the origin.
+type Store interface {
+	Load(key string) (cacheData, bool)
+	Save(key string, d cacheData) error
+	Delete(key string)
+
+	// Entries lists the keys held with the age and TTL of their entries,
+	// without their header or body, so purges and cleanup can find them.
+	Entries() map[string]cacheData
+}
+
+// diskStore keeps one file per entry in a directory. Each file starts with
+// the CRC-32C of the rest, so entries corrupted on disk are discarded rather
+// than served. An index of the files is kept in memory, rebuilt from the
+// directory at start-up; file names are hashes, so keys can't be listed from
+// it otherwise.
+type diskStore struct {
+	dir string
+
+	// maxBytes bounds the bytes of the files held, zero meaning no bound.
+	// Over it the entries saved longest ago are removed first.
+	maxBytes int64
+
+	// precompress keeps gzip and Brotli siblings of the identity bodies
+	// worth compressing, see compressSiblings. uncompressed are the Content-Type
+	// prefixes left alone.
+	precompress  bool
+	uncompressed []string
+
+	mu    sync.Mutex
+	index map[string]diskMeta
+	order *lruList
+	bytes int64
+}
+
+// diskMeta is what the index of a disk store knows about an entry. The
+// header and status are only kept for entries with siblings, which are served
+// from them without reading the entry file.
+type diskMeta struct {
+	size int64
+	age  time.Time
+	ttl  time.Duration
+
+	header      http.Header
+	status      int
+	forcedStale bool
+	encodings   []string
+
+	// sums holds the CRC-32C of each sibling by coding, checked again each
+	// time one is served.
+	sums map[string]uint32
+
+	// hits counts the hits of the entry, carried over from memory when it is
+	// demoted and back when it is promoted.
+	hits *atomic.Int64
+}
+
+// diskEntry is the on-disk form of an entry. The key is kept to tell hash
+// collisions apart.
+type diskEntry struct {
+	Key    string
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+	TTL    time.Duration
+	Status int
+
+	ForcedStale bool
+
+	// Encodings holds the CRC-32C of each sibling file by coding.
+	Encodings map[string]uint32
+
+	// Source is the request the entry was fetched for, if known.
+	Source *diskSource
+}
+
+// diskSource is the on-disk form of a fetchSource.
+type diskSource struct {
+	URI    string
+	Host   string
+	Header http.Header
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func newDiskStore(dir string, maxBytes int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &diskStore{dir: dir, maxBytes: maxBytes, index: make(map[string]diskMeta), order: newLRU()}
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.trimLocked()
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+// scan indexes the entries left in the directory by an earlier run, oldest
+// first, and removes the temporary files of interrupted saves and the files
+// that fail their checksum.
+func (s *diskStore) scan() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	type found struct {
+		key  string
+		meta diskMeta
+	}
+
+	var entries []found
+
+	claimed := make(map[string]bool)
+
+	for _, f := range files {
+		name := filepath.Join(s.dir, f.Name())
+
+		if strings.HasPrefix(f.Name(), ".tmp-") {
+			_ = os.Remove(name)
+
+			continue
+		}
+
+		// Siblings are checked along with the entry they belong to.
+		if f.IsDir() || isSiblingFile(name) {
+			continue
+		}
+
+		b, err := os.ReadFile(name)
+		if err != nil {
+			log.Printf("cannot read disk cache file %s %s", name, err)
+
+			continue
+		}
+
+		e, ok := decodeDiskEntry(b)
+		if !ok || s.path(e.Key) != name {
+			log.Printf("disk cache file %s is unreadable, discarding", name)
+			_ = os.Remove(name)
+
+			continue
+		}
+
+		m := diskMeta{size: int64(len(b)), age: e.Stored, ttl: e.TTL, sums: make(map[string]uint32), hits: new(atomic.Int64)}
+		for _, sibling := range s.scanSiblings(name, e, &m) {
+			claimed[sibling] = true
+		}
+
+		entries = append(entries, found{e.Key, m})
+	}
+
+	s.removeOrphanSiblings(files, claimed)
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].meta.age.Before(entries[j].meta.age) })
+
+	for _, e := range entries {
+		s.index[e.key] = e.meta
+		s.order.add(e.key)
+		s.bytes += e.meta.size
+	}
+
+	return nil
+}
+
+// decodeDiskEntry checks the checksum of the contents of an entry file and
+// decodes it.
+func decodeDiskEntry(b []byte) (diskEntry, bool) {
+	var e diskEntry
+
+	if len(b) < crc32.Size || binary.BigEndian.Uint32(b) != crc32.Checksum(b[crc32.Size:], castagnoli) {
+		return e, false
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(b[crc32.Size:])).Decode(&e); err != nil {
+		return e, false
+	}
+
+	return e, true
+}
+
+func (s *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *diskStore) Load(key string) (cacheData, bool) {
+	b, err := os.ReadFile(s.path(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("cannot read disk cache entry %s %s", key, err)
+		}
+
+		return cacheData{}, false
+	}
+
+	e, ok := decodeDiskEntry(b)
+	if !ok {
+		log.Printf("disk cache entry %s failed its checksum, discarding", key)
+		s.Delete(key)
+
+		return cacheData{}, false
+	}
+
+	if e.Key != key {
+		return cacheData{}, false
+	}
+
+	d := cacheData{header: e.Header, body: e.Body, age: e.Stored, ttl: e.TTL, status: e.Status, forcedStale: e.ForcedStale}
+
+	s.mu.Lock()
+	d.hits = s.index[key].hits
+	s.mu.Unlock()
+
+	if e.Source != nil {
+		d.source = &fetchSource{uri: e.Source.URI, host: e.Source.Host, header: e.Source.Header}
+	}
+
+	return d, true
+}
+
+// Save writes the entry to a temporary file first, so readers never see a
+// partial one. An entry larger than the whole bound is not kept.
+func (s *diskStore) Save(key string, d cacheData) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, crc32.Size))
+
+	siblings := s.compressSiblings(key, d)
+
+	e := diskEntry{
+		Key:    key,
+		Header: d.header,
+		Body:   d.body,
+		Stored: d.age,
+		TTL:    d.ttl,
+		Status: d.status,
+
+		ForcedStale: d.forcedStale,
+	}
+
+	if d.source != nil {
+		e.Source = &diskSource{URI: d.source.uri, Host: d.source.host, Header: d.source.header}
+	}
+
+	for coding, body := range siblings {
+		if e.Encodings == nil {
+			e.Encodings = make(map[string]uint32)
+		}
+
+		e.Encodings[coding] = crc32.Checksum(body, castagnoli)
+	}
+
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return err
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, crc32.Checksum(b[crc32.Size:], castagnoli))
+
+	m := diskMeta{size: int64(len(b)), age: d.age, ttl: d.ttl, sums: e.Encodings, hits: d.hits}
+	if m.hits == nil {
+		m.hits = new(atomic.Int64)
+	}
+
+	for coding, body := range siblings {
+		m.size += int64(len(body))
+		m.encodings = append(m.encodings, coding)
+	}
+
+	if len(m.encodings) > 0 {
+		sort.Strings(m.encodings)
+		m.header, m.status, m.forcedStale = d.header, d.status, d.forcedStale
+	}
+
+	if s.maxBytes > 0 && m.size > s.maxBytes {
+		s.Delete(key)
+
+		return nil
+	}
+
+	tmp, err := s.writeTemp(b)
+	if err != nil {
+		return err
+	}
+
+	tmps := make(map[string]string, len(siblings))
+	removeTemps := func() {
+		_ = os.Remove(tmp)
+
+		for _, name := range tmps {
+			_ = os.Remove(name)
+		}
+	}
+
+	for coding, body := range siblings {
+		name, err := s.writeTemp(body)
+		if err != nil {
+			removeTemps()
+
+			return err
+		}
+
+		tmps[coding] = name
+	}
+
+	s.mu.Lock()
+
+	// Siblings of an earlier version of the entry must not outlive it.
+	s.removeSiblingsLocked(key, s.index[key].encodings)
+
+	// Renamed under the lock, so the index never lists a file a concurrent
+	// Delete removed. Siblings go first so no entry claims a missing one.
+	for coding, name := range tmps {
+		if err := os.Rename(name, s.siblingPath(key, coding)); err != nil {
+			s.mu.Unlock()
+			removeTemps()
+
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, s.path(key)); err != nil {
+		s.removeSiblingsLocked(key, m.encodings)
+		s.mu.Unlock()
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	s.bytes -= s.index[key].size
+	s.index[key] = m
+	s.bytes += m.size
+	s.order.add(key)
+	s.trimLocked()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// writeTemp writes b to a temporary file of the store, so readers never see
+// a partial file once it is renamed, and returns its name.
+func (s *diskStore) writeTemp(b []byte) (string, error) {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// trimLocked removes the entries saved longest ago while the store holds
+// more than maxBytes. Callers must hold s.mu.
+func (s *diskStore) trimLocked() {
+	for s.maxBytes > 0 && s.bytes > s.maxBytes {
+		key, ok := s.order.oldest()
+		if !ok {
+			break
+		}
+
+		s.deleteLocked(key)
+	}
+}
+
+func (s *diskStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteLocked(key)
+}
+
+func (s *diskStore) deleteLocked(key string) {
+	s.removeSiblingsLocked(key, s.index[key].encodings)
+	s.bytes -= s.index[key].size
+	delete(s.index, key)
+	s.order.remove(key)
+
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("cannot delete disk cache entry %s %s", key, err)
+	}
+}
+
+func (s *diskStore) Entries() map[string]cacheData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make(map[string]cacheData, len(s.index))
+	for key, m := range s.index {
+		entries[key] = cacheData{age: m.age, ttl: m.ttl}
+	}
+
+	return entries
+}
+
+// purgeDisk removes the entries of the disk tier whose key matches and
+// reports how many. It runs without the cache lock, files being removed one
+// by one.
+func (c *cache) purgeDisk(match func(key string) bool) int {
+	if c.l2 == nil {
+		return 0
+	}
+
+	n := 0
+
+	for key := range c.l2.Entries() {
+		if match(key) {
+			c.l2.Delete(key)
+			n++
+		}
+	}
+
+	return n
+}
+
+// cleanupDisk removes the entries of the disk tier that cleanup would have
+// deleted from memory, so they don't wait for a lookup to go.
+func (c *cache) cleanupDisk() {
+	if c.l2 == nil {
+		return
+	}
+
+	entries := c.l2.Entries()
+
+	var deleted []string
+
+	c.mu.RLock()
+	for key, d := range entries {
+		if ttl := c.ttlForLocked(key, d); c.isCacheDeletable(d.age, ttl, c.keepFor(ttl)) {
+			deleted = append(deleted, key)
+		}
+	}
+	c.mu.RUnlock()
+
+	for _, key := range deleted {
+		c.l2.Delete(key)
+		log.Printf("deleted disk cache with key: %s", key)
+	}
+}
+
+// lookup returns the entry of key from memory, or promotes it from the second
+// tier when memory misses.
+func (c *cache) lookup(key string) (cacheData, bool) {
+	c.mu.RLock()
+	d, ok := c.data[key]
+	if ok {
+		c.touchVariant(key)
+	}
+	c.mu.RUnlock()
+
+	if ok {
+		if ns := c.namespaceFor(key); ns.bounded() {
+			ns.lru.touch(key)
+		}
+
+		return d, true
+	}
+
+	if c.l2 == nil {
+		return cacheData{}, false
+	}
+
+	d, ok = c.l2.Load(key)
+	if !ok {
+		return cacheData{}, false
+	}
+
+	c.l2.Delete(key)
+
+	c.mu.RLock()
+	ttl := c.ttlForLocked(key, d)
+	expired := c.isCacheDeletable(d.age, ttl, c.keepFor(ttl))
+	c.mu.RUnlock()
+
+	if expired {
+		return cacheData{}, false
+	}
+
+	c.store(key, d)
+
+	c.mu.RLock()
+	d, ok = c.data[key]
+	c.mu.RUnlock()
+
+	return d, ok
+}
+
+// shrink evicts the least recently used entries of ns while it exceeds its
+// quota, returning them for demotion. Callers must hold c.mu for writing.
+func (c *cache) shrink(ns *namespace) map[string]cacheData {
+	var demoted map[string]cacheData
+
+	for {
+		reason, over := ns.overQuota()
+		if !over {
+			break
+		}
+
+		key, ok := ns.lru.oldest()
+		if !ok {
+			break
+		}
+
+		if d, ok := c.data[key]; ok && c.l2 != nil {
+			if demoted == nil {
+				demoted = make(map[string]cacheData)
+			}
+
+			demoted[key] = d
+		}
+
+		c.evict(key, reason)
+	}
+
+	return demoted
+}
+
+// demote hands evicted entries to the second tier, outside of the cache lock.
+func (c *cache) demote(entries map[string]cacheData) {
+	for key, d := range entries {
+		if err := c.l2.Save(key, d); err != nil {
+			log.Printf("cannot demote %s to disk %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestTieredStore(t *testing.T) {
+	s, err := newDiskStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("cannot create disk store: %v", err)
+	}
+
+	c := newCache(time.Hour)
+	c.pool.maxEntries = 2
+	c.l2 = s
+
+	for _, key := range []string{"/a", "/b", "/c"} {
+		c.store(key, cacheData{body: []byte(key), age: time.Now(), ttl: time.Hour, status: 200})
+	}
+
+	if _, ok := c.data["/a"]; ok || len(c.data) != 2 {
+		t.Fatalf("expected /a to leave memory, got %d entries", len(c.data))
+	}
+
+	if _, ok := s.Load("/a"); !ok {
+		t.Fatal("expected /a to be demoted to disk")
+	}
+
+	d, ok := c.lookup("/a")
+	if !ok || string(d.body) != "/a" || d.status != 200 {
+		t.Fatalf("expected /a to be promoted from disk, got %v %q", ok, d.body)
+	}
+
+	if _, ok := s.Load("/a"); ok {
+		t.Error("expected the promoted entry to leave the disk")
+	}
+
+	// /b was the least recently used when /a came back.
+	if _, ok := c.data["/b"]; ok {
+		t.Error("expected /b to be demoted")
+	}
+
+	c.mu.Lock()
+	c.evict("/c", EvictionReasonPurge)
+	c.mu.Unlock()
+
+	if _, ok := c.lookup("/c"); ok {
+		t.Error("expected a purged entry to be gone from both tiers")
+	}
+
+	if _, ok := c.lookup("/b"); !ok {
+		t.Error("expected /b to be found on disk")
+	}
+
+	if _, ok := c.lookup("/missing"); ok {
+		t.Error("expected a miss in both tiers")
+	}
+}
+
+func TestTieredStoreDropsExpired(t *testing.T) {
+	s, err := newDiskStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("cannot create disk store: %v", err)
+	}
+
+	c := newCache(time.Hour)
+	c.l2 = s
+
+	if err := s.Save("/old", cacheData{body: []byte("old"), age: time.Now().Add(-2 * time.Hour), ttl: time.Hour}); err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+
+	if _, ok := c.lookup("/old"); ok {
+		t.Error("expected an expired disk entry to miss")
+	}
+
+	if _, ok := s.Load("/old"); ok {
+		t.Error("expected the expired disk entry to be deleted")
+	}
+}
+
+func TestDiskStoreChecksum(t *testing.T) {
+	s, err := newDiskStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("cannot create disk store: %v", err)
+	}
+
+	if err := s.Save("/a", cacheData{body: []byte("payload"), age: time.Now(), ttl: time.Hour, status: 200}); err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+
+	if d, ok := s.Load("/a"); !ok || string(d.body) != "payload" {
+		t.Fatalf("expected the entry back, got %v %q", ok, d.body)
+	}
+
+	b, err := os.ReadFile(s.path("/a"))
+	if err != nil {
+		t.Fatalf("cannot read entry: %v", err)
+	}
+
+	// Flip a byte of the body.
+	i := bytes.Index(b, []byte("payload"))
+	b[i] ^= 0xff
+
+	if err := os.WriteFile(s.path("/a"), b, 0o600); err != nil {
+		t.Fatalf("cannot corrupt entry: %v", err)
+	}
+
+	if _, ok := s.Load("/a"); ok {
+		t.Error("expected the corrupted entry discarded")
+	}
+
+	if _, err := os.Stat(s.path("/a")); !os.IsNotExist(err) {
+		t.Errorf("expected the corrupted file deleted, got %v", err)
+	}
+}
+
+func TestDiskStoreIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("cannot create disk store: %v", err)
+	}
+
+	for _, key := range []string{"/a", "/b", "/c"} {
+		if err := s.Save(key, cacheData{body: bytes.Repeat([]byte("x"), 100), age: time.Now(), ttl: time.Hour}); err != nil {
+			t.Fatalf("cannot save %s: %v", key, err)
+		}
+	}
+
+	size := s.bytes / 3
+
+	// Reopened with room for two entries, the oldest goes.
+	s, err = newDiskStore(dir, 2*size)
+	if err != nil {
+		t.Fatalf("cannot reopen disk store: %v", err)
+	}
+
+	if entries := s.Entries(); len(entries) != 2 || s.bytes != 2*size {
+		t.Fatalf("expected 2 entries indexed, got %d in %d bytes", len(entries), s.bytes)
+	}
+
+	if _, ok := s.Load("/a"); ok {
+		t.Error("expected the oldest entry removed over DISK_CACHE_MAX_BYTES")
+	}
+
+	if err := s.Save("/d", cacheData{body: bytes.Repeat([]byte("x"), 100), age: time.Now(), ttl: time.Hour}); err != nil {
+		t.Fatalf("cannot save /d: %v", err)
+	}
+
+	if _, ok := s.Load("/b"); ok {
+		t.Error("expected /b removed to make room for /d")
+	}
+
+	if _, ok := s.Load("/d"); !ok {
+		t.Error("expected /d on disk")
+	}
+
+	if err := s.Save("/huge", cacheData{body: bytes.Repeat([]byte("x"), 1000), age: time.Now(), ttl: time.Hour}); err != nil {
+		t.Fatalf("cannot save /huge: %v", err)
+	}
+
+	if _, ok := s.Entries()["/huge"]; ok || len(s.Entries()) != 2 {
+		t.Errorf("expected an entry over the bound not kept, got %d entries", len(s.Entries()))
+	}
+}
+
+func TestDiskTierPurgesAndCleanup(t *testing.T) {
+	s, err := newDiskStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("cannot create disk store: %v", err)
+	}
+
+	c := newCache(time.Hour)
+	c.l2 = s
+
+	save := func(key string, age time.Time) {
+		if err := s.Save(key, cacheData{body: []byte(key), age: age, ttl: time.Hour, status: 200}); err != nil {
+			t.Fatalf("cannot save %s: %v", key, err)
+		}
+	}
+
+	save("/a?page=2", time.Now())
+	save("/a#segment=1", time.Now())
+	save("/old", time.Now().Add(-2*time.Hour))
+	save("/products/1", time.Now())
+	save("@img.example.com/logo.png", time.Now())
+
+	if n := c.invalidate("/a"); n != 2 {
+		t.Errorf("expected the query and segment entries of /a purged from disk, got %d", n)
+	}
+
+	c.cleanup()
+
+	if _, ok := s.Entries()["/old"]; ok {
+		t.Error("expected cleanup to delete the expired entry on disk")
+	}
+
+	if n, _ := c.purgeRegex(context.Background(), regexp.MustCompile(`^/products/`), false); n != 1 {
+		t.Errorf("expected the regex purge to match on disk, got %d", n)
+	}
+
+	if n := c.purgeUpstream("@img.example.com"); n != 1 {
+		t.Errorf("expected the upstream purge to reach the disk, got %d", n)
+	}
+
+	if entries := s.Entries(); len(entries) != 0 {
+		t.Errorf("expected nothing left on disk, got %v", entries)
+	}
+}
+
+func TestDiskStorePrecompressedSiblings(t *testing.T) {
+	var fetches atomic.Int32
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_, _ = w.Write([]byte("origin"))
+	}))
+
+	defer backend.Close()
+
+	dir := t.TempDir()
+
+	s, err := newDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("cannot create disk store: %v", err)
+	}
+
+	s.precompress = true
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.l2 = s
+
+	body := strings.Repeat("precompressed ", 100)
+	d := cacheData{header: http.Header{"Content-Type": {"text/plain"}}, body: []byte(body), age: time.Now(), ttl: time.Hour, status: http.StatusOK}
+
+	if err := s.Save("/test", d); err != nil {
+		t.Fatalf("cannot save: %v", err)
+	}
+
+	get := func(acceptEncoding string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		// Set explicitly, so the client leaves gzip bodies as they are.
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	decode := map[string]func(string) string{
+		"br": func(b string) string {
+			out, _ := io.ReadAll(brotli.NewReader(strings.NewReader(b)))
+
+			return string(out)
+		},
+		"gzip": func(b string) string {
+			out, _ := gunzipBytes([]byte(b))
+
+			return string(out)
+		},
+	}
+
+	for acceptEncoding, want := range map[string]string{"gzip, br": "br", "gzip": "gzip", "br;q=0.5, gzip": "gzip"} {
+		resp, b := get(acceptEncoding)
+
+		if got := resp.Header.Get("Content-Encoding"); got != want || resp.Header.Get("X-Cache") != XCacheHit {
+			t.Errorf("%q: expected a %s hit, got %q %q", acceptEncoding, want, got, resp.Header.Get("X-Cache"))
+
+			continue
+		}
+
+		if decode[want](b) != body {
+			t.Errorf("%q: expected the %s sibling of the body", acceptEncoding, want)
+		}
+	}
+
+	if _, ok := c.data["/test"]; ok || fetches.Load() != 0 {
+		t.Errorf("expected the siblings to be served from disk, got %d fetches", fetches.Load())
+	}
+
+	// Reopened with the Brotli sibling corrupted and an orphan left over.
+	if err := os.WriteFile(s.siblingPath("/test", "br"), []byte("bogus"), 0o600); err != nil {
+		t.Fatalf("cannot corrupt sibling: %v", err)
+	}
+
+	orphan := s.siblingPath("/orphan", "gzip")
+	if err := os.WriteFile(orphan, []byte("orphan"), 0o600); err != nil {
+		t.Fatalf("cannot write orphan: %v", err)
+	}
+
+	s, err = newDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("cannot reopen disk store: %v", err)
+	}
+
+	c.l2 = s
+
+	if _, err := os.Stat(orphan); err == nil {
+		t.Error("expected the orphan sibling to be removed")
+	}
+
+	if resp, _ := get("br, gzip"); resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected the corrupted sibling to be dropped, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	// Clients without a coding get the identity copy.
+	if resp, b := get("identity"); resp.Header.Get("Content-Encoding") != "" || b != body {
+		t.Errorf("expected the identity body, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	if _, err := os.Stat(s.siblingPath("/test", "gzip")); err == nil {
+		t.Error("expected the siblings to leave with the promoted entry")
+	}
+}
+
+func TestPrecompressedSiblingCheckedOnServe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("origin"))
+	}))
+
+	defer backend.Close()
+
+	s, err := newDiskStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("cannot create disk store: %v", err)
+	}
+
+	s.precompress = true
+
+	proxyServer, c := newTestProxy(t, backend.URL, &config{})
+	c.l2 = s
+
+	body := strings.Repeat("precompressed ", 100)
+	for _, key := range []string{"/a", "/b"} {
+		d := cacheData{header: http.Header{"Content-Type": {"text/plain"}}, body: []byte(body), age: time.Now(), ttl: time.Hour, status: http.StatusOK}
+		if err := s.Save(key, d); err != nil {
+			t.Fatalf("cannot save: %v", err)
+		}
+	}
+
+	get := func(path string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return resp, string(b)
+	}
+
+	// A sibling hit counts as a use of the entry, moving /a past /b.
+	if resp, _ := get("/a"); resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip sibling hit, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	if n := s.index["/a"].hits.Load(); n != 1 {
+		t.Errorf("expected the sibling hit to be counted, got %d", n)
+	}
+
+	if key, _ := s.order.oldest(); key != "/b" {
+		t.Errorf("expected /b to be the oldest entry, got %q", key)
+	}
+
+	// A sibling corrupted since start-up is dropped before anything is sent.
+	if err := os.WriteFile(s.siblingPath("/b", "gzip"), []byte("bogus"), 0o600); err != nil {
+		t.Fatalf("cannot corrupt sibling: %v", err)
+	}
+
+	resp, b := get("/b")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != XCacheHit {
+		t.Fatalf("expected a hit from the identity copy, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		out, _ := gunzipBytes([]byte(b))
+		b = string(out)
+	}
+
+	if b != body {
+		t.Error("expected the body of the identity copy")
+	}
+
+	if _, err := os.Stat(s.siblingPath("/b", "gzip")); err == nil {
+		t.Error("expected the corrupted sibling to be removed")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceparentIsPropagated(t *testing.T) {
+	if _, err := setupTracing(""); err != nil {
+		t.Fatalf("failed to set up tracing: %v", err)
+	}
+
+	var traceparent string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{}
+	c := newCache(time.Hour)
+	rp := newReverseProxy(backend.URL, cfg)
+	handleMissedCache(rp, c, cfg)
+
+	proxyServer := httptest.NewServer(traced(cacheHandler(rp, c, cfg)))
+
+	defer proxyServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if !strings.Contains(traceparent, traceID) {
+		t.Errorf("expected origin to continue trace %s, got traceparent %q", traceID, traceparent)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newTransport returns the transport used to reach the origin, a clone of
+// http.DefaultTransport carrying the upstream TLS settings and timeouts.
+func newTransport(cfg *config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.upstreamDialTimeout > 0 {
+		t.DialContext = (&net.Dialer{Timeout: cfg.upstreamDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+
+	t.ResponseHeaderTimeout = cfg.upstreamHeaderTimeout
+
+	// Left on, the transport would decode the gzip it asked for itself
+	// and drop Content-Encoding before the body could be cached.
+	t.DisableCompression = cfg.upstreamCompression
+
+	if cfg.upstreamTLS != nil {
+		t.TLSClientConfig = cfg.upstreamTLS.Clone()
+	}
+
+	if cfg.upstreamInsecureSkipVerify {
+		log.Println("WARNING: UPSTREAM_INSECURE_SKIP_VERIFY is enabled, origin TLS certificates are NOT verified. Never use this in production.")
+
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	return t
+}
+
+// closeIdler is implemented by the transports keeping upstream connections,
+// and forwarded by the round trippers wrapping them.
+type closeIdler interface {
+	CloseIdleConnections()
+}
+
+func closeIdleConnections(rt http.RoundTripper) {
+	if t, ok := rt.(closeIdler); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// loadUpstreamTLS builds the TLS config for mutual TLS with the origin. It
+// returns nil when neither a client certificate nor a CA is configured.
+func loadUpstreamTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load upstream client certificate: %w", err)
+		}
+
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read upstream CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream CA %s", caFile)
+		}
+
+		tc.RootCAs = pool
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to dir.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cache-proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	return cert, certFile, keyFile
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.StartTLS()
+
+	defer backend.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	serverCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+
+	if err := os.WriteFile(caFile, serverCert, 0o600); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+
+	tc, err := loadUpstreamTLS(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("failed to load upstream TLS: %v", err)
+	}
+
+	proxyServer, _ := newTestProxy(t, backend.URL, &config{upstreamTLS: tc})
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected origin to accept the client certificate, got %d", resp.StatusCode)
+	}
+}
+
+func TestUpstreamInsecureSkipVerify(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	for _, insecure := range []bool{false, true} {
+		proxyServer, _ := newTestProxy(t, backend.URL, &config{upstreamInsecureSkipVerify: insecure})
+
+		resp, err := http.Get(proxyServer.URL + "/test")
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if ok := resp.StatusCode == http.StatusOK; ok != insecure {
+			t.Errorf("insecure=%t: unexpected status %d", insecure, resp.StatusCode)
+		}
+	}
+}
+
+func TestUpstreamHeaderTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+
+		_, _ = w.Write([]byte("slow"))
+	}))
+
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		headerTimeout time.Duration
+		status        int
+	}{
+		{100 * time.Millisecond, http.StatusBadGateway},
+		{2 * time.Second, http.StatusOK},
+	} {
+		c := newCache(time.Hour)
+
+		srv := httptest.NewUnstartedServer(newProxy(backend.URL, c, &config{upstreamHeaderTimeout: tt.headerTimeout}).Handler())
+		srv.Config.WriteTimeout = time.Second
+		srv.Start()
+
+		start := time.Now()
+
+		resp, err := http.Get(srv.URL + "/slow")
+		if err != nil {
+			t.Fatalf("header timeout %s: proxy request failed: %v", tt.headerTimeout, err)
+		}
+
+		_ = resp.Body.Close()
+		srv.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("header timeout %s: expected %d, got %d", tt.headerTimeout, tt.status, resp.StatusCode)
+		}
+
+		if elapsed := time.Since(start); tt.status == http.StatusBadGateway && elapsed > 250*time.Millisecond {
+			t.Errorf("expected the origin wait to end at the header timeout, took %s", elapsed)
+		}
+	}
+}
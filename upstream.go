@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// upstreamRoute sends the requests for host, or under the path prefix, to
+// target instead of the default origin. A host of the form *.example.com
+// matches every subdomain. A non-zero ttl replaces the default TTL of the
+// entries it fills.
+type upstreamRoute struct {
+	host   string
+	prefix string
+	target *url.URL
+	ttl    time.Duration
+}
+
+type upstreamKey struct{}
+
+// upstreamFor resolves the route of r: exact host routes first, then the
+// longest matching wildcard host, then the longest matching path prefix. It
+// returns nil for the default origin.
+func (cfg *config) upstreamFor(r *http.Request) *upstreamRoute {
+	var wildcard, prefix *upstreamRoute
+
+	for i, route := range cfg.upstreams {
+		switch {
+		case route.host == "":
+			if strings.HasPrefix(r.URL.Path, route.prefix) && (prefix == nil || len(route.prefix) > len(prefix.prefix)) {
+				prefix = &cfg.upstreams[i]
+			}
+		case strings.HasPrefix(route.host, "*."):
+			if matchesWildcard(route.host, r.Host) && (wildcard == nil || len(route.host) > len(wildcard.host)) {
+				wildcard = &cfg.upstreams[i]
+			}
+		case strings.EqualFold(route.host, r.Host) || strings.EqualFold(route.host, hostname(r.Host)):
+			return &cfg.upstreams[i]
+		}
+	}
+
+	if wildcard != nil {
+		return wildcard
+	}
+
+	return prefix
+}
+
+// matchesWildcard reports whether host, with or without its port, is a
+// subdomain of the *.domain pattern. The domain itself does not match.
+func matchesWildcard(pattern, host string) bool {
+	suffix := strings.ToLower(pattern[1:])
+
+	for _, h := range []string{host, hostname(host)} {
+		if h = strings.ToLower(h); len(h) > len(suffix) && strings.HasSuffix(h, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostname strips the port from a Host header value.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return host
+}
+
+// routeRequest records the route of r in its context, where the director and
+// the cache key read it from, also on the outgoing request.
+func routeRequest(r *http.Request, cfg *config) *http.Request {
+	if route := cfg.upstreamFor(r); route != nil {
+		return r.WithContext(context.WithValue(r.Context(), upstreamKey{}, route))
+	}
+
+	return r
+}
+
+func upstreamFrom(ctx context.Context) *upstreamRoute {
+	route, _ := ctx.Value(upstreamKey{}).(*upstreamRoute)
+
+	return route
+}
+
+// upstreamPartition is the part of the cache key naming the upstream, empty
+// for the default origin. Routes to the same origin share a partition.
+func upstreamPartition(ctx context.Context) string {
+	if route := upstreamFrom(ctx); route != nil {
+		return "@" + route.target.Host
+	}
+
+	return ""
+}
+
+// splitPartition separates the upstream partition from the request URI in a
+// key without the cache key prefix.
+func splitPartition(key string) (partition, uri string) {
+	if !strings.HasPrefix(key, "@") {
+		return "", key
+	}
+
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i], key[i:]
+	}
+
+	return key, ""
+}
+
+// upstreamByPartition finds a route to the upstream of a partition.
+func (cfg *config) upstreamByPartition(partition string) *upstreamRoute {
+	for i, route := range cfg.upstreams {
+		if "@"+route.target.Host == partition {
+			return &cfg.upstreams[i]
+		}
+	}
+
+	return nil
+}
+
+// purgeUpstream evicts every entry of an upstream partition, on disk too.
+func (c *cache) purgeUpstream(partition string) int {
+	match := func(key string) bool {
+		p, _ := splitPartition(strings.TrimPrefix(key, c.keyPrefix))
+
+		return p == partition
+	}
+
+	n := 0
+
+	c.mu.Lock()
+	for key := range c.data {
+		if match(key) {
+			c.evict(key, EvictionReasonPurge)
+			n++
+		}
+	}
+	c.mu.Unlock()
+
+	return n + c.purgeDisk(match)
+}
+
+// upstreamsHandler lists the entries held per upstream on GET and purges the
+// entries of ?host= on DELETE, "default" naming the default origin.
+func upstreamsHandler(c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			counts := make(map[string]int)
+
+			c.mu.RLock()
+			for key := range c.data {
+				p, _ := splitPartition(strings.TrimPrefix(key, c.keyPrefix))
+				counts[strings.TrimPrefix(p, "@")]++
+			}
+			c.mu.RUnlock()
+
+			if n, ok := counts[""]; ok {
+				delete(counts, "")
+				counts["default"] = n
+			}
+
+			hosts := make([]string, 0, len(counts))
+			for host := range counts {
+				hosts = append(hosts, host)
+			}
+
+			sort.Strings(hosts)
+
+			type upstreamEntries struct {
+				Host    string `json:"host"`
+				Entries int    `json:"entries"`
+			}
+
+			list := make([]upstreamEntries, 0, len(hosts))
+			for _, host := range hosts {
+				list = append(list, upstreamEntries{Host: host, Entries: counts[host]})
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+
+			if err := json.NewEncoder(w).Encode(list); err != nil {
+				log.Printf("can't write to body %s", err)
+			}
+		case http.MethodDelete:
+			host := r.URL.Query().Get("host")
+			if host == "" {
+				cfg.writeError(w, r, http.StatusBadRequest)
+
+				return
+			}
+
+			partition := "@" + host
+			if host == "default" {
+				partition = ""
+			}
+
+			log.Printf("purged %d entries of upstream %s", c.purgeUpstream(partition), host)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			cfg.writeError(w, r, http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPartitions(t *testing.T) {
+	origin := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name + r.URL.Path))
+		}))
+	}
+
+	def, tenant, files := origin("default"), origin("tenant"), origin("files")
+	defer def.Close()
+	defer tenant.Close()
+	defer files.Close()
+
+	tenantURL, _ := url.Parse(tenant.URL)
+	filesURL, _ := url.Parse(files.URL)
+
+	cfg := &config{adminSecret: "secret", upstreams: []upstreamRoute{
+		{host: "tenant.example", target: tenantURL},
+		{prefix: "/files/", target: filesURL},
+	}}
+	c := newCache(time.Hour)
+	srv := httptest.NewServer(newProxy(def.URL, c, cfg).routes())
+	defer srv.Close()
+
+	get := func(host, path string) string {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if host != "" {
+			req.Host = host
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		return string(b)
+	}
+
+	for i := 0; i < 2; i++ {
+		if body := get("", "/users"); body != "default/users" {
+			t.Errorf("expected the default origin, got %q", body)
+		}
+
+		if body := get("tenant.example", "/users"); body != "tenant/users" {
+			t.Errorf("expected the tenant origin, got %q", body)
+		}
+
+		if body := get("", "/files/a.txt"); body != "files/files/a.txt" {
+			t.Errorf("expected the files origin, got %q", body)
+		}
+	}
+
+	if len(c.data) != 3 {
+		t.Errorf("expected one entry per origin, got %d", len(c.data))
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/_cache/upstreams?host="+tenantURL.Host, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rec := httptest.NewRecorder()
+	adminOnly(cfg, upstreamsHandler(c, cfg))(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	if _, ok := c.data["@"+tenantURL.Host+"/users"]; ok || len(c.data) != 2 {
+		t.Errorf("expected only the tenant entries to be purged, got %d entries", len(c.data))
+	}
+}
+
+func TestWildcardHostRoutes(t *testing.T) {
+	api, _ := url.Parse("http://api.internal")
+	img, _ := url.Parse("http://img.internal")
+	deep, _ := url.Parse("http://deep.internal")
+
+	cfg := &config{upstreams: []upstreamRoute{
+		{host: "*.example.com", target: img},
+		{host: "*.eu.example.com", target: deep},
+		{host: "api.example.com", target: api},
+	}}
+
+	for host, want := range map[string]*url.URL{
+		"api.example.com":      api,
+		"api.example.com:8080": api,
+		"img.example.com":      img,
+		"IMG.Example.com:443":  img,
+		"cdn.eu.example.com":   deep,
+		"example.com":          nil,
+		"badexample.com":       nil,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+
+		route := cfg.upstreamFor(r)
+		if (route == nil) != (want == nil) || (route != nil && route.target != want) {
+			t.Errorf("%s: expected %v, got %+v", host, want, route)
+		}
+	}
+}
+
+func TestUpstreamTTLAndUnmatched(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	cfg := &config{unmatched: UnmatchedNotFound, upstreams: []upstreamRoute{
+		{host: "*.example.com", target: target, ttl: time.Minute},
+	}}
+
+	proxyServer, c := newTestProxy(t, backend.URL, cfg)
+
+	for host, want := range map[string]int{
+		"api.example.com": http.StatusOK,
+		"other.test":      http.StatusNotFound,
+	} {
+		req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/test", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.Host = host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected %d, got %d", host, want, resp.StatusCode)
+		}
+	}
+
+	if d, ok := c.data["@"+target.Host+"/test"]; !ok || d.ttl != time.Minute {
+		t.Errorf("expected the route TTL on the entry, got %v %v", ok, d.ttl)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// variantSet orders the stored variants of one URL from most to least
+// recently used.
+type variantSet struct {
+	lru    *lruList
+	capped bool
+}
+
+// variantURL strips the request header component from key, leaving what
+// identifies the URL. That component is the last '#' of the key, as '#' is
+// escaped in the URI and the header values before it. Segments are parts of
+// one object, not variants of it, and are left out.
+func variantURL(key string) (string, bool) {
+	if isSegmentKey(key) {
+		return "", false
+	}
+
+	i := strings.LastIndexByte(key, '#')
+	if i < 0 {
+		return "", false
+	}
+
+	return key[:i], true
+}
+
+// trackVariant records key as the most recently used variant of its URL,
+// evicting the least recently used ones beyond maxVariants. Callers must hold
+// c.mu for writing.
+func (c *cache) trackVariant(key string) {
+	if c.maxVariants <= 0 {
+		return
+	}
+
+	url, ok := variantURL(key)
+	if !ok {
+		return
+	}
+
+	set := c.variants[url]
+	if set == nil {
+		if c.variants == nil {
+			c.variants = make(map[string]*variantSet)
+		}
+
+		set = &variantSet{lru: newLRU()}
+		c.variants[url] = set
+	}
+
+	set.lru.add(key)
+
+	for set.lru.len() > c.maxVariants {
+		if !set.capped {
+			set.capped = true
+			log.Printf("%s reached the cap of %d variants, evicting the least recently used", url, c.maxVariants)
+		}
+
+		oldest, ok := set.lru.oldest()
+		if !ok || oldest == key {
+			break
+		}
+
+		c.evict(oldest, EvictionReasonVariants)
+	}
+}
+
+// touchVariant marks key as just used among the variants of its URL.
+// Callers must hold c.mu.
+func (c *cache) touchVariant(key string) {
+	if c.maxVariants <= 0 {
+		return
+	}
+
+	if url, ok := variantURL(key); ok {
+		if set := c.variants[url]; set != nil {
+			set.lru.touch(key)
+		}
+	}
+}
+
+// forgetVariant drops key from the variants of its URL. Callers must hold c.mu
+// for writing.
+func (c *cache) forgetVariant(key string) {
+	url, ok := variantURL(key)
+	if !ok {
+		return
+	}
+
+	set := c.variants[url]
+	if set == nil {
+		return
+	}
+
+	set.lru.remove(key)
+
+	if set.lru.len() == 0 {
+		delete(c.variants, url)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// addVia appends the proxy to the Via header of an upstream request, as RFC
+// 9110 section 7.6.3 describes.
+func addVia(req *http.Request, id string) {
+	if id == "" {
+		return
+	}
+
+	proto := "1.1"
+	if req.ProtoMajor >= 2 {
+		proto = "2"
+	}
+
+	req.Header.Add("Via", proto+" "+id)
+}
+
+// hasVia reports whether the proxy is already listed in Via, i.e. the request
+// went through it before.
+func hasVia(h http.Header, id string) bool {
+	if id == "" {
+		return false
+	}
+
+	for _, v := range h.Values("Via") {
+		for _, entry := range strings.Split(v, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && fields[1] == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
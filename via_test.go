@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestViaLoopDetected(t *testing.T) {
+	var via string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		via = r.Header.Get("Via")
+		_, _ = w.Write([]byte("OK"))
+	}))
+
+	defer backend.Close()
+
+	cfg := &config{proxyID: "edge-1"}
+	proxyServer, _ := newTestProxy(t, backend.URL, cfg)
+
+	resp, err := http.Get(proxyServer.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if via != "1.1 edge-1" {
+		t.Errorf("expected Via 1.1 edge-1 upstream, got %q", via)
+	}
+
+	// A proxy pointed at itself sees its own id on the second pass.
+	var loop *httptest.Server
+
+	loop = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		newProxy(loop.URL, newCache(0), cfg).Handler().ServeHTTP(w, r)
+	}))
+
+	defer loop.Close()
+
+	resp, err = http.Get(loop.URL + "/test")
+	if err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("expected 508, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+	"time"
+)
+
+// warmProgress tracks start-up warming for readiness and stats. The zero
+// value is a warming with nothing to do, so it is complete.
+type warmProgress struct {
+	total    atomic.Int64
+	done     atomic.Int64
+	failed   atomic.Int64
+	started  atomic.Int64
+	complete atomic.Bool
+}
+
+// begin announces n paths to warm, before any readiness probe may see them.
+func (p *warmProgress) begin(n int) {
+	p.total.Store(int64(n))
+	p.started.Store(time.Now().UnixNano())
+	p.complete.Store(n == 0)
+}
+
+// ready reports whether warming completed or has been running for longer
+// than timeout, zero meaning no timeout.
+func (p *warmProgress) ready(timeout time.Duration) bool {
+	if p.total.Load() == 0 || p.complete.Load() {
+		return true
+	}
+
+	return timeout > 0 && time.Since(time.Unix(0, p.started.Load())) >= timeout
+}
+
+// warmStatus is the warming progress as reported by the stats endpoint.
+type warmStatus struct {
+	Total    int64 `json:"total"`
+	Done     int64 `json:"done"`
+	Failed   int64 `json:"failed"`
+	Complete bool  `json:"complete"`
+}
+
+func (p *warmProgress) status() warmStatus {
+	return warmStatus{
+		Total:    p.total.Load(),
+		Done:     p.done.Load(),
+		Failed:   p.failed.Load(),
+		Complete: p.total.Load() == 0 || p.complete.Load(),
+	}
+}
+
+// warm fetches each of paths from the origin and caches the responses exactly
+// like a client miss would, so the first real requests are hits.
+func warm(rp *httputil.ReverseProxy, cfg *config, paths []string, progress *warmProgress) {
+	for _, path := range paths {
+		if err := warmPath(rp, cfg, path); err != nil {
+			log.Printf("cannot warm %s %s", path, err)
+			progress.failed.Add(1)
+		}
+
+		progress.done.Add(1)
+	}
+
+	progress.complete.Store(true)
+	log.Printf("cache warming completed for %d paths", len(paths))
+}
+
+// readyHandler answers 503 until start-up warming is over, unless the
+// readiness gate ignores warming.
+func readyHandler(c *cache, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.readyIgnoresWarm && !c.warming.ready(cfg.warmTimeout) {
+			cfg.writeError(w, r, http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if _, err := w.Write([]byte("ok\n")); err != nil {
+			log.Printf("can't write to body %s", err)
+		}
+	}
+}
+
+func warmPath(rp *httputil.ReverseProxy, cfg *config, path string) error {
+	req, err := newFetchRequest(path)
+	if err != nil {
+		return err
+	}
+
+	return fetchInto(rp, routeRequest(req, cfg))
+}
+
+// newFetchRequest is a GET for path made by the proxy itself, which is always
+// admitted to the cache.
+func newFetchRequest(path string) (*http.Request, error) {
+	return http.NewRequestWithContext(withBypassAdmission(context.Background()), http.MethodGet, path, nil)
+}
+
+// fetchInto sends req to the origin and caches the response exactly like a
+// client miss.
+func fetchInto(rp *httputil.ReverseProxy, req *http.Request) error {
+	// The proxy's own requests carry no key headers of clients.
+	req = withFetchSource(req, nil)
+	rp.Director(req)
+
+	res, err := rp.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if err := rp.ModifyResponse(res); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, res.Body)
+
+	return err
+}